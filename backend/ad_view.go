@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adViewTokenTTL bounds how long after maturing a view token can still be redeemed
+const adViewTokenTTL = 30 * time.Minute
+
+var (
+	errAdViewMissing  = errors.New("ad view token missing")
+	errAdViewInvalid  = errors.New("ad view token invalid")
+	errAdViewSession  = errors.New("ad view token belongs to another session")
+	errAdViewImmature = errors.New("ad has not been watched long enough")
+	errAdViewExpired  = errors.New("ad view token expired")
+)
+
+// adViewClaims is the signed payload of a view token
+type adViewClaims struct {
+	AdID     int    `json:"ad"`
+	Session  string `json:"sid"` // hashed session key, never the raw MAC/IP
+	IssuedAt int64  `json:"iat"`
+	Wait     int    `json:"wait"` // seconds the guest must watch before the token matures
+}
+
+var (
+	adViewSecretOnce sync.Once
+	adViewSecret     []byte
+)
+
+func getAdViewSecret() []byte {
+	adViewSecretOnce.Do(func() {
+		if s := CleanEnv(os.Getenv("AD_VIEW_SECRET")); s != "" {
+			adViewSecret = []byte(s)
+			return
+		}
+		adViewSecret = make([]byte, 32)
+		rand.Read(adViewSecret)
+		slog.Warn("AD_VIEW_SECRET not set, using a per-process secret (view tokens won't work across instances)")
+	})
+	return adViewSecret
+}
+
+// adViewSession identifies the guest device a view token is bound to:
+// the hotspot MAC when MikroTik passed one along, the client IP otherwise
+func adViewSession(r *http.Request, params url.Values) string {
+	if mac := strings.ToLower(strings.TrimSpace(params.Get("mac"))); mac != "" {
+		return "mac:" + mac
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP is the address of the guest behind a request. The proxy headers
+// are only believed from a proxy on this host (nginx in deploy/); anyone
+// else could send them to dodge the per-address rate limits. Of
+// X-Forwarded-For the last entry counts, the one our proxy appended.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return host
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	return host
+}
+
+func hashSession(session string) string {
+	sum := sha256.Sum256([]byte(session))
+	return hex.EncodeToString(sum[:16])
+}
+
+func signAdView(payload string) string {
+	mac := hmac.New(sha256.New, getAdViewSecret())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func issueAdViewToken(adID int, session string, wait int, now time.Time) string {
+	claims, _ := json.Marshal(adViewClaims{
+		AdID:     adID,
+		Session:  hashSession(session),
+		IssuedAt: now.Unix(),
+		Wait:     wait,
+	})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + signAdView(payload)
+}
+
+func verifyAdViewToken(token, session string, now time.Time) (adViewClaims, error) {
+	var claims adViewClaims
+	if token == "" {
+		return claims, errAdViewMissing
+	}
+
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(signAdView(payload))) {
+		return claims, errAdViewInvalid
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		return claims, errAdViewInvalid
+	}
+
+	if claims.Session != hashSession(session) {
+		return claims, errAdViewSession
+	}
+	matured := time.Unix(claims.IssuedAt, 0).Add(time.Duration(claims.Wait) * time.Second)
+	if now.Before(matured) {
+		return claims, errAdViewImmature
+	}
+	if now.After(matured.Add(adViewTokenTTL)) {
+		return claims, errAdViewExpired
+	}
+	return claims, nil
+}
+
+func adViewSeconds(settings Settings) int {
+	return max(settings.AdViewSeconds, 0)
+}
+
+// adViewGate issues the view token for a guest about to be shown ad (nil when
+// there is no active ad) and how long they must watch it. ok is false when the
+// site does not require watching the ad.
+func adViewGate(r *http.Request, settings Settings, ad *ScheduledAd) (token string, wait int, ok bool) {
+	if !settings.AdViewRequired {
+		return "", 0, false
+	}
+	adID := 0
+	if ad != nil {
+		adID = ad.ID
+		wait = adViewSeconds(settings)
+	}
+	return issueAdViewToken(adID, adViewSession(r, r.URL.Query()), wait, time.Now()), wait, true
+}
+
+// checkAdView enforces the "watch ad before connecting" gate when it is enabled in settings
+func checkAdView(r *http.Request, settings Settings, params url.Values, token string) error {
+	if !settings.AdViewRequired {
+		return nil
+	}
+	if token == "" {
+		token = params.Get("view_token")
+	}
+	claims, err := verifyAdViewToken(token, adViewSession(r, params), time.Now())
+	if err != nil {
+		slog.InfoContext(r.Context(), "Ad view gate refused", "path", r.URL.Path, "error", err)
+		return err
+	}
+	slog.DebugContext(r.Context(), "Ad view verified", "ad", claims.AdID)
+	return nil
+}
+
+// refuseAdView answers a guest that tried to connect without a valid view token
+func refuseAdView(w http.ResponseWriter, err error) {
+	msg := "Please watch the ad before connecting"
+	if err == errAdViewImmature {
+		msg = "Please watch the ad until the end before connecting"
+	}
+	http.Error(w, msg, http.StatusForbidden)
+}
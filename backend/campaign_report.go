@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+type AdDelivery struct {
+	AdID        int    `json:"ad_id"`
+	Title       string `json:"title"`
+	Impressions int    `json:"impressions"`
+}
+
+type DailyDelivery struct {
+	Date        string `json:"date"`
+	Impressions int    `json:"impressions"`
+}
+
+// CampaignReport summarizes delivery of a campaign against its goal, for sponsors
+type CampaignReport struct {
+	Campaign       Campaign        `json:"campaign"`
+	ContactName    string          `json:"contact_name"`
+	ContactEmail   string          `json:"contact_email"`
+	GeneratedAt    time.Time       `json:"generated_at"`
+	Status         string          `json:"status"` // 'scheduled', 'running', 'completed'
+	FlightDays     int             `json:"flight_days"`
+	ElapsedDays    int             `json:"elapsed_days"`
+	Impressions    int             `json:"impressions"`
+	GoalProgress   float64         `json:"goal_progress"`    // % of impression_goal delivered
+	ExpectedToDate int             `json:"expected_to_date"` // linear pacing target for today
+	PacingIndex    float64         `json:"pacing_index"`     // % of expected_to_date delivered
+	Ads            []AdDelivery    `json:"ads"`
+	Daily          []DailyDelivery `json:"daily"`
+}
+
+func (s *Server) GetCampaignReport(w http.ResponseWriter, r *http.Request) {
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	report, found, err := s.loadCampaignReport(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to build campaign report", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to build campaign report", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Campaign not found", nil)
+		return
+	}
+
+	filename := fmt.Sprintf("campaign_%d_report_%s", id, report.GeneratedAt.Format("20060102"))
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", filename))
+		writeCampaignReportCSV(w, report)
+	case "pdf":
+		var buf bytes.Buffer
+		if err := writeCampaignReportPDF(&buf, report); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to render campaign report PDF", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to render PDF", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.pdf", filename))
+		w.Write(buf.Bytes())
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	default:
+		writeJSONError(w, http.StatusBadRequest, "Unsupported format (use json, csv or pdf)", nil)
+	}
+}
+
+// loadCampaignReport gathers a campaign's delivery; false when the campaign does not exist
+func (s *Server) loadCampaignReport(id int) (CampaignReport, bool, error) {
+	var report CampaignReport
+	c, err := s.Campaigns.Campaign(id)
+	if err != nil || c == nil {
+		return report, false, err
+	}
+	report.Campaign = *c
+
+	advertiser, err := s.Campaigns.Advertiser(c.AdvertiserID)
+	if err != nil {
+		return report, false, err
+	}
+	if advertiser != nil {
+		report.ContactName = advertiser.ContactName
+		report.ContactEmail = advertiser.ContactEmail
+	}
+
+	report.Ads, report.Daily, err = s.Campaigns.CampaignDelivery(id)
+	if err != nil {
+		return report, false, err
+	}
+
+	loc, _ := time.LoadLocation("Asia/Makassar")
+	computeCampaignPacing(&report, time.Now().In(loc))
+	return report, true, nil
+}
+
+// computeCampaignPacing fills the totals, status and pacing figures from the delivery rows
+func computeCampaignPacing(report *CampaignReport, now time.Time) {
+	report.GeneratedAt = now
+	report.Impressions = 0
+	for _, d := range report.Daily {
+		report.Impressions += d.Impressions
+	}
+
+	goal := report.Campaign.ImpressionGoal
+	if goal > 0 {
+		report.GoalProgress = round2(float64(report.Impressions) * 100 / float64(goal))
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	start, errStart := time.Parse("2006-01-02", report.Campaign.StartDate)
+	end, errEnd := time.Parse("2006-01-02", report.Campaign.EndDate)
+
+	report.Status = "running"
+	if errStart == nil && today.Before(start) {
+		report.Status = "scheduled"
+	} else if errEnd == nil && today.After(end) {
+		report.Status = "completed"
+	}
+
+	// Pacing needs a closed flight window to spread the goal over
+	if errStart != nil || errEnd != nil || end.Before(start) {
+		return
+	}
+	report.FlightDays = int(end.Sub(start).Hours()/24) + 1
+	switch report.Status {
+	case "scheduled":
+		report.ElapsedDays = 0
+	case "completed":
+		report.ElapsedDays = report.FlightDays
+	default:
+		report.ElapsedDays = int(today.Sub(start).Hours()/24) + 1
+	}
+
+	if goal > 0 {
+		report.ExpectedToDate = int(math.Round(float64(goal) * float64(report.ElapsedDays) / float64(report.FlightDays)))
+		if report.ExpectedToDate > 0 {
+			report.PacingIndex = round2(float64(report.Impressions) * 100 / float64(report.ExpectedToDate))
+		}
+	}
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+func writeCampaignReportCSV(w io.Writer, report CampaignReport) {
+	cw := csv.NewWriter(w)
+	c := report.Campaign
+
+	cw.Write([]string{"Campaign", c.Name})
+	cw.Write([]string{"Advertiser", c.AdvertiserName})
+	cw.Write([]string{"Flight", c.StartDate, c.EndDate})
+	cw.Write([]string{"Status", report.Status})
+	cw.Write([]string{"Impression goal", strconv.Itoa(c.ImpressionGoal)})
+	cw.Write([]string{"Impressions delivered", strconv.Itoa(report.Impressions)})
+	cw.Write([]string{"Goal progress %", strconv.FormatFloat(report.GoalProgress, 'f', 2, 64)})
+	cw.Write([]string{"Expected to date", strconv.Itoa(report.ExpectedToDate)})
+	cw.Write([]string{"Pacing index %", strconv.FormatFloat(report.PacingIndex, 'f', 2, 64)})
+	cw.Write([]string{"Generated at", report.GeneratedAt.Format(time.RFC3339)})
+	cw.Write(nil)
+
+	cw.Write([]string{"ad_id", "title", "impressions"})
+	for _, d := range report.Ads {
+		cw.Write([]string{strconv.Itoa(d.AdID), d.Title, strconv.Itoa(d.Impressions)})
+	}
+	cw.Write(nil)
+
+	cw.Write([]string{"date", "impressions"})
+	for _, d := range report.Daily {
+		cw.Write([]string{d.Date, strconv.Itoa(d.Impressions)})
+	}
+	cw.Flush()
+}
+
+func writeCampaignReportPDF(buf *bytes.Buffer, report CampaignReport) error {
+	c := report.Campaign
+	pdf := fpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.CellFormat(0, 10, tr("Campaign Delivery Report"), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, tr("Generated "+report.GeneratedAt.Format("2 Jan 2006 15:04 MST")), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	flight := "open-ended"
+	if c.StartDate != "" || c.EndDate != "" {
+		flight = fmt.Sprintf("%s to %s", c.StartDate, c.EndDate)
+	}
+	summary := [][2]string{
+		{"Advertiser", c.AdvertiserName},
+		{"Campaign", c.Name},
+		{"Flight", flight},
+		{"Status", report.Status},
+		{"Impression goal", strconv.Itoa(c.ImpressionGoal)},
+		{"Impressions delivered", strconv.Itoa(report.Impressions)},
+		{"Goal progress", fmt.Sprintf("%.2f%%", report.GoalProgress)},
+		{"Expected to date", strconv.Itoa(report.ExpectedToDate)},
+		{"Pacing index", fmt.Sprintf("%.2f%%", report.PacingIndex)},
+	}
+	for _, row := range summary {
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.CellFormat(55, 7, tr(row[0]), "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 11)
+		pdf.CellFormat(0, 7, tr(row[1]), "", 1, "L", false, 0, "")
+	}
+
+	pdf.Ln(6)
+	pdf.SetFont("Helvetica", "B", 13)
+	pdf.CellFormat(0, 8, "Delivery by ad", "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(20, 7, "ID", "1", 0, "L", false, 0, "")
+	pdf.CellFormat(120, 7, "Title", "1", 0, "L", false, 0, "")
+	pdf.CellFormat(40, 7, "Impressions", "1", 1, "R", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	for _, d := range report.Ads {
+		pdf.CellFormat(20, 7, strconv.Itoa(d.AdID), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(120, 7, tr(d.Title), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(40, 7, strconv.Itoa(d.Impressions), "1", 1, "R", false, 0, "")
+	}
+
+	pdf.Ln(6)
+	pdf.SetFont("Helvetica", "B", 13)
+	pdf.CellFormat(0, 8, "Daily delivery", "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(60, 7, "Date", "1", 0, "L", false, 0, "")
+	pdf.CellFormat(40, 7, "Impressions", "1", 1, "R", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	for _, d := range report.Daily {
+		pdf.CellFormat(60, 7, d.Date, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(40, 7, strconv.Itoa(d.Impressions), "1", 1, "R", false, 0, "")
+	}
+
+	return pdf.Output(buf)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Advertiser struct {
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	ContactName  string    `json:"contact_name"`
+	ContactEmail string    `json:"contact_email"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Campaign groups ads of one advertiser under a flight window and an impression goal
+type Campaign struct {
+	ID             int       `json:"id"`
+	AdvertiserID   int       `json:"advertiser_id"`
+	AdvertiserName string    `json:"advertiser_name,omitempty"`
+	Name           string    `json:"name"`
+	StartDate      string    `json:"start_date"`
+	EndDate        string    `json:"end_date"`
+	ImpressionGoal int       `json:"impression_goal"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (s *Server) GetAdvertisers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+	advertisers, err := s.Campaigns.Advertisers()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load advertisers", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load advertisers", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(advertisers)
+}
+
+func (s *Server) CreateAdvertiser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	var a Advertiser
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	if errs := validateAdvertiser(&a); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if err := s.Campaigns.CreateAdvertiser(&a); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create advertiser", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create advertiser", nil)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Advertiser created", "advertiser", a.ID, "name", a.Name)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": a.ID})
+}
+
+func (s *Server) UpdateAdvertiser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var a Advertiser
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	if errs := validateAdvertiser(&a); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	a.ID = id
+	found, err := s.Campaigns.UpdateAdvertiser(a)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update advertiser", "advertiser", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update advertiser", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Advertiser not found", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func (s *Server) DeleteAdvertiser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+	found, err := s.Campaigns.DeleteAdvertiser(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete advertiser", "advertiser", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete advertiser", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Advertiser not found", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func (s *Server) GetCampaigns(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	advertiserID := 0
+	if advertiser := r.URL.Query().Get("advertiser_id"); advertiser != "" {
+		id, err := strconv.Atoi(advertiser)
+		if err != nil || id <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "Invalid advertiser_id", nil)
+			return
+		}
+		advertiserID = id
+	}
+
+	campaigns, err := s.Campaigns.Campaigns(advertiserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load campaigns", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load campaigns", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(campaigns)
+}
+
+func (s *Server) CreateCampaign(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	var c Campaign
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	if errs := s.validateCampaign(&c); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if err := s.Campaigns.CreateCampaign(&c); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create campaign", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create campaign", nil)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Campaign created", "campaign", c.ID, "name", c.Name, "advertiser", c.AdvertiserID)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": c.ID})
+}
+
+func (s *Server) UpdateCampaign(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var c Campaign
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	if errs := s.validateCampaign(&c); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	c.ID = id
+	found, err := s.Campaigns.UpdateCampaign(c)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update campaign", "campaign", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update campaign", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Campaign not found", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func (s *Server) DeleteCampaign(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+	found, err := s.Campaigns.DeleteCampaign(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete campaign", "campaign", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete campaign", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Campaign not found", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func validateAdvertiser(a *Advertiser) ValidationErrors {
+	errs := ValidationErrors{}
+	a.Name = strings.TrimSpace(a.Name)
+	a.ContactName = strings.TrimSpace(a.ContactName)
+	a.ContactEmail = strings.TrimSpace(a.ContactEmail)
+	if a.Name == "" {
+		errs.Add("name", "is required")
+	}
+	if a.ContactEmail != "" && !strings.Contains(a.ContactEmail, "@") {
+		errs.Add("contact_email", "must be an email address")
+	}
+	return errs
+}
+
+func (s *Server) validateCampaign(c *Campaign) ValidationErrors {
+	errs := ValidationErrors{}
+	c.Name = strings.TrimSpace(c.Name)
+	c.StartDate = strings.TrimSpace(c.StartDate)
+	c.EndDate = strings.TrimSpace(c.EndDate)
+	if c.Name == "" {
+		errs.Add("name", "is required")
+	}
+	if c.ImpressionGoal < 0 {
+		errs.Add("impression_goal", "must not be negative")
+	}
+	start, startOK := parseAdDate(errs, "start_date", &c.StartDate)
+	end, endOK := parseAdDate(errs, "end_date", &c.EndDate)
+	if startOK && endOK && end.Before(start) {
+		errs.Add("end_date", "must not be before start_date")
+	}
+
+	if c.AdvertiserID <= 0 {
+		errs.Add("advertiser_id", "is required")
+	} else if a, _ := s.Campaigns.Advertiser(c.AdvertiserID); a == nil {
+		errs.Add("advertiser_id", "advertiser %d does not exist", c.AdvertiserID)
+	}
+	return errs
+}
+
+// recordImpression counts one served ad towards today's delivery
+func (s *Server) recordImpression(ad ScheduledAd, day string) {
+	s.metrics.adImpressions.Inc()
+	if err := s.Ads.RecordImpression(ad, day); err != nil {
+		slog.Error("Failed to record impression", "ad", ad.ID, "error", err)
+	}
+}
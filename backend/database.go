@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	_ "modernc.org/sqlite"
+)
+
+// The SQL dialects the backend can run on
+const (
+	dialectPostgres = "postgres"
+	dialectSQLite   = "sqlite"
+)
+
+// sqliteOptions are added to every SQLite DSN: enforce foreign keys, wait for
+// a busy database instead of failing, let readers run beside the writer, and
+// take the write lock when a transaction begins (which serialises settings
+// saves the way Postgres' advisory locks do)
+const sqliteOptions = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite&_txlock=immediate"
+
+// Database is the open database together with the dialect it speaks
+type Database struct {
+	*sql.DB
+	Dialect string
+}
+
+// openDatabase opens DATABASE_URL. A sqlite: or file: URL selects the
+// embedded SQLite database for single-box deployments (sqlite:portal.db,
+// sqlite:///var/lib/portal/portal.db); anything else, postgres:// URLs and
+// key=value strings alike, is handed to Postgres.
+func openDatabase(connStr string) (*Database, error) {
+	if dsn, ok := sqliteDSN(connStr); ok {
+		db, err := openTracedDB("sqlite", dsn, semconv.DBSystemSqlite)
+		if err != nil {
+			return nil, err
+		}
+		return &Database{DB: db, Dialect: dialectSQLite}, nil
+	}
+
+	db, err := openTracedDB("postgres", connStr, semconv.DBSystemPostgreSQL)
+	if err != nil {
+		return nil, err
+	}
+	return &Database{DB: db, Dialect: dialectPostgres}, nil
+}
+
+// sqliteDSN turns a sqlite: or file: URL into the driver's DSN
+func sqliteDSN(connStr string) (string, bool) {
+	var dsn string
+	switch {
+	case strings.HasPrefix(connStr, "sqlite://"):
+		dsn = strings.TrimPrefix(connStr, "sqlite://")
+	case strings.HasPrefix(connStr, "sqlite:"):
+		dsn = strings.TrimPrefix(connStr, "sqlite:")
+	case strings.HasPrefix(connStr, "file:"):
+		dsn = connStr
+	default:
+		return "", false
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + sqliteOptions, true
+	}
+	return dsn + "?" + sqliteOptions, true
+}
+
+// NewStore returns the Store for the database's dialect
+func NewStore(db *Database) Store {
+	if db.Dialect == dialectSQLite {
+		return NewSQLiteStore(db.DB)
+	}
+	return NewPostgresStore(db.DB)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// readyCheckTimeout bounds each component check of /readyz
+const readyCheckTimeout = 2 * time.Second
+
+// storageProbeKey is written and removed again to check upload storage is writable
+const storageProbeKey = "readyz-probe.txt"
+
+// ComponentStatus is one component's line in /readyz
+type ComponentStatus struct {
+	Status    string `json:"status"` // 'ok' or 'unavailable'
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// HealthCheck is the liveness probe (/healthz, and /health for older probes):
+// the process is up and serving. It does not look at dependencies; a restart
+// would not fix those.
+func HealthCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// ReadyCheck is the readiness probe (/readyz): the database answers and is
+// migrated, upload storage takes writes, and the default site's settings are
+// loaded. Any failing component makes it 503, with the details per component.
+func (s *Server) ReadyCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	components := map[string]ComponentStatus{
+		"database": runCheck(r.Context(), s.checkDatabase),
+		"storage":  runCheck(r.Context(), s.checkStorage),
+		"settings": runCheck(r.Context(), s.checkSettings),
+	}
+	status, code := "ok", http.StatusOK
+	for _, c := range components {
+		if c.Status != "ok" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     status,
+		"components": components,
+	})
+}
+
+func runCheck(ctx context.Context, check func(context.Context) error) ComponentStatus {
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	c := ComponentStatus{Status: "ok", LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		c.Status = "unavailable"
+		c.Error = err.Error()
+	}
+	return c
+}
+
+func (s *Server) checkDatabase(ctx context.Context) error {
+	if err := s.store.Ping(ctx); err != nil {
+		return err
+	}
+	if s.schemaPending.Load() {
+		return fmt.Errorf("migrations not applied yet")
+	}
+	return nil
+}
+
+func (s *Server) checkStorage(ctx context.Context) error {
+	probe := []byte(time.Now().UTC().Format(time.RFC3339))
+	if err := s.Storage.Put(ctx, storageProbeKey, bytes.NewReader(probe), int64(len(probe)), "text/plain"); err != nil {
+		return err
+	}
+	return s.Storage.Delete(ctx, storageProbeKey)
+}
+
+func (s *Server) checkSettings(ctx context.Context) error {
+	_, err := s.settingsCache.Get(defaultSiteID)
+	return err
+}
+
+// startupMode is STARTUP_MODE: 'degraded' (the default) starts serving without
+// a database and keeps trying to connect in the background; 'fail-fast' exits
+// when the database is not reachable within DB_CONNECT_TIMEOUT.
+func startupMode() (failFast bool) {
+	switch mode := strings.ToLower(CleanEnv(os.Getenv("STARTUP_MODE"))); mode {
+	case "", "degraded":
+		return false
+	case "fail-fast":
+		return true
+	default:
+		slog.Warn("Ignoring unknown STARTUP_MODE, starting degraded", "mode", mode)
+		return false
+	}
+}
+
+// dbConnectTimeout is DB_CONNECT_TIMEOUT (default 30s): how long startup
+// retries the first database connection (0: until it answers)
+func dbConnectTimeout() time.Duration {
+	return envDuration("DB_CONNECT_TIMEOUT", 30*time.Second)
+}
+
+// Backoff between database connection attempts
+const (
+	dbRetryInitial = 500 * time.Millisecond
+	dbRetryMax     = 15 * time.Second
+)
+
+// waitForDatabase pings the database until it answers, backing off
+// exponentially between attempts. It gives up after timeout; 0 retries forever.
+func waitForDatabase(db *Database, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	delay := dbRetryInitial
+	for attempt := 1; ; attempt++ {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		if !deadline.IsZero() && time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("database not reachable after %d attempts: %v", attempt, err)
+		}
+		slog.Warn("Database not reachable, retrying", "attempt", attempt, "delay", delay.String(), "error", err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > dbRetryMax {
+			delay = dbRetryMax
+		}
+	}
+}
+
+// prepareDatabase migrates a reachable database and starts listening for
+// changes; readiness reports the database once it is done
+func (s *Server) prepareDatabase(db *Database, connStr string) error {
+	// Serving against a half-migrated schema does more harm than not serving
+	n, err := migrateUp(db, 0)
+	if err != nil {
+		return err
+	}
+	slog.Info("Database schema up to date", "applied", n)
+	s.schemaPending.Store(false)
+
+	if db.Dialect == dialectPostgres {
+		// Only Postgres can be shared by several instances
+		s.listenForChanges(connStr)
+	}
+	return nil
+}
+
+// connectInBackground is degraded mode: keep trying the database and prepare
+// it once it answers. Until then /readyz reports it unavailable and the
+// endpoints needing it answer with errors.
+func (s *Server) connectInBackground(db *Database, connStr string) {
+	go func() {
+		waitForDatabase(db, 0)
+		slog.Info("Database connected, leaving degraded mode", "dialect", db.Dialect)
+		if err := s.prepareDatabase(db, connStr); err != nil {
+			slog.Error("Database migration failed, staying degraded", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// HTTPConfig is how the backend listens, from the environment:
+//
+//	LISTEN_ADDR               address to listen on (0.0.0.0:8080)
+//	HTTP_READ_HEADER_TIMEOUT  time to send the request headers (10s)
+//	HTTP_READ_TIMEOUT         time to send the whole request, uploads included (60s)
+//	HTTP_WRITE_TIMEOUT        time to write the response (60s)
+//	HTTP_IDLE_TIMEOUT         keep-alive time between requests (120s)
+//	HTTP_MAX_HEADER_BYTES     request header size limit (65536)
+//	SHUTDOWN_TIMEOUT          time in-flight requests get to finish on SIGTERM (30s)
+//	OUTBOUND_HTTP_TIMEOUT     limit for calls to the OAuth providers (10s)
+type HTTPConfig struct {
+	Addr              string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	ShutdownTimeout   time.Duration
+}
+
+func httpConfigFromEnv() HTTPConfig {
+	addr := CleanEnv(os.Getenv("LISTEN_ADDR"))
+	if addr == "" {
+		addr = "0.0.0.0:8080"
+	}
+	return HTTPConfig{
+		Addr:              addr,
+		ReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 60*time.Second),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    envInt("HTTP_MAX_HEADER_BYTES", 64<<10),
+		ShutdownTimeout:   envDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+	}
+}
+
+// envDuration reads a duration like "30s" from the environment; unset or
+// invalid values give def
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := CleanEnv(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		slog.Warn("Ignoring invalid setting", "name", name, "value", raw)
+		return def
+	}
+	return d
+}
+
+// envInt reads a positive number from the environment; unset or invalid values give def
+func envInt(name string, def int) int {
+	raw := CleanEnv(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		slog.Warn("Ignoring invalid setting", "name", name, "value", raw)
+		return def
+	}
+	return n
+}
+
+// newHTTPServer wraps the handler in an http.Server with every timeout set,
+// so slow or idle clients cannot hold connections open indefinitely
+func newHTTPServer(cfg HTTPConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// serve runs the servers until one fails or SIGINT or SIGTERM arrives, then
+// stops accepting connections and gives in-flight requests (a guest halfway
+// through a login) up to the shutdown timeout to finish. Servers with a
+// TLSConfig serve HTTPS.
+func serve(shutdownTimeout time.Duration, servers ...*http.Server) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	errc := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if server.TLSConfig != nil {
+				slog.Info("Serving HTTPS", "addr", server.Addr)
+				errc <- server.ListenAndServeTLS("", "")
+			} else {
+				slog.Info("Serving HTTP", "addr", server.Addr)
+				errc <- server.ListenAndServe()
+			}
+		}(server)
+	}
+
+	var failed error
+	returned := 0
+	select {
+	case failed = <-errc:
+		returned++
+		slog.Error("Server stopped, shutting down", "error", failed)
+	case sig := <-stop:
+		slog.Info("Signal received, draining requests", "signal", sig.String(), "timeout", shutdownTimeout.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	for ; returned < len(servers); returned++ {
+		if err := <-errc; !errors.Is(err, http.ErrServerClosed) && failed == nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// newOutboundClient is the client for calls to the OAuth providers. Unlike
+// http.DefaultClient it gives up on a provider that does not answer, instead
+// of leaving the guest's login hanging, and traces each call.
+func newOutboundClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: tracingTransport{next: http.DefaultTransport}}
+}
+
+// outboundGet is a GET to an OAuth provider, cancelled with the guest's request
+func (s *Server) outboundGet(ctx context.Context, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Do(req)
+}
+
+// outboundPostForm is a form POST to an OAuth provider, cancelled with the guest's request
+func (s *Server) outboundPostForm(ctx context.Context, target string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return s.client.Do(req)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeDrainsOnSignal(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	cfg := HTTPConfig{Addr: addr, ReadHeaderTimeout: time.Second, ShutdownTimeout: 5 * time.Second}
+
+	served := make(chan error, 1)
+	go func() { served <- serve(cfg.ShutdownTimeout, newHTTPServer(cfg, handler)) }()
+
+	// A guest is halfway through a request when the deploy sends SIGTERM
+	body := make(chan string, 1)
+	go func() {
+		for {
+			resp, err := http.Get("http://" + addr)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			raw, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			body <- string(raw)
+			return
+		}
+	}()
+	<-started
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned before the request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	if got := <-body; got != "done" {
+		t.Errorf("in-flight request got %q", got)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+	if _, err := http.Get("http://" + addr); err == nil {
+		t.Error("server still accepts connections after shutdown")
+	}
+}
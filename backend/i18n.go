@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// supportedLocales are the languages guest-facing text can be translated into.
+// The plain setting values and ad fields are the untranslated source text.
+var supportedLocales = []string{"en", "id", "ru", "zh"}
+
+func isSupportedLocale(locale string) bool {
+	for _, l := range supportedLocales {
+		if l == locale {
+			return true
+		}
+	}
+	return false
+}
+
+// portalStrings are the fixed texts of the built-in portal theme, per locale
+var portalStrings = map[string]map[string]string{
+	"en": {"continue_google": "Continue with Google", "continue_facebook": "Continue with Facebook", "email_placeholder": "Your email", "connect_in": "You can connect in", "seconds": "s"},
+	"id": {"continue_google": "Lanjutkan dengan Google", "continue_facebook": "Lanjutkan dengan Facebook", "email_placeholder": "Email Anda", "connect_in": "Anda dapat terhubung dalam", "seconds": "dtk"},
+	"ru": {"continue_google": "Продолжить с Google", "continue_facebook": "Продолжить с Facebook", "email_placeholder": "Ваш email", "connect_in": "Подключиться можно через", "seconds": "с"},
+	"zh": {"continue_google": "使用 Google 继续", "continue_facebook": "使用 Facebook 继续", "email_placeholder": "您的邮箱", "connect_in": "可连接倒计时", "seconds": "秒"},
+}
+
+// localizedKey is the page_settings key holding a setting's translation
+func localizedKey(key, locale string) string {
+	return key + "." + locale
+}
+
+// matchLocale maps a language tag like "zh-Hans-CN" or "id_ID" to a supported locale
+func matchLocale(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(strings.ReplaceAll(tag, "_", "-")))
+	base, _, _ := strings.Cut(tag, "-")
+	if isSupportedLocale(base) {
+		return base, true
+	}
+	return "", false
+}
+
+// negotiateLocale picks the guest's locale: the lang query parameter, then the
+// Accept-Language preferences in q order, then the site's default locale
+func negotiateLocale(r *http.Request, siteDefault string) string {
+	if locale, ok := matchLocale(r.URL.Query().Get("lang")); ok {
+		return locale
+	}
+
+	type pref struct {
+		tag string
+		q   float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, pref{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		if locale, ok := matchLocale(p.tag); ok {
+			return locale
+		}
+	}
+
+	if isSupportedLocale(siteDefault) {
+		return siteDefault
+	}
+	return supportedLocales[0]
+}
+
+// localeChain is the fallback order for a locale: the locale itself, then the
+// site's default locale. Past the end of the chain the untranslated value applies.
+func localeChain(locale, siteDefault string) []string {
+	chain := []string{locale}
+	if siteDefault != locale && isSupportedLocale(siteDefault) {
+		chain = append(chain, siteDefault)
+	}
+	return chain
+}
+
+// localizeSettings returns stored settings with every localized key replaced by
+// its best translation along the chain
+func localizeSettings(stored map[string]string, chain []string) map[string]string {
+	out := copySettings(stored)
+	for _, def := range settingsSchema {
+		if !def.Localized {
+			continue
+		}
+		for _, locale := range chain {
+			if v := stored[localizedKey(def.Key, locale)]; v != "" {
+				out[def.Key] = v
+				break
+			}
+		}
+	}
+	return out
+}
+
+// guestLocale negotiates the locale for a guest of the site and returns it with its fallback chain
+func guestLocale(r *http.Request, stored map[string]string) (string, []string) {
+	siteDefault := settingsValues(stored)["default_locale"]
+	locale := negotiateLocale(r, siteDefault)
+	return locale, localeChain(locale, siteDefault)
+}
+
+// setLocaleHeaders marks a response as negotiated on the guest's language
+func setLocaleHeaders(w http.ResponseWriter, locale string) {
+	w.Header().Set("Content-Language", locale)
+	w.Header().Add("Vary", "Accept-Language")
+}
+
+// AdTranslation is an ad's title and description in one locale
+type AdTranslation struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// localizeAd swaps in the ad's best translation along the chain, field by field
+func (s *Server) localizeAd(ad *ScheduledAd, chain []string) {
+	if ad == nil {
+		return
+	}
+	translations, err := s.Ads.AdTranslations(ad.ID)
+	if err != nil {
+		slog.Warn("Failed to load ad translations", "ad", ad.ID, "error", err)
+		return
+	}
+	titled, described := false, false
+	for _, locale := range chain {
+		t, ok := translations[locale]
+		if !ok {
+			continue
+		}
+		if !titled && t.Title != "" {
+			ad.Title, titled = t.Title, true
+		}
+		if !described && t.Description != "" {
+			ad.Description, described = t.Description, true
+		}
+	}
+}
+
+// localeFromRequest parses the {locale} route variable, answering 404 itself when it is not supported
+func localeFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	locale := strings.ToLower(mux.Vars(r)["locale"])
+	if !isSupportedLocale(locale) {
+		writeJSONError(w, http.StatusNotFound, "Unsupported locale, use one of "+strings.Join(supportedLocales, ", "), nil)
+		return "", false
+	}
+	return locale, true
+}
+
+// GetTranslations lists the site's setting translations per locale, for the admin translation editor
+func (s *Server) GetTranslations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	stored, err := s.settingsCache.Get(site.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load translations", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load translations", nil)
+		return
+	}
+
+	fields := []string{}
+	source := map[string]string{}
+	values := settingsValues(stored)
+	for _, def := range settingsSchema {
+		if def.Localized {
+			fields = append(fields, def.Key)
+			source[def.Key] = values[def.Key]
+		}
+	}
+	translations := map[string]map[string]string{}
+	for _, locale := range supportedLocales {
+		translations[locale] = map[string]string{}
+		for _, key := range fields {
+			if v, ok := stored[localizedKey(key, locale)]; ok {
+				translations[locale][key] = v
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"locales":        supportedLocales,
+		"default_locale": values["default_locale"],
+		"fields":         fields,
+		"source":         source,
+		"settings":       translations,
+	})
+}
+
+// UpdateSettingTranslations sets a locale's translations of localized settings;
+// null removes a translation. They are ordinary settings keys, so they are
+// revisioned like every other settings change.
+func (s *Server) UpdateSettingTranslations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	locale, ok := localeFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+
+	changes := map[string]*string{}
+	errs := ValidationErrors{}
+	for key, raw := range body {
+		if !settingsByKey[key].Localized {
+			errs.Add(key, "is not a translatable setting")
+			continue
+		}
+		value, err := decodeSetting(localizedKey(key, locale), raw, true)
+		if err != nil {
+			errs.Add(key, "%s", err.Error())
+			continue
+		}
+		changes[localizedKey(key, locale)] = value
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	revision, err := s.saveSettings(site.ID, changes, requestAdmin(r), "translate")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save setting translations", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save translations", nil)
+		return
+	}
+	if revision > 0 {
+		slog.InfoContext(r.Context(), "Setting translations saved", "site", site.Slug, "locale", locale, "revision", revision)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "revision_id": revision})
+}
+
+// siteAdFromRequest checks the {id} ad exists on the admin's site, answering the request itself when not
+func (s *Server) siteAdFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return 0, false
+	}
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return 0, false
+	}
+	ad, err := s.Ads.Ad(site.ID, id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Ad lookup failed", "ad", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load ad", nil)
+		return 0, false
+	}
+	if ad == nil {
+		writeJSONError(w, http.StatusNotFound, "Ad not found", nil)
+		return 0, false
+	}
+	return id, true
+}
+
+// GetAdTranslations lists an ad's translations by locale
+func (s *Server) GetAdTranslations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := s.siteAdFromRequest(w, r)
+	if !ok {
+		return
+	}
+	translations, err := s.Ads.AdTranslations(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load ad translations", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load translations", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(translations)
+}
+
+// UpdateAdTranslation sets an ad's title and description in one locale. An
+// empty field falls back along the guest's locale chain.
+func (s *Server) UpdateAdTranslation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := s.siteAdFromRequest(w, r)
+	if !ok {
+		return
+	}
+	locale, ok := localeFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var t AdTranslation
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+
+	t.Title = strings.TrimSpace(t.Title)
+	t.Description = strings.TrimSpace(t.Description)
+	errs := ValidationErrors{}
+	if utf8.RuneCountInString(t.Title) > 200 {
+		errs.Add("title", "must be at most 200 characters")
+	}
+	if utf8.RuneCountInString(t.Description) > 2000 {
+		errs.Add("description", "must be at most 2000 characters")
+	}
+	if t.Title == "" && t.Description == "" {
+		errs.Add("title", "title or description is required (DELETE removes a translation)")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if err := s.Ads.SaveAdTranslation(id, locale, t); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save ad translation", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save translation", nil)
+		return
+	}
+	slog.InfoContext(r.Context(), "Ad translation saved", "ad", id, "locale", locale)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func (s *Server) DeleteAdTranslation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, ok := s.siteAdFromRequest(w, r)
+	if !ok {
+		return
+	}
+	locale, ok := localeFromRequest(w, r)
+	if !ok {
+		return
+	}
+	found, err := s.Ads.DeleteAdTranslation(id, locale)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete ad translation", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete translation", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Translation not found", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
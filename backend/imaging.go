@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gen2brain/webp"
+	"golang.org/x/image/draw"
+)
+
+// variantWidths are the responsive widths generated for every uploaded image.
+// Widths above the source width are skipped; the source width (capped at the
+// largest entry) is always included.
+var variantWidths = []int{480, 960, 1440, 1920}
+
+const (
+	variantJPEGQuality = 82
+	variantWebPQuality = 75
+)
+
+// ImageVariant is one rendition of an uploaded image
+type ImageVariant struct {
+	Key    string `json:"key"`
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"` // 'jpeg', 'png', 'webp'
+	Size   int64  `json:"size"`
+}
+
+// ImageVariantSet is the srcset-style manifest returned for processed images
+type ImageVariantSet struct {
+	Src        string         `json:"src"` // largest fallback rendition, use as <img src>
+	Width      int            `json:"width"`
+	Height     int            `json:"height"`
+	Srcset     string         `json:"srcset"`
+	WebPSrcset string         `json:"webp_srcset"`
+	Variants   []ImageVariant `json:"variants"`
+}
+
+// processableImage reports whether an upload gets resized variants.
+// GIFs are left alone so animations survive.
+func processableImage(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png" || contentType == "image/webp"
+}
+
+// processImageVariants decodes a staged upload, applies its EXIF orientation and
+// stores width variants in the fallback format plus WebP. Re-encoding drops all
+// metadata, so EXIF (GPS, camera serials, ...) never reaches guests. The raw
+// upload itself is not stored; its URL becomes the largest variant.
+func processImageVariants(ctx context.Context, store Storage, staged *StagedUpload) (*ImageVariantSet, error) {
+	raw, err := os.ReadFile(staged.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	if staged.ContentType == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(raw))
+	}
+
+	// Transparent images keep PNG as the fallback, photos get JPEG
+	fallback := "jpeg"
+	if !isOpaque(img) {
+		fallback = "png"
+	}
+
+	base := strings.TrimSuffix(staged.Filename, filepath.Ext(staged.Filename))
+	bounds := img.Bounds()
+	set := &ImageVariantSet{Width: bounds.Dx(), Height: bounds.Dy()}
+
+	for _, width := range targetWidths(bounds.Dx()) {
+		resized := resizeToWidth(img, width)
+		height := resized.Bounds().Dy()
+
+		for _, format := range []string{fallback, "webp"} {
+			name := fmt.Sprintf("%s-%dw.%s", base, width, formatExt(format))
+			data, err := encodeVariant(resized, format)
+			if err != nil {
+				return nil, fmt.Errorf("variant %s: %w", name, err)
+			}
+			if err := store.Put(ctx, name, bytes.NewReader(data), int64(len(data)), "image/"+format); err != nil {
+				return nil, fmt.Errorf("variant %s: %w", name, err)
+			}
+			set.Variants = append(set.Variants, ImageVariant{
+				Key:    name,
+				URL:    store.URL(name),
+				Width:  width,
+				Height: height,
+				Format: format,
+				Size:   int64(len(data)),
+			})
+		}
+	}
+
+	set.buildSrcsets(fallback)
+	staged.URL = set.Src
+	return set, nil
+}
+
+func (s *ImageVariantSet) buildSrcsets(fallback string) {
+	var srcset, webpSrcset []string
+	largest := 0
+	for _, v := range s.Variants {
+		entry := fmt.Sprintf("%s %dw", v.URL, v.Width)
+		if v.Format == "webp" {
+			webpSrcset = append(webpSrcset, entry)
+			continue
+		}
+		srcset = append(srcset, entry)
+		if v.Format == fallback && v.Width > largest {
+			largest = v.Width
+			s.Src = v.URL
+		}
+	}
+	s.Srcset = strings.Join(srcset, ", ")
+	s.WebPSrcset = strings.Join(webpSrcset, ", ")
+}
+
+func targetWidths(sourceWidth int) []int {
+	maxWidth := variantWidths[len(variantWidths)-1]
+	if sourceWidth < maxWidth {
+		maxWidth = sourceWidth
+	}
+	widths := []int{maxWidth}
+	for _, w := range variantWidths {
+		if w < maxWidth {
+			widths = append(widths, w)
+		}
+	}
+	sort.Ints(widths)
+	return widths
+}
+
+func resizeToWidth(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if b.Dx() == width {
+		// Still copy into a fresh NRGBA so every variant is encoded from decoded pixels only
+		dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+		return dst
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+func formatExt(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+func encodeVariant(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: variantJPEGQuality})
+	case "png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	case "webp":
+		err = webp.Encode(&buf, img, webp.Options{Quality: variantWebPQuality})
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	return buf.Bytes(), err
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// jpegOrientation returns the EXIF orientation tag (1-8) of a JPEG, 1 when absent
+func jpegOrientation(data []byte) int {
+	r := bytes.NewReader(data)
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+		// Start of scan or end of image: no EXIF before the pixel data
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 1
+		}
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return 1
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 1
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+	}
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		off := ifd + 2 + i*12
+		if off+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[off:off+2]) == 0x0112 {
+			o := int(order.Uint16(tiff[off+8 : off+10]))
+			if o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates/flips img so it displays upright without its EXIF tag
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 CW
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 270 CW
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// imageVariants returns the variant set for an image URL, nil for
+// unprocessed images (legacy uploads, GIFs, external URLs)
+func (s *Server) imageVariants(imageURL string) *ImageVariantSet {
+	imageURL = strings.TrimSpace(imageURL)
+	if strings.HasPrefix(imageURL, "url(") && strings.HasSuffix(imageURL, ")") {
+		imageURL = strings.Trim(imageURL[4:len(imageURL)-1], `'"`)
+	}
+	if imageURL == "" {
+		return nil
+	}
+
+	candidates := []string{imageURL}
+	// The admin UI stores absolute URLs for local uploads when the API is on another origin
+	if i := strings.Index(imageURL, "/img/"); i > 0 {
+		candidates = append(candidates, imageURL[i:])
+	}
+
+	for _, candidate := range candidates {
+		if m, err := s.Media.MediaByURL(candidate); err == nil && m != nil && m.Variants != nil {
+			return m.Variants
+		}
+	}
+	return nil
+}
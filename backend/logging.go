@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// setupLogging installs the process-wide slog logger, configured from the
+// environment:
+//
+//	LOG_LEVEL   debug, info (the default), warn or error
+//	LOG_FORMAT  json (the default) or text
+//
+// Everything logged goes through the redaction layer, including what is
+// still written with the log package by dependencies.
+func setupLogging() {
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, CleanEnv(os.Getenv("LOG_FORMAT")), CleanEnv(os.Getenv("LOG_LEVEL")))))
+}
+
+func newLogHandler(w io.Writer, format, level string) slog.Handler {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	if strings.EqualFold(format, "text") {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return &redactingHandler{next: h}
+}
+
+// fatal logs an error and exits, for startup failures
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request ctx belongs to, if any
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID accepts IDs set by a proxy in front of us, within reason
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID gives every request an ID, taken from X-Request-ID when a
+// proxy already set one, returns it in the response header and attaches it to
+// the request context. Log calls passed that context carry it.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// slowRequest is when a request is logged as a warning
+const slowRequest = 100 * time.Millisecond
+
+// LoggerMiddleware writes one access log line per request, when it is done
+func LoggerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+		level := slog.LevelInfo
+		if elapsed > slowRequest || rec.status >= 500 {
+			level = slog.LevelWarn
+		}
+		slog.Log(r.Context(), level, "Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", elapsed.Milliseconds(),
+			"remote", r.RemoteAddr,
+			"origin", r.Header.Get("Origin"),
+		)
+	})
+}
+
+// redactingHandler masks personal data and secrets before a record is
+// written: guest emails, OAuth codes and tokens, hotspot and admin passwords.
+// It also adds the request ID and trace ID of the record's context.
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, redactString(r.Message), r.PC)
+	if id := requestID(ctx); id != "" {
+		out.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		out.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(out)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name)}
+}
+
+// redacted replaces a secret value
+const redacted = "[REDACTED]"
+
+// secretKeys are attribute keys whose values are never logged
+var secretKeys = map[string]bool{
+	"password": true, "pass": true, "secret": true, "client_secret": true,
+	"token": true, "access_token": true, "refresh_token": true, "view_token": true,
+	"code": true, "authorization": true, "cookie": true, "state": true, "query": true,
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	key := strings.ToLower(a.Key)
+	switch {
+	case v.Kind() == slog.KindGroup:
+		attrs := v.Group()
+		out := make([]slog.Attr, len(attrs))
+		for i, ga := range attrs {
+			out[i] = redactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(out...)}
+	case secretKeys[key]:
+		return slog.String(a.Key, redacted)
+	case key == "email" && v.Kind() == slog.KindString:
+		// Masked by key: rejected guest emails need not look like emails
+		return slog.String(a.Key, maskEmail(v.String()))
+	case v.Kind() == slog.KindString:
+		return slog.String(a.Key, redactString(v.String()))
+	case v.Kind() == slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, redactString(err.Error()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+var (
+	emailPattern = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*(@|%40)([A-Za-z0-9.-]+\.[A-Za-z]{2,})`)
+	// Secret query parameters, plain or URL-encoded inside another parameter
+	// (the OAuth state carries the MikroTik query). Deliberately loose: a
+	// "postcode" masked by mistake is better than a password logged.
+	secretParamPattern = regexp.MustCompile(`(?i)(password|pass|code|access_token|refresh_token|id_token|client_secret|view_token|token)(=|%3D)(?:[^&\s%"']|%(?:[013-9A-Fa-f][0-9A-Fa-f]|2[0-57-9A-Fa-f]))*`)
+	bearerPattern      = regexp.MustCompile(`(?i)\bbearer\s+\S+`)
+)
+
+// maskEmail keeps only the first character of an email attribute
+func maskEmail(s string) string {
+	for _, r := range s {
+		return string(r) + "***"
+	}
+	return s
+}
+
+// redactString masks emails (keeping the first letter and the domain) and the
+// values of secret query parameters and bearer tokens in free text
+func redactString(s string) string {
+	s = emailPattern.ReplaceAllString(s, "$1***$2$3")
+	s = secretParamPattern.ReplaceAllString(s, "$1$2"+redacted)
+	return bearerPattern.ReplaceAllString(s, "Bearer "+redacted)
+}
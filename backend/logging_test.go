@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, "json", "debug"))
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-1")
+
+	logger.InfoContext(ctx, "Guest maria.santos@gmail.com logged in",
+		"email", "maria.santos@gmail.com",
+		"password", "hunter2",
+		"url", "http://10.5.50.1/login?username=user&password=s3cret&dst=x",
+		"state", "ip=10.5.50.1&password=s3cret",
+		"error", errors.New(`Get "https://graph.facebook.com/me?access_token=EAAB123": timeout`),
+		slog.Group("oauth", "code", "4/0Adeu5B"),
+	)
+	logger.Info("encoded", "redirect", "state=ip%3D10.5.50.1%26password%3Ds3cret%26mac%3Daa")
+	logger.Info("Blocked invalid guest email", "email", "wayan.not-an-address")
+
+	out := buf.String()
+	for _, secret := range []string{"maria.santos", "hunter2", "s3cret", "EAAB123", "4/0Adeu5B", "not-an-address"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log leaks %q:\n%s", secret, out)
+		}
+	}
+	for _, want := range []string{`"request_id":"req-1"`, "m***@gmail.com", `"email":"m***"`, `"email":"w***"`, "dst=x", "mac%3Daa"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+
+	buf.Reset()
+	slog.New(newLogHandler(&buf, "text", "warn")).Info("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("info logged at LOG_LEVEL=warn: %s", buf.String())
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if seen == "" || rec.Header().Get(requestIDHeader) != seen {
+		t.Errorf("generated ID %q, header %q", seen, rec.Header().Get(requestIDHeader))
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "from-proxy-42")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if seen != "from-proxy-42" || rec.Header().Get(requestIDHeader) != "from-proxy-42" {
+		t.Errorf("proxy ID not kept: %q", seen)
+	}
+
+	req.Header.Set(requestIDHeader, "bad id\nwith newline")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if strings.ContainsAny(seen, " \n") {
+		t.Errorf("unsafe ID accepted: %q", seen)
+	}
+}
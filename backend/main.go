@@ -1,15 +1,13 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -17,11 +15,11 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
-	"github.com/rs/cors"
 	"unicode"
 )
 
+// Settings is the typed view of the portal settings used by the handlers;
+// see settingsSchema for the keys, defaults and validation
 type Settings struct {
 	BackgroundImage      string `json:"background_image"`
 	BackgroundImageType  string `json:"background_image_type"`
@@ -29,14 +27,16 @@ type Settings struct {
 	BackgroundColor      string `json:"background_color"`
 	PageTitle            string `json:"page_title"`
 	ButtonText           string `json:"button_text"`
-	GoogleLoginEnabled   string `json:"google_login_enabled"`
-	FacebookLoginEnabled string `json:"facebook_login_enabled"`
+	GoogleLoginEnabled   bool   `json:"google_login_enabled"`
+	FacebookLoginEnabled bool   `json:"facebook_login_enabled"`
 	GoogleClientID       string `json:"google_client_id"`
 	GoogleClientSecret   string `json:"google_client_secret"`
 	FacebookAppID        string `json:"facebook_app_id"`
 	FacebookAppSecret    string `json:"facebook_app_secret"`
-	Email               string `json:"email"`    // Added for tracking
-	Tracking            bool   `json:"tracking"` // Added for tracking
+	AdViewRequired       bool   `json:"ad_view_required"`
+	AdViewSeconds        int    `json:"ad_view_seconds"`
+	PortalTheme          string `json:"portal_theme"`
+	DefaultLocale        string `json:"default_locale"`
 }
 
 type ScheduledAd struct {
@@ -50,65 +50,26 @@ type ScheduledAd struct {
 	StartTime   string    `json:"start_time"`
 	EndTime     string    `json:"end_time"`
 	IsActive    bool      `json:"is_active"`
+	CampaignID  *int      `json:"campaign_id"`
+	ImageVariants *ImageVariantSet `json:"image_variants,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
 
-var db *sql.DB
-
-func initDB() {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS page_settings (
-			key TEXT PRIMARY KEY,
-			value TEXT,
-			setting_key TEXT,
-			setting_value TEXT,
-			created_at TIMESTAMP DEFAULT NOW(),
-			updated_at TIMESTAMP DEFAULT NOW()
-		);
-
-		CREATE TABLE IF NOT EXISTS scheduled_ads (
-			id SERIAL PRIMARY KEY,
-			title TEXT,
-			description TEXT,
-			image TEXT,
-			link TEXT,
-			start_date DATE,
-			end_date DATE,
-			start_time TIME,
-			end_time TIME,
-			is_active BOOLEAN DEFAULT TRUE,
-			created_at TIMESTAMP DEFAULT NOW()
-		);
-
-
-		CREATE TABLE IF NOT EXISTS collected_emails (
-			id SERIAL PRIMARY KEY,
-			email TEXT UNIQUE NOT NULL,
-			source TEXT, -- 'manual', 'google', 'facebook'
-			created_at TIMESTAMP DEFAULT NOW()
-		);
-
-		-- Migration: Add link column if not exists
-		ALTER TABLE scheduled_ads ADD COLUMN IF NOT EXISTS link TEXT;
-
-	`)
-	if err != nil {
-		log.Println("Database initialization error:", err)
-	} else {
-		log.Println("✅ Database tables ensured")
-	}
-}
-
 func main() {
 	var err error
 
 	// Load .env file
 	err = godotenv.Load("../.env")
+	setupLogging()
 	if err != nil {
-		log.Println("⚠️ Warning: .env file not found or could not be loaded")
+		slog.Warn(".env file not found or could not be loaded")
 	} else {
-		log.Println("✅ Environment variables loaded from .env")
+		slog.Info("Environment variables loaded from .env")
+	}
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		slog.Error("Tracing not started", "error", err)
 	}
 
 	// Database connection
@@ -119,129 +80,116 @@ func main() {
 		connStr = "user=postgres password=postgres dbname=wifi_hotspot sslmode=disable"
 	}
 
-	db, err = sql.Open("postgres", connStr)
+	// sqlite: URLs select the embedded SQLite database, anything else Postgres
+	db, err := openDatabase(connStr)
 	if err != nil {
-		log.Println("⚠️ Failed to connect to database:", err)
-		log.Println("🔄 Continuing anyway... some endpoints may not work")
-	} else {
-		// Test connection
-		if err = db.Ping(); err != nil {
-			log.Println("⚠️ Failed to ping database:", err)
-			log.Println("🔄 Continuing anyway... database operations may fail")
-		} else {
-			log.Println("✅ Database connected successfully")
+		fatal("Invalid DATABASE_URL", "error", err)
+	}
+	// One-off commands share the DB and storage setup with the server, but have
+	// nothing to serve degraded: they need the database now
+	command := ""
+	if len(os.Args) > 1 && (os.Args[1] == "migrate" || os.Args[1] == "gc") {
+		command = os.Args[1]
+	}
+	failFast := startupMode()
+	connected := true
+	if err := waitForDatabase(db, dbConnectTimeout()); err != nil {
+		if command != "" {
+			fatal("Database not reachable", "command", command, "error", err)
+		}
+		if failFast {
+			fatal("Database not reachable, refusing to start (STARTUP_MODE=fail-fast)", "error", err)
 		}
+		slog.Warn("Database not reachable, starting degraded and retrying in the background", "error", err)
+		connected = false
+	} else {
+		slog.Info("Database connected", "dialect", db.Dialect)
 	}
 
-	if db != nil {
-		initDB()
-	} else {
-		log.Println("⚠️ Database initialization skipped (no connection)")
-	}
-
-	log.Println("--- NUANU BACKEND STARTING (v3.1 AUTH INTERCEPTOR) ---")
-
-	// Router
-	r := mux.NewRouter()
-	r.StrictSlash(true)
-
-	// Auth Routes - v3.0 EXPLICIT REGISTRATION (most reliable)
-	log.Println("🔌 Registering explicit Auth routes...")
-	r.HandleFunc("/auth/google/login", GoogleLogin).Methods("GET")
-	r.HandleFunc("/auth/google/callback", GoogleCallback).Methods("GET")
-	r.HandleFunc("/auth/facebook/login", FacebookLogin).Methods("GET")
-	r.HandleFunc("/auth/facebook/callback", FacebookCallback).Methods("GET")
-	// Fallback catch-all for any other /auth paths
-	r.PathPrefix("/auth").HandlerFunc(AuthRouter)
-	log.Println("✅ Auth routes registered.")
-
-	// API Routes...
-	r.HandleFunc("/api/settings", GetSettings).Methods("GET")
-	r.HandleFunc("/api/settings", UpdateSettings).Methods("POST")
-	r.HandleFunc("/api/upload", UploadFile).Methods("POST")
-	r.HandleFunc("/api/auth/login", AdminLogin).Methods("POST")
-	r.HandleFunc("/api/emails", GetEmails).Methods("GET")
-
-	// Ads Routes...
-	r.HandleFunc("/api/ads", GetAds).Methods("GET")
-	r.HandleFunc("/api/ads", CreateAd).Methods("POST")
-	r.HandleFunc("/api/ads/{id}", UpdateAd).Methods("PUT")
-	r.HandleFunc("/api/ads/{id}", DeleteAd).Methods("DELETE")
-	r.HandleFunc("/api/active-ad", GetActiveAd).Methods("GET")
-
-	r.HandleFunc("/health", HealthCheck).Methods("GET")
-
-	// Fallback for debugging (Enhanced for v2.8)
-	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("❌ 404 NOT FOUND: [%s] %s (FULL URL: %s) (RemoteAddr: %s)", r.Method, r.URL.Path, r.URL.String(), r.RemoteAddr)
-		msg := fmt.Sprintf("404 page not found: [%s] - NUANU BACKEND v3.1", r.URL.Path)
-		http.Error(w, msg, http.StatusNotFound)
-	})
+	if command == "migrate" {
+		runMigrateCommand(db, os.Args[2:])
+	}
 
-	// Static files
-	// Static files - more robust path handling
-	cwd, _ := os.Getwd()
-	imgDir := filepath.Join(cwd, "..", "public", "img")
-	if _, err := os.Stat(imgDir); os.IsNotExist(err) {
-		// Fallback if we are in root
-		imgDir = filepath.Join(cwd, "public", "img")
-	}
-	log.Printf("📂 Serving static files from: %s", imgDir)
-	r.PathPrefix("/img/").Handler(http.StripPrefix("/img/", http.FileServer(http.Dir(imgDir))))
-
-	// CORS: Enhanced stability — includes production domain
-	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{
-			"http://localhost:3000",
-			"http://localhost:3001",
-			"http://127.0.0.1:3000",
-			"http://127.0.0.1:3001",
-			"https://gowifi.nuanu.io",
-			"http://gowifi.nuanu.io",
-		},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "Authorization", "X-CSRF-Token"},
-		AllowCredentials: true,
-		Debug:            false,
-	})
+	srv := NewServer(NewStore(db), initStorage())
+	srv.schemaPending.Store(true)
+	srv.metrics.WatchDatabase(db)
+	srv.limiter.store = limiterStoreFor(db)
+	if connected {
+		if err := srv.prepareDatabase(db, connStr); err != nil {
+			fatal("Database migration failed, refusing to start", "error", err)
+		}
+	} else {
+		srv.connectInBackground(db, connStr)
+	}
 
-	handler := c.Handler(r)
-	handler = LoggerMiddleware(handler)
-	handler = AuthInterceptor(handler) // v3.1: Outermost handler, bypasses gorilla/mux entirely
+	if command == "gc" {
+		srv.runMediaGCCommand(os.Args[2:])
+	}
+	srv.startMediaGCJob()
+	srv.startDraftPublisher()
+	srv.startLimiterSweeper()
 
-	log.Println("🚀 Go Backend starting on 0.0.0.0:8080")
-	log.Fatal(http.ListenAndServe("0.0.0.0:8080", handler))
+	cfg := httpConfigFromEnv()
+	tlsCfg, err := tlsConfigFromEnv()
+	if err != nil {
+		fatal("Invalid TLS config", "error", err)
+	}
+	servers, err := newServers(cfg, tlsCfg, srv.Handler())
+	if err != nil {
+		fatal("TLS setup failed", "error", err)
+	}
+	slog.Info("Backend starting", "version", "v3.1", "tls", tlsCfg.Mode)
+	if err := serve(cfg.ShutdownTimeout, servers...); err != nil {
+		fatal("Server failed", "error", err)
+	}
+	db.Close()
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("Failed to flush traces", "error", err)
+	}
+	slog.Info("Backend stopped")
 }
 
 // AuthInterceptor v3.1 - NUCLEAR FIX: Bypasses gorilla/mux, CORS, and all middleware for auth routes
-func AuthInterceptor(next http.Handler) http.Handler {
+func (s *Server) AuthInterceptor(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Normalize path: lowercase and strip trailing slash
 		path := strings.ToLower(strings.TrimRight(r.URL.Path, "/"))
 
 		// Debug Log: Show exactly what path is being evaluated
 		if strings.Contains(path, "auth") {
-			log.Printf("🔍 AuthInterceptor checking path: [%s] (Raw: %s)", path, r.URL.Path)
+			slog.DebugContext(r.Context(), "AuthInterceptor checking path", "path", path, "raw_path", r.URL.Path)
 		}
 
 		if strings.HasSuffix(path, "/auth/google/login") {
-			log.Printf("⚡ INTERCEPTED GoogleLogin [%s]", r.Method)
-			GoogleLogin(w, r)
+			slog.DebugContext(r.Context(), "Intercepted auth route", "handler", "GoogleLogin")
+			setRoute(r, "/auth/google/login")
+			s.GoogleLogin(w, r)
 			return
 		}
 		if strings.HasSuffix(path, "/auth/google/callback") {
-			log.Printf("⚡ INTERCEPTED GoogleCallback [%s]", r.Method)
-			GoogleCallback(w, r)
+			slog.DebugContext(r.Context(), "Intercepted auth route", "handler", "GoogleCallback")
+			setRoute(r, "/auth/google/callback")
+			s.GoogleCallback(w, r)
 			return
 		}
 		if strings.HasSuffix(path, "/auth/facebook/login") {
-			log.Printf("⚡ INTERCEPTED FacebookLogin [%s]", r.Method)
-			FacebookLogin(w, r)
+			slog.DebugContext(r.Context(), "Intercepted auth route", "handler", "FacebookLogin")
+			setRoute(r, "/auth/facebook/login")
+			s.FacebookLogin(w, r)
 			return
 		}
 		if strings.HasSuffix(path, "/auth/facebook/callback") {
-			log.Printf("⚡ INTERCEPTED FacebookCallback [%s]", r.Method)
-			FacebookCallback(w, r)
+			slog.DebugContext(r.Context(), "Intercepted auth route", "handler", "FacebookCallback")
+			setRoute(r, "/auth/facebook/callback")
+			s.FacebookCallback(w, r)
+			return
+		}
+		if strings.HasSuffix(path, "/auth/email/login") {
+			slog.DebugContext(r.Context(), "Intercepted auth route", "handler", "EmailLogin")
+			setRoute(r, "/auth/email/login")
+			s.EmailLogin(w, r)
 			return
 		}
 
@@ -250,46 +198,56 @@ func AuthInterceptor(next http.Handler) http.Handler {
 }
 
 // AuthRouter - Fallback catch-all for unknown /auth paths
-func AuthRouter(w http.ResponseWriter, r *http.Request) {
+func (s *Server) AuthRouter(w http.ResponseWriter, r *http.Request) {
 	path := strings.ToLower(strings.TrimRight(r.URL.Path, "/"))
-	log.Printf("🛂 AuthRouter FALLBACK: [%s] path=%s", r.Method, path)
+	slog.DebugContext(r.Context(), "AuthRouter fallback", "path", path)
 
 	switch {
 	case strings.HasSuffix(path, "/auth/google/login"):
-		log.Println("✅ Fallback routing to GoogleLogin")
-		GoogleLogin(w, r)
+		slog.DebugContext(r.Context(), "Fallback auth routing", "handler", "GoogleLogin")
+		s.GoogleLogin(w, r)
 	case strings.HasSuffix(path, "/auth/google/callback"):
-		log.Println("✅ Fallback routing to GoogleCallback")
-		GoogleCallback(w, r)
+		slog.DebugContext(r.Context(), "Fallback auth routing", "handler", "GoogleCallback")
+		s.GoogleCallback(w, r)
 	case strings.HasSuffix(path, "/auth/facebook/login"):
-		log.Println("✅ Fallback routing to FacebookLogin")
-		FacebookLogin(w, r)
+		slog.DebugContext(r.Context(), "Fallback auth routing", "handler", "FacebookLogin")
+		s.FacebookLogin(w, r)
 	case strings.HasSuffix(path, "/auth/facebook/callback"):
-		log.Println("✅ Fallback routing to FacebookCallback")
-		FacebookCallback(w, r)
+		slog.DebugContext(r.Context(), "Fallback auth routing", "handler", "FacebookCallback")
+		s.FacebookCallback(w, r)
+	case strings.HasSuffix(path, "/auth/email/login"):
+		slog.DebugContext(r.Context(), "Fallback auth routing", "handler", "EmailLogin")
+		s.EmailLogin(w, r)
 	default:
-		log.Printf("❓ Unknown auth path: [%s] - returning 404", path)
+		slog.InfoContext(r.Context(), "Unknown auth path", "path", path)
 		msg := fmt.Sprintf("404 Auth Route Not Found: [%s] - NUANU v3.1", path)
 		http.Error(w, msg, http.StatusNotFound)
 	}
 }
 
 
-func GoogleLogin(w http.ResponseWriter, r *http.Request) {
-	log.Printf("🚀 GoogleLogin triggered! Path: %s, Query: %s", r.URL.Path, r.URL.RawQuery)
-	settings := getSettingsFromDB()
-	if settings.GoogleLoginEnabled != "true" {
-		log.Println("❌ Google login is DISABLED in settings")
+func (s *Server) GoogleLogin(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Guest login started", "provider", "google")
+	if !s.allow(w, r, limitOAuthStart, guestLimitKeys(r, r.URL.Query(), "")) {
+		return
+	}
+	site := s.guestSite(r)
+	settings, ok := s.siteSettings(w, site.ID)
+	if !ok {
+		return
+	}
+	if !settings.GoogleLoginEnabled {
+		slog.WarnContext(r.Context(), "Google login is disabled in settings", "site", site.Slug)
 		http.Error(w, "Google login is disabled", http.StatusForbidden)
 		return
 	}
 	if settings.GoogleClientID == "" {
-		log.Println("❌ Google Client ID is empty")
+		slog.ErrorContext(r.Context(), "Google client ID is empty", "site", site.Slug)
 		http.Error(w, "Google login is misconfigured (no client ID)", http.StatusForbidden)
 		return
 	}
 
-	state := r.URL.RawQuery // Pass MikroTik params in state
+	state := withSiteParam(r.URL.RawQuery, site) // Pass MikroTik params (and the site) in state
 	const prodDomain = "gowifi.nuanu.io"
 	redirectURI := fmt.Sprintf("https://%s/auth/google/callback", prodDomain)
 
@@ -304,26 +262,39 @@ func GoogleLogin(w http.ResponseWriter, r *http.Request) {
 	params.Set("prompt", "select_account")
 	authURL := "https://accounts.google.com/o/oauth2/v2/auth?" + params.Encode()
 
-	log.Printf("🔗 Google redirectURI: %s | state: %s", redirectURI, state)
+	slog.DebugContext(r.Context(), "Redirecting to Google", "redirect_uri", redirectURI)
+	s.metrics.loginEvent("google", loginStarted)
 	http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
 }
 
-func GoogleCallback(w http.ResponseWriter, r *http.Request) {
-	log.Printf("🚀 MEGA LOG: GoogleCallback triggered! Path: %s, Query: %s", r.URL.Path, r.URL.RawQuery)
+func (s *Server) GoogleCallback(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Guest login callback", "provider", "google")
+	result := loginFailure
+	defer func() { s.metrics.loginEvent("google", result) }()
 	code := r.URL.Query().Get("code")
 	state := r.URL.Query().Get("state")
-	settings := getSettingsFromDB()
 
 	if code == "" {
 		http.Error(w, "Code missing", http.StatusBadRequest)
 		return
 	}
 
+	stateParams, _ := url.ParseQuery(state)
+	site := s.resolveSite(r, stateParams)
+	settings, ok := s.siteSettings(w, site.ID)
+	if !ok {
+		return
+	}
+	if err := checkAdView(r, settings, stateParams, ""); err != nil {
+		refuseAdView(w, err)
+		return
+	}
+
 	const prodDomain = "gowifi.nuanu.io"
 	redirectURI := fmt.Sprintf("https://%s/auth/google/callback", prodDomain)
 
 	// Exchange code for token
-	resp, err := http.PostForm("https://oauth2.googleapis.com/token", map[string][]string{
+	resp, err := s.outboundPostForm(r.Context(), "https://oauth2.googleapis.com/token", url.Values{
 		"client_id":     {settings.GoogleClientID},
 		"client_secret": {settings.GoogleClientSecret},
 		"code":          {code},
@@ -343,7 +314,7 @@ func GoogleCallback(w http.ResponseWriter, r *http.Request) {
 	json.NewDecoder(resp.Body).Decode(&tokenResp)
 
 	// Get user info
-	userResp, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + tokenResp.AccessToken)
+	userResp, err := s.outboundGet(r.Context(), "https://www.googleapis.com/oauth2/v2/userinfo?access_token="+tokenResp.AccessToken)
 	if err != nil {
 		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
 		return
@@ -357,30 +328,41 @@ func GoogleCallback(w http.ResponseWriter, r *http.Request) {
 
 	// SAVE EMAIL TO DATABASE (Tracking)
 	if userInfo.Email != "" && isValidEmail(userInfo.Email) {
-		db.Exec("INSERT INTO collected_emails (email, source) VALUES ($1, 'google') ON CONFLICT (email) DO NOTHING", userInfo.Email)
-		log.Printf("📧 Saved Google email to DB: %s", userInfo.Email)
+		if err := s.Emails.SaveEmail(site.ID, userInfo.Email, "google"); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save guest email", "error", err)
+		} else {
+			slog.InfoContext(r.Context(), "Guest email saved", "provider", "google", "email", userInfo.Email)
+		}
+		result = loginSuccess
 	} else if userInfo.Email != "" {
-		log.Printf("⚠️ Rejected invalid Google email: %s", userInfo.Email)
+		slog.WarnContext(r.Context(), "Rejected invalid guest email", "provider", "google", "email", userInfo.Email)
 	}
 
-	AuthorizeMikroTik(w, r, userInfo.Email, state)
+	s.AuthorizeMikroTik(w, r, "google", userInfo.Email, state)
 }
 
-func FacebookLogin(w http.ResponseWriter, r *http.Request) {
-	log.Printf("🚀 FacebookLogin triggered! Path: %s, Query: %s", r.URL.Path, r.URL.RawQuery)
-	settings := getSettingsFromDB()
-	if settings.FacebookLoginEnabled != "true" {
-		log.Println("❌ Facebook login is DISABLED in settings")
+func (s *Server) FacebookLogin(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Guest login started", "provider", "facebook")
+	if !s.allow(w, r, limitOAuthStart, guestLimitKeys(r, r.URL.Query(), "")) {
+		return
+	}
+	site := s.guestSite(r)
+	settings, ok := s.siteSettings(w, site.ID)
+	if !ok {
+		return
+	}
+	if !settings.FacebookLoginEnabled {
+		slog.WarnContext(r.Context(), "Facebook login is disabled in settings", "site", site.Slug)
 		http.Error(w, "Facebook login is disabled", http.StatusForbidden)
 		return
 	}
 	if settings.FacebookAppID == "" {
-		log.Println("❌ Facebook App ID is empty")
+		slog.ErrorContext(r.Context(), "Facebook app ID is empty", "site", site.Slug)
 		http.Error(w, "Facebook login is misconfigured (no app ID)", http.StatusForbidden)
 		return
 	}
 
-	state := r.URL.RawQuery
+	state := withSiteParam(r.URL.RawQuery, site)
 	const prodDomain = "gowifi.nuanu.io"
 	redirectURI := fmt.Sprintf("https://%s/auth/facebook/callback", prodDomain)
 
@@ -392,21 +374,34 @@ func FacebookLogin(w http.ResponseWriter, r *http.Request) {
 	fbParams.Set("scope", "email")
 	authURL := "https://www.facebook.com/v18.0/dialog/oauth?" + fbParams.Encode()
 
-	log.Printf("🔗 Facebook redirectURI: %s | state: %s", redirectURI, state)
+	slog.DebugContext(r.Context(), "Redirecting to Facebook", "redirect_uri", redirectURI)
+	s.metrics.loginEvent("facebook", loginStarted)
 	http.Redirect(w, r, authURL, http.StatusTemporaryRedirect)
 }
 
-func FacebookCallback(w http.ResponseWriter, r *http.Request) {
-	log.Printf("🚀 MEGA LOG: FacebookCallback triggered! Path: %s, Query: %s", r.URL.Path, r.URL.RawQuery)
+func (s *Server) FacebookCallback(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Guest login callback", "provider", "facebook")
+	result := loginFailure
+	defer func() { s.metrics.loginEvent("facebook", result) }()
 	code := r.URL.Query().Get("code")
 	state := r.URL.Query().Get("state")
-	settings := getSettingsFromDB()
 
 	if code == "" {
 		http.Error(w, "Code missing", http.StatusBadRequest)
 		return
 	}
 
+	stateParams, _ := url.ParseQuery(state)
+	site := s.resolveSite(r, stateParams)
+	settings, ok := s.siteSettings(w, site.ID)
+	if !ok {
+		return
+	}
+	if err := checkAdView(r, settings, stateParams, ""); err != nil {
+		refuseAdView(w, err)
+		return
+	}
+
 	const prodDomain = "gowifi.nuanu.io"
 	redirectURI := fmt.Sprintf("https://%s/auth/facebook/callback", prodDomain)
 
@@ -416,7 +411,7 @@ func FacebookCallback(w http.ResponseWriter, r *http.Request) {
 	tokenParams.Set("redirect_uri", redirectURI)
 	tokenParams.Set("client_secret", settings.FacebookAppSecret)
 	tokenParams.Set("code", code)
-	resp, err := http.Get("https://graph.facebook.com/v18.0/oauth/access_token?" + tokenParams.Encode())
+	resp, err := s.outboundGet(r.Context(), "https://graph.facebook.com/v18.0/oauth/access_token?"+tokenParams.Encode())
 
 	if err != nil {
 		http.Error(w, "Token exchange failed", http.StatusInternalServerError)
@@ -430,7 +425,7 @@ func FacebookCallback(w http.ResponseWriter, r *http.Request) {
 	json.NewDecoder(resp.Body).Decode(&tokenResp)
 
 	// Get user info
-	userResp, err := http.Get("https://graph.facebook.com/me?fields=email&access_token=" + tokenResp.AccessToken)
+	userResp, err := s.outboundGet(r.Context(), "https://graph.facebook.com/me?fields=email&access_token="+tokenResp.AccessToken)
 	if err != nil {
 		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
 		return
@@ -444,17 +439,61 @@ func FacebookCallback(w http.ResponseWriter, r *http.Request) {
 
 	// SAVE EMAIL TO DATABASE (Tracking)
 	if userInfo.Email != "" && isValidEmail(userInfo.Email) {
-		db.Exec("INSERT INTO collected_emails (email, source) VALUES ($1, 'facebook') ON CONFLICT (email) DO NOTHING", userInfo.Email)
-		log.Printf("📧 Saved Facebook email to DB: %s", userInfo.Email)
+		if err := s.Emails.SaveEmail(site.ID, userInfo.Email, "facebook"); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save guest email", "error", err)
+		} else {
+			slog.InfoContext(r.Context(), "Guest email saved", "provider", "facebook", "email", userInfo.Email)
+		}
+		result = loginSuccess
 	} else if userInfo.Email != "" {
-		log.Printf("⚠️ Rejected invalid Facebook email: %s", userInfo.Email)
+		slog.WarnContext(r.Context(), "Rejected invalid guest email", "provider", "facebook", "email", userInfo.Email)
+	}
+
+	s.AuthorizeMikroTik(w, r, "facebook", userInfo.Email, state)
+}
+
+// EmailLogin registers a guest by email and authorizes them on the hotspot server-side.
+// MikroTik params travel in the query string exactly like for the OAuth logins.
+func (s *Server) EmailLogin(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Guest login started", "provider", "email")
+	s.metrics.loginEvent("email", loginStarted)
+	result := loginFailure
+	defer func() { s.metrics.loginEvent("email", result) }()
+	state := r.URL.RawQuery
+	params, _ := url.ParseQuery(state)
+	email := strings.TrimSpace(r.FormValue("email"))
+	if !s.allow(w, r, limitGuestEmail, guestLimitKeys(r, params, email)) {
+		return
 	}
+	site := s.resolveSite(r, params)
 
-	AuthorizeMikroTik(w, r, userInfo.Email, state)
+	settings, ok := s.siteSettings(w, site.ID)
+	if !ok {
+		return
+	}
+	if err := checkAdView(r, settings, params, r.FormValue("view_token")); err != nil {
+		refuseAdView(w, err)
+		return
+	}
+
+	if !isValidEmail(email) {
+		slog.InfoContext(r.Context(), "Blocked invalid guest email", "email", email)
+		http.Error(w, "Please enter a real, valid email address.", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Emails.SaveEmail(site.ID, email, "welcome nuanu wifi"); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save guest email", "error", err)
+	} else {
+		slog.InfoContext(r.Context(), "Guest email saved", "provider", "email", "email", email)
+	}
+	result = loginSuccess
+
+	s.AuthorizeMikroTik(w, r, "email", email, state)
 }
 
 // AuthorizeMikroTik handles the final redirection to MikroTik with correct parameters
-func AuthorizeMikroTik(w http.ResponseWriter, r *http.Request, userEmail string, state string) {
+func (s *Server) AuthorizeMikroTik(w http.ResponseWriter, r *http.Request, provider string, userEmail string, state string) {
 	params, _ := url.ParseQuery(state)
 	
 	gatewayIP := params.Get("ip")
@@ -487,7 +526,7 @@ func AuthorizeMikroTik(w http.ResponseWriter, r *http.Request, userEmail string,
 		hotspotPass = "user" 
 	}
 
-	log.Printf("🎯 Authorizing MikroTik: %s | User: %s | Pass: %s | Dest: %s", linkLogin, hotspotUser, hotspotPass, dst)
+	slog.InfoContext(r.Context(), "Authorizing guest on the hotspot", "provider", provider, "link_login", linkLogin, "hotspot_user", hotspotUser, "dst", dst)
 
 	loginURL := fmt.Sprintf("%s?username=%s&password=%s&dst=%s",
 		linkLogin,
@@ -496,167 +535,75 @@ func AuthorizeMikroTik(w http.ResponseWriter, r *http.Request, userEmail string,
 		url.QueryEscape(dst),
 	)
 
+	s.metrics.hotspotRedirects.WithLabelValues(provider).Inc()
 	http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
 }
 
-func getSettingsFromDB() Settings {
-	settings := Settings{
-		GoogleLoginEnabled:   "false",
-		FacebookLoginEnabled: "false",
-	}
-
-	rows, err := db.Query("SELECT key, value FROM page_settings")
-	if err != nil {
-		return settings
-	}
-	defer rows.Close()
-
-	settingsMap := make(map[string]string)
-	for rows.Next() {
-		var key, value string
-		if err := rows.Scan(&key, &value); err != nil {
-			continue
-		}
-		settingsMap[key] = value
-	}
-
-	if val, ok := settingsMap["google_login_enabled"]; ok {
-		settings.GoogleLoginEnabled = val
-	}
-	if val, ok := settingsMap["facebook_login_enabled"]; ok {
-		settings.FacebookLoginEnabled = val
-	}
-	if val, ok := settingsMap["google_client_id"]; ok {
-		settings.GoogleClientID = val
-	}
-	if val, ok := settingsMap["google_client_secret"]; ok {
-		settings.GoogleClientSecret = val
-	}
-	if val, ok := settingsMap["facebook_app_id"]; ok {
-		settings.FacebookAppID = val
-	}
-	if val, ok := settingsMap["facebook_app_secret"]; ok {
-		settings.FacebookAppSecret = val
-	}
-
-	return settings
-}
-
-func HealthCheck(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-}
-
-func GetSettings(w http.ResponseWriter, r *http.Request) {
+// UpdateSettings is the legacy form save used by the admin UI, and the guest
+// email registration (tracking) call from the portal
+func (s *Server) UpdateSettings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	settings := Settings{
-		BackgroundImage:      "url(/img/nuanu.png)",
-		BackgroundImageType:  "url",
-		BackgroundImageData:  "",
-		BackgroundColor:      "#667eea",
-		PageTitle:            "Welcome To NUANU Free WiFi",
-		ButtonText:           "Connect to WiFi",
-		GoogleLoginEnabled:   "false",
-		FacebookLoginEnabled: "false",
-		GoogleClientID:       "",
-		GoogleClientSecret:   "",
-		FacebookAppID:        "",
-		FacebookAppSecret:    "",
-	}
-
-	rows, err := db.Query("SELECT key, value FROM page_settings")
-	if err != nil {
-		log.Println("Query error:", err)
-		json.NewEncoder(w).Encode(settings)
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
-
-	settingsMap := make(map[string]string)
-	for rows.Next() {
-		var key, value string
-		if err := rows.Scan(&key, &value); err != nil {
-			continue
-		}
-		settingsMap[key] = value
+	var settings struct {
+		Email     string `json:"email"`
+		Tracking  bool   `json:"tracking"`
+		ViewToken string `json:"view_token"`
 	}
+	json.Unmarshal(body["email"], &settings.Email)
+	json.Unmarshal(body["tracking"], &settings.Tracking)
+	json.Unmarshal(body["view_token"], &settings.ViewToken)
 
-	if val, ok := settingsMap["background_image"]; ok {
-		settings.BackgroundImage = val
-	}
-	if val, ok := settingsMap["background_color"]; ok {
-		settings.BackgroundColor = val
-	}
-	if val, ok := settingsMap["page_title"]; ok {
-		settings.PageTitle = val
-	}
-	if val, ok := settingsMap["button_text"]; ok {
-		settings.ButtonText = val
-	}
-	if val, ok := settingsMap["google_login_enabled"]; ok {
-		settings.GoogleLoginEnabled = val
-	}
-	if val, ok := settingsMap["facebook_login_enabled"]; ok {
-		settings.FacebookLoginEnabled = val
-	}
-	if val, ok := settingsMap["google_client_id"]; ok {
-		settings.GoogleClientID = val
-	}
-	if val, ok := settingsMap["google_client_secret"]; ok {
-		settings.GoogleClientSecret = val
-	}
-	if val, ok := settingsMap["facebook_app_id"]; ok {
-		settings.FacebookAppID = val
-	}
-	if val, ok := settingsMap["facebook_app_secret"]; ok {
-		settings.FacebookAppSecret = val
-	}
-
-	json.NewEncoder(w).Encode(settings)
-}
-
-func UpdateSettings(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	var settings Settings
-	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Empty values mean "not sent" here (guests post only email/tracking);
+	// PATCH /api/settings is the way to clear a value
+	changes, errs := decodeSettingChanges(body, false)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
 		return
 	}
-
-	updateSetting := func(key, value string) error {
-		if value == "" {
-			return nil
+	if len(changes) > 0 {
+		site, ok := s.adminSite(w, r)
+		if !ok {
+			return
+		}
+		revision, err := s.saveSettings(site.ID, changes, requestAdmin(r), "update")
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to save settings", "site", site.Slug, "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to save settings", nil)
+			return
+		}
+		if revision > 0 {
+			slog.InfoContext(r.Context(), "Settings saved", "site", site.Slug, "revision", revision)
 		}
-		_, err := db.Exec(`
-			INSERT INTO page_settings (key, value, setting_key, setting_value, updated_at)
-			VALUES ($1, $2, $1, $2, NOW())
-			ON CONFLICT (key) DO UPDATE SET value = $2, setting_value = $2, updated_at = NOW()
-		`, key, value)
-		return err
-	}
-
-	updateSetting("page_title", settings.PageTitle)
-	updateSetting("button_text", settings.ButtonText)
-	updateSetting("background_color", settings.BackgroundColor)
-	updateSetting("google_login_enabled", settings.GoogleLoginEnabled)
-	updateSetting("facebook_login_enabled", settings.FacebookLoginEnabled)
-	updateSetting("google_client_id", settings.GoogleClientID)
-	updateSetting("google_client_secret", settings.GoogleClientSecret)
-	updateSetting("facebook_app_id", settings.FacebookAppID)
-	updateSetting("facebook_app_secret", settings.FacebookAppSecret)
+	}
 
 	// LOG EMAIL IF TRACKING IS ENABLED
 	if settings.Tracking && settings.Email != "" {
+		if !s.allow(w, r, limitGuestEmail, guestLimitKeys(r, r.URL.Query(), settings.Email)) {
+			return
+		}
+		site := s.guestSite(r)
+		siteSettings, ok := s.siteSettings(w, site.ID)
+		if !ok {
+			return
+		}
+		if err := checkAdView(r, siteSettings, r.URL.Query(), settings.ViewToken); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Please watch the ad before connecting."})
+			return
+		}
 		if isValidEmail(settings.Email) {
-			_, err := db.Exec("INSERT INTO collected_emails (email, source) VALUES ($1, 'welcome nuanu wifi') ON CONFLICT (email) DO NOTHING", settings.Email)
-			if err != nil {
-				log.Printf("⚠️ Failed to save email: %v", err)
+			if err := s.Emails.SaveEmail(site.ID, settings.Email, "welcome nuanu wifi"); err != nil {
+				slog.ErrorContext(r.Context(), "Failed to save guest email", "error", err)
 			} else {
-				log.Printf("📧 Email saved to database: %s", settings.Email)
+				slog.InfoContext(r.Context(), "Guest email saved", "provider", "tracking", "email", settings.Email)
 			}
 		} else {
-			log.Printf("🚫 Blocked invalid address: %s", settings.Email)
+			slog.InfoContext(r.Context(), "Blocked invalid guest email", "email", settings.Email)
 			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Please enter a real, valid email address."})
 			return
 		}
@@ -665,217 +612,227 @@ func UpdateSettings(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
-func UploadFile(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetAds(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "File too large", http.StatusBadRequest)
+	site, ok := s.adminSite(w, r)
+	if !ok {
 		return
 	}
-
-	file, header, err := r.FormFile("file")
+	ads, err := s.Ads.Ads(site.ID)
 	if err != nil {
-		http.Error(w, "No file received", http.StatusBadRequest)
+		slog.ErrorContext(r.Context(), "Failed to load ads", "site", site.Slug, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load ads", nil)
 		return
 	}
-	defer file.Close()
+	json.NewEncoder(w).Encode(ads)
+}
 
-	filename := fmt.Sprintf("upload_%d_%s", time.Now().Unix(), header.Filename)
-	uploadDir := "../public/img"
-	os.MkdirAll(uploadDir, 0755)
+func (s *Server) CreateAd(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 
-	dst, err := os.Create(filepath.Join(uploadDir, filename))
-	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+	site, ok := s.adminSite(w, r)
+	if !ok {
 		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+	var ad ScheduledAd
+	if err := json.NewDecoder(r.Body).Decode(&ad); err != nil {
+		slog.InfoContext(r.Context(), "CreateAd: invalid JSON", "error", err)
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
 		return
 	}
 
-	fileURL := fmt.Sprintf("/img/%s", filename)
-
-	// Check if this is for an ad or main BG
-	isAd := r.FormValue("is_ad") == "true"
-	if !isAd {
-		db.Exec(`
-			INSERT INTO page_settings (key, value, setting_key, setting_value, updated_at)
-			VALUES ('background_image', $1, 'background_image', $1, NOW())
-			ON CONFLICT (key) DO UPDATE SET value = $1, setting_value = $1, updated_at = NOW()
-		`, fmt.Sprintf("url(%s)", fileURL))
+	if errs := s.validateAdRequest(r, &ad, nil); len(errs) > 0 {
+		slog.InfoContext(r.Context(), "CreateAd: validation failed", "errors", errs)
+		writeValidationErrors(w, errs)
+		return
 	}
+	slog.InfoContext(r.Context(), "Creating ad", "site", site.Slug, "title", ad.Title, "link", ad.Link)
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"url":     fileURL,
-	})
-}
-
-func GetAds(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	rows, err := db.Query("SELECT id, title, description, image, link, start_date, end_date, start_time, end_time, is_active FROM scheduled_ads ORDER BY created_at DESC")
+	ad.IsActive = true
+	err := s.Ads.CreateAd(site.ID, &ad)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to create ad", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create ad", nil)
 		return
 	}
-	defer rows.Close()
-
-	ads := []ScheduledAd{}
-	for rows.Next() {
-		var ad ScheduledAd
-		var sd, ed sql.NullString
-		var st, et sql.NullString
-		var lnk sql.NullString
-		if err := rows.Scan(&ad.ID, &ad.Title, &ad.Description, &ad.Image, &lnk, &sd, &ed, &st, &et, &ad.IsActive); err != nil {
-			log.Printf("❌ GetAds: Scan error: %v", err)
-			continue
-		}
-		if lnk.Valid {
-			ad.Link = lnk.String
-		}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": ad.ID})
+}
 
+func (s *Server) UpdateAd(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 
-		if sd.Valid {
-			ad.StartDate = sd.String
-		}
-		if ed.Valid {
-			ad.EndDate = ed.String
-		}
-		if st.Valid {
-			ad.StartTime = st.String
-		}
-		if et.Valid {
-			ad.EndTime = et.String
-		}
-		ads = append(ads, ad)
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
 	}
-	json.NewEncoder(w).Encode(ads)
-}
 
-func CreateAd(w http.ResponseWriter, r *http.Request) {
 	var ad ScheduledAd
 	if err := json.NewDecoder(r.Body).Decode(&ad); err != nil {
-		log.Printf("❌ CreateAd: JSON decode error: %v", r.Body)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.InfoContext(r.Context(), "UpdateAd: invalid JSON", "error", err)
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
 		return
 	}
 
-	ad.Link = strings.TrimSpace(ad.Link)
-	log.Printf("➕ Creating Ad: %s, Link: %s", ad.Title, ad.Link)
-
-
-	_, err := db.Exec(`
-		INSERT INTO scheduled_ads (title, description, image, link, start_date, end_date, start_time, end_time, is_active)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-	`, ad.Title, ad.Description, ad.Image, nullIfEmpty(ad.Link),
-		nullIfEmpty(ad.StartDate), nullIfEmpty(ad.EndDate),
-		nullIfEmpty(ad.StartTime), nullIfEmpty(ad.EndTime), true)
-
+	current, err := s.Ads.Ad(site.ID, id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load ad", "ad", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update ad", nil)
+		return
+	}
+	if current == nil {
+		writeJSONError(w, http.StatusNotFound, "Ad not found", nil)
+		return
+	}
+	if errs := s.validateAdRequest(r, &ad, current.CampaignID); len(errs) > 0 {
+		slog.InfoContext(r.Context(), "UpdateAd: validation failed", "ad", id, "errors", errs)
+		writeValidationErrors(w, errs)
+		return
+	}
+	slog.InfoContext(r.Context(), "Updating ad", "ad", id, "title", ad.Title, "link", ad.Link, "active", ad.IsActive)
 
+	ad.ID = id
+	found, err := s.Ads.UpdateAd(site.ID, ad)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to update ad", "ad", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update ad", nil)
 		return
 	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Ad not found", nil)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Ad updated", "ad", id)
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
-func UpdateAd(w http.ResponseWriter, r *http.Request) {
+func (s *Server) DeleteAd(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	
-	vars := mux.Vars(r)
-	idStr := vars["id"]
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		log.Printf("❌ UpdateAd: Invalid ID format '%s': %v", idStr, err)
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Invalid ID format"})
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	id, ok := idFromRequest(w, r)
+	if !ok {
 		return
 	}
 
-	var ad ScheduledAd
-	if err := json.NewDecoder(r.Body).Decode(&ad); err != nil {
-		log.Printf("❌ UpdateAd: JSON decode error: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Invalid request body"})
+	found, err := s.Ads.DeleteAd(site.ID, id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete ad", "ad", id, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete ad", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Ad not found", nil)
 		return
 	}
 
-	ad.Link = strings.TrimSpace(ad.Link)
-	log.Printf("🔄 Updating Ad ID %d: %s (Link: %s, Active: %v)", id, ad.Title, ad.Link, ad.IsActive)
+	slog.InfoContext(r.Context(), "Ad deleted", "ad", id)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
 
-	_, err = db.Exec(`
-		UPDATE scheduled_ads 
-		SET title = $1, description = $2, image = $3, link = $4, start_date = $5, end_date = $6, start_time = $7, end_time = $8, is_active = $9
-		WHERE id = $10
-	`, ad.Title, ad.Description, ad.Image, nullIfEmpty(ad.Link),
-		nullIfEmpty(ad.StartDate), nullIfEmpty(ad.EndDate),
-		nullIfEmpty(ad.StartTime), nullIfEmpty(ad.EndTime), ad.IsActive, id)
+// idFromRequest parses the {id} route variable, answering 400 itself when it is not a positive integer
+func idFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id <= 0 {
+		slog.InfoContext(r.Context(), "Invalid ID format", "id", idStr, "path", r.URL.Path)
+		writeJSONError(w, http.StatusBadRequest, "Invalid ID format", nil)
+		return 0, false
+	}
+	return id, true
+}
 
+// validateAdRequest runs the field validation plus the checks that need the
+// database. Campaigns are shared by all sites, so only unrestricted admins may
+// move an ad into or out of one; current is the ad's campaign before the change.
+func (s *Server) validateAdRequest(r *http.Request, ad *ScheduledAd, current *int) ValidationErrors {
+	errs := validateAd(ad)
+	if _, bad := errs["campaign_id"]; bad {
+		return errs
+	}
+	if !sameCampaign(ad.CampaignID, current) {
+		if ids, err := s.Sites.AdminSiteIDs(requestAdmin(r)); err != nil || ids != nil {
+			errs.Add("campaign_id", "only unrestricted admins can change an ad's campaign")
+			return errs
+		}
+	}
+	if ad.CampaignID != nil {
+		if c, _ := s.Campaigns.Campaign(*ad.CampaignID); c == nil {
+			errs.Add("campaign_id", "campaign %d does not exist", *ad.CampaignID)
+		}
+	}
+	return errs
+}
 
+func sameCampaign(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
 
+func (s *Server) GetActiveAd(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	site := s.guestSite(r)
+	stored, ok := s.liveSettings(w, site.ID)
+	if !ok {
+		return
+	}
+	locale, chain := guestLocale(r, stored)
+	setLocaleHeaders(w, locale)
 
+	ad, day, err := s.findActiveAd(site.ID)
 	if err != nil {
-		log.Printf("❌ UpdateAd: Database execution error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Database error: " + err.Error()})
+		slog.ErrorContext(r.Context(), "Failed to pick the active ad", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load active ad", nil)
 		return
 	}
 
-	log.Printf("✅ Ad ID %d updated successfully", id)
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
-}
+	resp := map[string]interface{}{"ad": nil, "locale": locale}
+	if ad != nil {
+		s.recordImpression(*ad, day)
+		s.localizeAd(ad, chain)
+		resp["ad"] = ad
+	}
 
-func DeleteAd(w http.ResponseWriter, r *http.Request) {
-	id := mux.Vars(r)["id"]
-	_, err := db.Exec("DELETE FROM scheduled_ads WHERE id = $1", id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Server-enforced ad view: the token only matures after the ad was shown for N seconds.
+	// With no active ad there is nothing to watch, so the token is valid immediately.
+	if token, wait, ok := adViewGate(r, portalSettings(stored), ad); ok {
+		resp["view_token"] = token
+		resp["view_seconds"] = wait
 	}
-	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+
+	json.NewEncoder(w).Encode(resp)
 }
 
-func GetActiveAd(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// findActiveAd returns the site's ad to show right now (nil when there is none)
+// and the portal-local day, for impression counting
+func (s *Server) findActiveAd(siteID int) (*ScheduledAd, string, error) {
 	loc, _ := time.LoadLocation("Asia/Makassar")
 	now := time.Now().In(loc)
 	dateStr := now.Format("2006-01-02")
 	timeStr := now.Format("15:04:05")
 
-	var ad ScheduledAd
-	var lnk sql.NullString
-	err := db.QueryRow(`
-		SELECT id, title, description, image, link, end_date, end_time FROM scheduled_ads 
-		WHERE is_active = TRUE 
-		AND (start_date IS NULL OR start_date <= $1)
-		AND (end_date IS NULL OR end_date >= $1)
-		AND (start_time IS NULL OR start_time <= $2)
-		AND (end_time IS NULL OR end_time >= $2)
-		ORDER BY created_at DESC LIMIT 1
-	`, dateStr, timeStr).Scan(&ad.ID, &ad.Title, &ad.Description, &ad.Image, &lnk, &ad.EndDate, &ad.EndTime)
-
-	if lnk.Valid {
-		ad.Link = lnk.String
-	}
-
-
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			json.NewEncoder(w).Encode(map[string]interface{}{"ad": nil})
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
+	ad, err := s.Ads.ActiveAd(siteID, dateStr, timeStr)
+	if err != nil || ad == nil {
+		return nil, dateStr, err
 	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{"ad": ad})
+	ad.ImageVariants = s.imageVariants(ad.Image)
+	return ad, dateStr, nil
 }
 
-func AdminLogin(w http.ResponseWriter, r *http.Request) {
+// AdminLogin checks the admin credentials and issues a session token (see
+// admin_auth.go). Guessing is held back by rate limits per address and per
+// account, and an exponential lockout after repeated failures (see Limiter).
+func (s *Server) AdminLogin(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var creds struct {
@@ -888,30 +845,33 @@ func AdminLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	adminUser := strings.TrimSpace(CleanEnv(os.Getenv("ADMIN_USERNAME")))
-	adminPass := strings.TrimSpace(CleanEnv(os.Getenv("ADMIN_PASSWORD")))
-
-	// Robust fallback if Env is missing
-	if adminUser == "" {
-		adminUser = "admin"
-	}
-	if adminPass == "" {
-		adminPass = "Nuanu0361"
-	}
-
 	inputUser := strings.TrimSpace(creds.Username)
 	inputPass := strings.TrimSpace(creds.Password)
 
-	log.Printf("🔑 Login attempt for user: [%s] (Hex: %x)", inputUser, inputUser)
+	if !s.allow(w, r, limitAdminLogin, map[string]string{limitByIP: clientIP(r), limitByAccount: strings.ToLower(inputUser)}) {
+		return
+	}
+	if s.adminLockedOut(w, r, inputUser) {
+		return
+	}
 
-	if inputUser == adminUser && inputPass == adminPass {
-		log.Println("✅ Login successful")
+	ok, err := s.checkAdminPassword(inputUser, inputPass)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to check admin credentials", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check credentials", nil)
+		return
+	}
+	if ok {
+		slog.InfoContext(r.Context(), "Admin login succeeded", "user", inputUser)
+		s.adminLoginSucceeded(r, inputUser)
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": true,
-			"token":   "nuanu_mock_token_2026",
+			"success":    true,
+			"token":      issueAdminSession(inputUser, time.Now()),
+			"expires_in": int(adminSessionTTL.Seconds()),
 		})
 	} else {
-		log.Printf("❌ Login failed. Expected: [%s] (%x) Received: [%s] (%x)", adminUser, adminUser, inputUser, inputUser)
+		slog.WarnContext(r.Context(), "Admin login failed", "remote", clientIP(r))
+		s.adminLoginFailed(r, inputUser)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
 			"message": "Invalid username or password",
@@ -919,13 +879,6 @@ func AdminLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func nullIfEmpty(s string) interface{} {
-	if s == "" {
-		return nil
-	}
-	return s
-}
-
 func CleanEnv(s string) string {
 	cleaned := strings.Map(func(r rune) rune {
 		if unicode.IsPrint(r) && !unicode.IsSpace(r) {
@@ -989,46 +942,26 @@ func isValidEmail(email string) bool {
 	return true
 }
 
-func GetEmails(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetEmails(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	rows, err := db.Query("SELECT id, email, source, created_at FROM collected_emails ORDER BY created_at DESC")
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	collected, err := s.Emails.Emails(site.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
 	var emails []map[string]interface{}
-	for rows.Next() {
-		var id int
-		var email, source string
-		var createdAt time.Time
-		if err := rows.Scan(&id, &email, &source, &createdAt); err != nil {
-			continue
-		}
+	for _, e := range collected {
 		emails = append(emails, map[string]interface{}{
-			"id":         id,
-			"email":      email,
-			"source":     source,
-			"created_at": createdAt.Format(time.RFC3339),
+			"id":         e.ID,
+			"email":      e.Email,
+			"source":     e.Source,
+			"created_at": e.CreatedAt.Format(time.RFC3339),
 		})
 	}
 	json.NewEncoder(w).Encode(emails)
 }
-
-func LoggerMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		origin := r.Header.Get("Origin")
-		
-		// Clean logs for high frequency
-		log.Printf("📥 [%s] %s (Origin: %s, From: %s)", r.Method, r.URL.Path, origin, r.RemoteAddr)
-		
-		next.ServeHTTP(w, r)
-		
-		elapsed := time.Since(start)
-		if elapsed > 100*time.Millisecond {
-			log.Printf("⚠️  SLUGGISH: %s took %v", r.URL.Path, elapsed)
-		}
-	})
-}
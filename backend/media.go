@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mediaGCGrace protects fresh uploads that the admin has not saved into settings or an ad yet
+const mediaGCGrace = 24 * time.Hour
+
+// managedUploadName matches files written by the upload endpoint, now and in the past.
+// Anything else in storage (logos, icons, default banners) is never garbage collected.
+var managedUploadName = regexp.MustCompile(`^((upload|background)_\d+_.+|[0-9a-f]{32}(-\d+w)?\.(jpg|png|webp|gif|mp4))$`)
+
+// Media is one stored upload in the media library
+type Media struct {
+	ID           int              `json:"id"`
+	Hash         string           `json:"hash"`
+	URL          string           `json:"url"`
+	Keys         []string         `json:"-"`
+	ContentType  string           `json:"content_type"`
+	Size         int64            `json:"size"`
+	Width        int              `json:"width,omitempty"`
+	Height       int              `json:"height,omitempty"`
+	Uploader     string           `json:"uploader"`
+	OriginalName string           `json:"original_name"`
+	Tags         []string         `json:"tags"`
+	Variants     *ImageVariantSet `json:"variants,omitempty"`
+	InUse        bool             `json:"in_use"`
+	CreatedAt    time.Time        `json:"created_at"`
+}
+
+// mediaStillStored guards dedup against rows whose files were removed behind our back
+func mediaStillStored(ctx context.Context, store Storage, m *Media) bool {
+	for _, key := range m.Keys {
+		if ok, err := store.Exists(ctx, key); err != nil || !ok {
+			return false
+		}
+	}
+	return len(m.Keys) > 0
+}
+
+// addMediaTags merges tags into an existing entry (used when a duplicate is re-uploaded)
+func (s *Server) addMediaTags(m *Media, tags []string) error {
+	merged := normalizeTags(append(append([]string{}, m.Tags...), tags...))
+	if _, err := s.Media.SetMediaTags(m.ID, merged); err != nil {
+		return err
+	}
+	m.Tags = merged
+	return nil
+}
+
+// normalizeTags lowercases, trims and de-duplicates tags, keeping their order
+func normalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] || len(t) > 50 {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	return out
+}
+
+func parseTags(s string) []string {
+	return normalizeTags(strings.Split(s, ","))
+}
+
+// keyFromURL turns a stored image reference (plain URL, absolute URL or CSS url(...))
+// into the storage key it points at
+func keyFromURL(ref string) string {
+	ref = unwrapCSSURL(ref)
+	if ref == "" {
+		return ""
+	}
+	p := ref
+	if u, err := url.Parse(ref); err == nil {
+		p = u.Path
+	} else if unescaped, err := url.PathUnescape(ref); err == nil {
+		p = unescaped
+	}
+	key := path.Base(p)
+	if key == "." || key == "/" {
+		return ""
+	}
+	return key
+}
+
+// referencedStorageKeys collects every storage key the portal still points at,
+// including settings revisions and the draft so a rollback or publish never ends up
+// with a missing background.
+// An error must abort garbage collection: an empty set would delete everything.
+func (s *Server) referencedStorageKeys() (map[string]bool, error) {
+	all, err := s.Media.ImageReferences()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]bool{}
+	for _, ref := range all {
+		if key := keyFromURL(ref); key != "" {
+			refs[key] = true
+		}
+	}
+	return refs, nil
+}
+
+func (m *Media) referencedBy(refs map[string]bool) bool {
+	if refs[keyFromURL(m.URL)] {
+		return true
+	}
+	for _, key := range m.Keys {
+		if refs[key] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) GetMedia(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	q := r.URL.Query()
+
+	filter := MediaFilter{
+		Tag:    strings.ToLower(strings.TrimSpace(q.Get("tag"))),
+		Type:   strings.TrimSpace(q.Get("type")),
+		Search: strings.TrimSpace(q.Get("q")),
+	}
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(q.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	filter.Limit, filter.Offset = limit, offset
+
+	items, err := s.Media.ListMedia(filter)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load media", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load media", nil)
+		return
+	}
+
+	refs, err := s.referencedStorageKeys()
+	if err != nil {
+		slog.WarnContext(r.Context(), "Could not resolve media references", "error", err)
+	}
+	for i := range items {
+		items[i].InUse = items[i].referencedBy(refs)
+	}
+	json.NewEncoder(w).Encode(items)
+}
+
+// UpdateMedia replaces the tags of a library entry
+func (s *Server) UpdateMedia(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+
+	found, err := s.Media.SetMediaTags(id, normalizeTags(body.Tags))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update media", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update media", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Media not found", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// DeleteMedia removes an unused asset and its files; assets still on the portal are refused
+func (s *Server) DeleteMedia(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+	m, err := s.Media.MediaByID(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load media", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete media", nil)
+		return
+	}
+	if m == nil {
+		writeJSONError(w, http.StatusNotFound, "Media not found", nil)
+		return
+	}
+
+	refs, err := s.referencedStorageKeys()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Could not resolve media references", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete media", nil)
+		return
+	}
+	if m.referencedBy(refs) {
+		writeJSONError(w, http.StatusConflict, "Media is still used by the portal settings or an ad", nil)
+		return
+	}
+
+	if err := s.deleteMedia(r.Context(), m); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete media", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete media", nil)
+		return
+	}
+	slog.InfoContext(r.Context(), "Media deleted", "media", m.ID, "url", m.URL)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+func (s *Server) deleteMedia(ctx context.Context, m *Media) error {
+	for _, key := range m.Keys {
+		if err := s.Storage.Delete(ctx, key); err != nil {
+			return fmt.Errorf("delete %s: %w", key, err)
+		}
+	}
+	return s.Media.RemoveMedia(m.ID)
+}
+
+// MediaGCReport summarises one garbage collection run
+type MediaGCReport struct {
+	DryRun       bool     `json:"dry_run"`
+	Removed      []string `json:"removed"`
+	MediaRemoved int      `json:"media_removed"`
+	BytesFreed   int64    `json:"bytes_freed"`
+	Kept         int      `json:"kept"`
+}
+
+// collectMediaGarbage deletes uploads referenced by neither page_settings nor
+// scheduled_ads: library entries first, then untracked files left over from
+// before the library existed. Only upload-named files older than grace qualify.
+func (s *Server) collectMediaGarbage(ctx context.Context, dryRun bool, grace time.Duration) (*MediaGCReport, error) {
+	report := &MediaGCReport{DryRun: dryRun, Removed: []string{}}
+	cutoff := time.Now().Add(-grace)
+
+	refs, err := s.referencedStorageKeys()
+	if err != nil {
+		return nil, fmt.Errorf("resolve references: %w", err)
+	}
+
+	objects, err := s.Storage.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list storage: %w", err)
+	}
+	sizes := map[string]int64{}
+	for _, obj := range objects {
+		sizes[obj.Key] = obj.Size
+	}
+
+	library, err := s.Media.ListMedia(MediaFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := map[string]bool{}
+	for i := range library {
+		m := &library[i]
+		for _, key := range m.Keys {
+			tracked[key] = true
+		}
+		if m.referencedBy(refs) || m.CreatedAt.After(cutoff) {
+			report.Kept++
+			continue
+		}
+		if !dryRun {
+			if err := s.deleteMedia(ctx, m); err != nil {
+				slog.WarnContext(ctx, "Media GC", "error", err)
+				continue
+			}
+		}
+		report.MediaRemoved++
+		for _, key := range m.Keys {
+			report.Removed = append(report.Removed, key)
+			report.BytesFreed += sizes[key]
+		}
+	}
+
+	for _, obj := range objects {
+		if tracked[obj.Key] || refs[obj.Key] || !managedUploadName.MatchString(obj.Key) {
+			continue
+		}
+		if obj.ModTime.After(cutoff) {
+			report.Kept++
+			continue
+		}
+		if !dryRun {
+			if err := s.Storage.Delete(ctx, obj.Key); err != nil {
+				slog.WarnContext(ctx, "Media GC could not delete a file", "key", obj.Key, "error", err)
+				continue
+			}
+		}
+		report.Removed = append(report.Removed, obj.Key)
+		report.BytesFreed += obj.Size
+	}
+	return report, nil
+}
+
+// RunMediaGC triggers garbage collection from the admin UI; ?dry_run=true only reports
+func (s *Server) RunMediaGC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	report, err := s.collectMediaGarbage(r.Context(), dryRun, mediaGCGrace)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Media GC failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Garbage collection failed", nil)
+		return
+	}
+	slog.InfoContext(r.Context(), "Media GC done", "dry_run", dryRun, "removed", len(report.Removed), "bytes_freed", report.BytesFreed)
+	json.NewEncoder(w).Encode(report)
+}
+
+// runMediaGCCommand implements `wifi-portal-backend gc [-dry-run] [-grace 24h]`
+func (s *Server) runMediaGCCommand(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only list what would be removed")
+	grace := flags.Duration("grace", mediaGCGrace, "keep uploads younger than this")
+	flags.Parse(args)
+
+	report, err := s.collectMediaGarbage(context.Background(), *dryRun, *grace)
+	if err != nil {
+		fatal("Media GC failed", "error", err)
+	}
+	for _, key := range report.Removed {
+		fmt.Println(key)
+	}
+	slog.Info("Media GC done", "dry_run", report.DryRun, "removed", len(report.Removed),
+		"media_removed", report.MediaRemoved, "bytes_freed", report.BytesFreed, "kept", report.Kept)
+	os.Exit(0)
+}
+
+// startMediaGCJob runs garbage collection periodically when MEDIA_GC_INTERVAL is set (e.g. "24h")
+func (s *Server) startMediaGCJob() {
+	raw := CleanEnv(os.Getenv("MEDIA_GC_INTERVAL"))
+	if raw == "" {
+		return
+	}
+	interval, err := time.ParseDuration(raw)
+	if err != nil || interval <= 0 {
+		slog.Warn("Ignoring invalid setting", "name", "MEDIA_GC_INTERVAL", "value", raw)
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			report, err := s.collectMediaGarbage(context.Background(), false, mediaGCGrace)
+			if err != nil {
+				slog.Error("Scheduled media GC failed", "error", err)
+				continue
+			}
+			slog.Info("Scheduled media GC done", "removed", len(report.Removed), "bytes_freed", report.BytesFreed)
+		}
+	}()
+	slog.Info("Media GC scheduled", "interval", interval.String())
+}
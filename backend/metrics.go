@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes every metric the backend exports
+const metricsNamespace = "wifi_portal"
+
+// Metrics are the Prometheus metrics served on /metrics. Each server has its
+// own registry so tests (and several servers in one process) do not clash.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests     *prometheus.CounterVec
+	httpDuration     *prometheus.HistogramVec
+	oauthLogins      *prometheus.CounterVec
+	hotspotRedirects *prometheus.CounterVec
+	adImpressions    prometheus.Counter
+	uploadBytes      prometheus.Histogram
+	rateLimited      *prometheus.CounterVec
+}
+
+// The results of oauthLogins: a guest starting a login, and how the callback ended
+const (
+	loginStarted = "started"
+	loginSuccess = "success"
+	loginFailure = "failure"
+)
+
+func newMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route and method.",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"route", "method"}),
+		oauthLogins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "guest_logins_total",
+			Help:      "Guest logins by provider (google, facebook, email) and result (started, success, failure).",
+		}, []string{"provider", "result"}),
+		hotspotRedirects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "hotspot_authorize_redirects_total",
+			Help:      "Guests redirected to the MikroTik hotspot login, by provider.",
+		}, []string{"provider"}),
+		adImpressions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ad_impressions_total",
+			Help:      "Ads shown to guests.",
+		}),
+		uploadBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_size_bytes",
+			Help:      "Size of media uploads.",
+			Buckets:   prometheus.ExponentialBuckets(16<<10, 4, 8), // 16KiB to 256MiB
+		}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rate_limited_total",
+			Help:      "Requests refused by a rate limit, by action and key (ip, mac, account, lockout).",
+		}, []string{"action", "key"}),
+	}
+	m.registry.MustRegister(
+		m.httpRequests, m.httpDuration, m.oauthLogins, m.hotspotRedirects, m.adImpressions, m.uploadBytes, m.rateLimited,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// watchSettingsCache exports the settings cache hits and misses; the hit rate
+// is rate(hits) / (rate(hits) + rate(misses))
+func (m *Metrics) watchSettingsCache(c *SettingsCache) {
+	m.registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "settings_cache_hits_total",
+			Help:      "Settings lookups answered from the cache.",
+		}, func() float64 { hits, _ := c.Stats(); return float64(hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "settings_cache_misses_total",
+			Help:      "Settings lookups that went to the database.",
+		}, func() float64 { _, misses := c.Stats(); return float64(misses) }),
+	)
+}
+
+// WatchDatabase exports the connection pool statistics of db
+func (m *Metrics) WatchDatabase(db *Database) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db.DB, db.Dialect))
+}
+
+// routeKey is the context key of the route a request matched
+type routeKey struct{}
+
+// setRoute records the route template a request matched, for its metrics and
+// span name. Requests that match no route are counted as "unmatched" so stray
+// URLs cannot blow up the number of series.
+func setRoute(r *http.Request, route string) {
+	if p, ok := r.Context().Value(routeKey{}).(*string); ok {
+		*p = route
+	}
+	nameSpan(r, route)
+}
+
+// routeFromMux is router middleware recording the matched route template
+func routeFromMux(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				setRoute(r, tmpl)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// metricMethods are the request methods that get their own label value; the
+// method is client-controlled, so anything else is counted as OTHER
+var metricMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+func methodLabel(method string) string {
+	if metricMethods[method] {
+		return method
+	}
+	return "OTHER"
+}
+
+// instrument counts and times every request by route
+func (m *Metrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := "unmatched"
+		r = r.WithContext(context.WithValue(r.Context(), routeKey{}, &route))
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		method := methodLabel(r.Method)
+		m.httpRequests.WithLabelValues(route, method, strconv.Itoa(rec.status)).Inc()
+		m.httpDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Handler serves the metrics in the Prometheus text format. With METRICS_TOKEN
+// set, scrapers must send it as a bearer token.
+func (m *Metrics) Handler() http.Handler {
+	h := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	token := CleanEnv(os.Getenv("METRICS_TOKEN"))
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loginEvent counts a guest login step for provider
+func (m *Metrics) loginEvent(provider, result string) {
+	m.oauthLogins.WithLabelValues(provider, result).Inc()
+}
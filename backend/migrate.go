@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationsLockID serialises schema changes between instances starting together
+const migrationsLockID = 7310002
+
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrationFS embed.FS
+
+// migrationDirs holds each dialect's migrations. Both sets have the same
+// versions and names; the SQLite files express the same schema in its dialect.
+var migrationDirs = map[string]string{
+	dialectPostgres: "migrations",
+	dialectSQLite:   "migrations/sqlite",
+}
+
+var migrationFile = regexp.MustCompile(`^(\d{4})_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is one numbered schema change from backend/migrations
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads a dialect's embedded migrations in version order.
+// Every version needs both an up and a down file.
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := migrationDirs[dialect]
+	entries, err := fs.ReadDir(migrationFS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_name.up.sql", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := migrationFS.ReadFile(dir + "/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %04d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(data)
+		} else {
+			mig.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func ensureMigrationsTable(db *Database) error {
+	appliedAt := "TIMESTAMPTZ DEFAULT NOW()"
+	if db.Dialect == dialectSQLite {
+		appliedAt = "TIMESTAMP DEFAULT CURRENT_TIMESTAMP"
+	}
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at ` + appliedAt + `
+		)
+	`)
+	return err
+}
+
+// appliedMigrations maps applied versions to when they were applied
+func appliedMigrations(q queryer) (map[int]time.Time, error) {
+	rows, err := q.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// migrateUp applies every pending migration up to target (0: all), each in its
+// own transaction, and returns how many were applied. It stops at the first
+// failure; that migration's changes are rolled back.
+func migrateUp(db *Database, target int) (int, error) {
+	migrations, err := loadMigrations(db.Dialect)
+	if err != nil {
+		return 0, err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if target > 0 && m.Version > target {
+			break
+		}
+		applied, err := runMigration(db, m, true)
+		if err != nil {
+			return count, fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+		if applied {
+			slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// migrateDown reverts the newest steps applied migrations
+func migrateDown(db *Database, steps int) (int, error) {
+	migrations, err := loadMigrations(db.Dialect)
+	if err != nil {
+		return 0, err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		reverted, err := runMigration(db, m, false)
+		if err != nil {
+			return count, fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+		if reverted {
+			slog.Info("Reverted migration", "version", m.Version, "name", m.Name)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// runMigration applies (up) or reverts one migration in a transaction. The
+// migrations lock and the schema_migrations check inside it make sure only one
+// instance runs it; false means another one already had.
+//
+// On SQLite the transaction itself holds the write lock. Its foreign keys are
+// switched off meanwhile, as rebuilding a table (SQLite's way of changing a
+// key) requires, and checked before committing instead.
+func runMigration(db *Database, m Migration, up bool) (bool, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if db.Dialect == dialectSQLite {
+		if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+			return false, err
+		}
+		defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if db.Dialect == dialectPostgres {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationsLockID); err != nil {
+			return false, err
+		}
+	}
+	var done bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1)", m.Version).Scan(&done); err != nil {
+		return false, err
+	}
+	if done == up {
+		return false, nil
+	}
+
+	script, record := m.Up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"
+	args := []interface{}{m.Version, m.Name}
+	if !up {
+		script, record = m.Down, "DELETE FROM schema_migrations WHERE version = $1"
+		args = args[:1]
+	}
+	if _, err := tx.Exec(script); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return false, err
+	}
+	if db.Dialect == dialectSQLite {
+		var table string
+		err := tx.QueryRow("SELECT \"table\" FROM pragma_foreign_key_check").Scan(&table)
+		if err == nil {
+			return false, fmt.Errorf("leaves rows in %s pointing at missing rows", table)
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// MigrationStatus is one line of `migrate status`
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+func migrationStatus(db *Database) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		s := MigrationStatus{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			s.AppliedAt = &at
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// runMigrateCommand is the `migrate` subcommand:
+//
+//	migrate up [-to N]     apply pending migrations (up to version N)
+//	migrate down [-steps N] revert the newest N applied migrations (default 1)
+//	migrate status         list migrations and when they were applied
+func runMigrateCommand(db *Database, args []string) {
+	action := "up"
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+
+	flags := flag.NewFlagSet("migrate "+action, flag.ExitOnError)
+	switch action {
+	case "up":
+		to := flags.Int("to", 0, "stop after this version (0: apply all)")
+		flags.Parse(args)
+		n, err := migrateUp(db, *to)
+		if err != nil {
+			fatal("Migration failed", "applied", n, "error", err)
+		}
+		slog.Info("Migrations applied", "applied", n)
+	case "down":
+		steps := flags.Int("steps", 1, "number of migrations to revert")
+		flags.Parse(args)
+		n, err := migrateDown(db, *steps)
+		if err != nil {
+			fatal("Revert failed", "reverted", n, "error", err)
+		}
+		slog.Info("Migrations reverted", "reverted", n)
+	case "status":
+		flags.Parse(args)
+		status, err := migrationStatus(db)
+		if err != nil {
+			fatal("migrate status failed", "error", err)
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d  %-40s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		fatal("Unknown migrate action (use up, down or status)", "action", action)
+	}
+	os.Exit(0)
+}
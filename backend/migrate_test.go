@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestMigrationDialectsMatch(t *testing.T) {
+	postgres, err := loadMigrations(dialectPostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite, err := loadMigrations(dialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(postgres) != len(sqlite) {
+		t.Fatalf("%d postgres migrations, %d sqlite", len(postgres), len(sqlite))
+	}
+	for i := range postgres {
+		if postgres[i].Version != sqlite[i].Version || postgres[i].Name != sqlite[i].Name {
+			t.Errorf("postgres %04d_%s, sqlite %04d_%s", postgres[i].Version, postgres[i].Name, sqlite[i].Version, sqlite[i].Name)
+		}
+	}
+}
+
+func TestSQLiteMigrationsRoundTrip(t *testing.T) {
+	db, err := openDatabase("sqlite:" + t.TempDir() + "/portal.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	all, err := loadMigrations(dialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := migrateUp(db, 0); err != nil || n != len(all) {
+		t.Fatalf("up: applied %d of %d: %v", n, len(all), err)
+	}
+
+	// Reverting everything but 0001 keeps the default site's rows
+	store := NewStore(db)
+	title := "Welcome"
+	if _, err := store.SaveSettings(defaultSiteID, map[string]*string{"page_title": &title}, "admin", "test"); err != nil {
+		t.Fatal(err)
+	}
+	other := &Site{Slug: "beach", Name: "Beach", Hostnames: []string{"beach.example"}}
+	if err := store.CreateSite(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveEmail(defaultSiteID, "guest@example.com", "google"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveEmail(other.ID, "guest@example.com", "google"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := migrateDown(db, len(all)-1); err != nil || n != len(all)-1 {
+		t.Fatalf("down: reverted %d of %d: %v", n, len(all)-1, err)
+	}
+	var key, emails string
+	if err := db.QueryRow("SELECT setting_key FROM page_settings").Scan(&key); err != nil || key != "page_title" {
+		t.Fatalf("page_settings after down: %q, %v", key, err)
+	}
+	if err := db.QueryRow("SELECT group_concat(email) FROM collected_emails").Scan(&emails); err != nil || emails != "guest@example.com" {
+		t.Fatalf("collected_emails after down: %q, %v", emails, err)
+	}
+
+	if _, err := migrateDown(db, 1); err != nil {
+		t.Fatalf("down to nothing: %v", err)
+	}
+	if n, err := migrateUp(db, 0); err != nil || n != len(all) {
+		t.Fatalf("up again: applied %d of %d: %v", n, len(all), err)
+	}
+}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS collected_emails;
+DROP TABLE IF EXISTS scheduled_ads;
+DROP TABLE IF EXISTS page_settings;
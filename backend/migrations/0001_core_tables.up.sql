@@ -0,0 +1,31 @@
+-- Portal settings, ads and the collected guest emails
+CREATE TABLE IF NOT EXISTS page_settings (
+	key TEXT PRIMARY KEY,
+	value TEXT,
+	setting_key TEXT,
+	setting_value TEXT,
+	created_at TIMESTAMP DEFAULT NOW(),
+	updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS scheduled_ads (
+	id SERIAL PRIMARY KEY,
+	title TEXT,
+	description TEXT,
+	image TEXT,
+	link TEXT,
+	start_date DATE,
+	end_date DATE,
+	start_time TIME,
+	end_time TIME,
+	is_active BOOLEAN DEFAULT TRUE,
+	created_at TIMESTAMP DEFAULT NOW()
+);
+ALTER TABLE scheduled_ads ADD COLUMN IF NOT EXISTS link TEXT;
+
+CREATE TABLE IF NOT EXISTS collected_emails (
+	id SERIAL PRIMARY KEY,
+	email TEXT UNIQUE NOT NULL,
+	source TEXT, -- 'manual', 'google', 'facebook'
+	created_at TIMESTAMP DEFAULT NOW()
+);
@@ -0,0 +1,4 @@
+ALTER TABLE scheduled_ads DROP COLUMN IF EXISTS campaign_id;
+DROP TABLE IF EXISTS ad_impressions;
+DROP TABLE IF EXISTS ad_campaigns;
+DROP TABLE IF EXISTS advertisers;
@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS advertisers (
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	contact_name TEXT,
+	contact_email TEXT,
+	created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS ad_campaigns (
+	id SERIAL PRIMARY KEY,
+	advertiser_id INTEGER NOT NULL REFERENCES advertisers(id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	start_date DATE,
+	end_date DATE,
+	impression_goal INTEGER DEFAULT 0,
+	created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- No FK on ad_id: delivery history must survive deleting the ad
+CREATE TABLE IF NOT EXISTS ad_impressions (
+	ad_id INTEGER NOT NULL,
+	campaign_id INTEGER,
+	day DATE NOT NULL,
+	impressions INTEGER DEFAULT 0,
+	PRIMARY KEY (ad_id, day)
+);
+
+-- Ads can belong to a campaign
+ALTER TABLE scheduled_ads ADD COLUMN IF NOT EXISTS campaign_id INTEGER REFERENCES ad_campaigns(id) ON DELETE SET NULL;
@@ -0,0 +1,17 @@
+-- Every stored upload; storage_keys lists all storage objects (variants included)
+CREATE TABLE IF NOT EXISTS media (
+	id SERIAL PRIMARY KEY,
+	hash TEXT UNIQUE NOT NULL,
+	url TEXT NOT NULL,
+	storage_keys TEXT[] NOT NULL,
+	content_type TEXT,
+	size BIGINT,
+	width INTEGER,
+	height INTEGER,
+	uploader TEXT,
+	original_name TEXT,
+	tags TEXT[] DEFAULT '{}',
+	variants JSONB,
+	created_at TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS media_url_idx ON media (url);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS settings_revisions;
+DROP FUNCTION IF EXISTS settings_revisions_keep();
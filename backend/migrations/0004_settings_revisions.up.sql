@@ -0,0 +1,24 @@
+-- Snapshot of page_settings after every save; rows are never changed
+CREATE TABLE IF NOT EXISTS settings_revisions (
+	id SERIAL PRIMARY KEY,
+	settings JSONB NOT NULL,
+	author TEXT,
+	reason TEXT,
+	restored_from INTEGER,
+	created_at TIMESTAMP DEFAULT NOW()
+);
+CREATE OR REPLACE RULE settings_revisions_no_update AS ON UPDATE TO settings_revisions DO INSTEAD NOTHING;
+
+-- Deletes are ignored too, except when a deleted site cascades to its revisions
+-- (a rule would also swallow the cascade and make the site delete fail)
+DROP RULE IF EXISTS settings_revisions_no_delete ON settings_revisions;
+CREATE OR REPLACE FUNCTION settings_revisions_keep() RETURNS trigger AS $$
+BEGIN
+	IF pg_trigger_depth() > 1 THEN
+		RETURN OLD;
+	END IF;
+	RETURN NULL;
+END $$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS settings_revisions_no_delete ON settings_revisions;
+CREATE TRIGGER settings_revisions_no_delete BEFORE DELETE ON settings_revisions
+	FOR EACH ROW EXECUTE FUNCTION settings_revisions_keep();
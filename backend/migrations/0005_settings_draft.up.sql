@@ -0,0 +1,9 @@
+-- The one staged set of guest-facing settings, optionally scheduled to go live
+CREATE TABLE IF NOT EXISTS settings_draft (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	settings JSONB NOT NULL,
+	preview_token TEXT NOT NULL,
+	publish_at TIMESTAMPTZ,
+	updated_by TEXT,
+	updated_at TIMESTAMP DEFAULT NOW()
+);
@@ -0,0 +1,19 @@
+-- Back to a single site: only the default site's settings, ads and emails survive
+DELETE FROM sites WHERE id <> 1;
+
+ALTER TABLE settings_draft DROP CONSTRAINT IF EXISTS settings_draft_pkey;
+ALTER TABLE settings_draft ADD COLUMN id INTEGER NOT NULL DEFAULT 1 CHECK (id = 1);
+ALTER TABLE settings_draft ADD PRIMARY KEY (id);
+ALTER TABLE collected_emails DROP CONSTRAINT IF EXISTS collected_emails_site_email_key;
+ALTER TABLE collected_emails ADD CONSTRAINT collected_emails_email_key UNIQUE (email);
+ALTER TABLE page_settings DROP CONSTRAINT IF EXISTS page_settings_pkey;
+ALTER TABLE page_settings ADD PRIMARY KEY (key);
+
+ALTER TABLE settings_draft DROP COLUMN IF EXISTS site_id;
+ALTER TABLE settings_revisions DROP COLUMN IF EXISTS site_id;
+ALTER TABLE collected_emails DROP COLUMN IF EXISTS site_id;
+ALTER TABLE scheduled_ads DROP COLUMN IF EXISTS site_id;
+ALTER TABLE page_settings DROP COLUMN IF EXISTS site_id;
+
+DROP TABLE IF EXISTS admin_sites;
+DROP TABLE IF EXISTS sites;
@@ -0,0 +1,50 @@
+-- Sites: every venue gets its own settings, ads and collected emails.
+-- Rows from before multi-site belong to the default site (id 1).
+CREATE TABLE IF NOT EXISTS sites (
+	id SERIAL PRIMARY KEY,
+	slug TEXT UNIQUE NOT NULL,
+	name TEXT NOT NULL,
+	hostnames TEXT[] DEFAULT '{}',
+	gateways TEXT[] DEFAULT '{}',
+	created_at TIMESTAMP DEFAULT NOW()
+);
+INSERT INTO sites (id, slug, name) VALUES (1, 'default', 'Nuanu') ON CONFLICT (id) DO NOTHING;
+SELECT setval(pg_get_serial_sequence('sites', 'id'), GREATEST((SELECT MAX(id) FROM sites), 1));
+
+-- Admins listed here may only manage these sites; admins without rows manage all
+CREATE TABLE IF NOT EXISTS admin_sites (
+	username TEXT NOT NULL,
+	site_id INTEGER NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+	PRIMARY KEY (username, site_id)
+);
+
+ALTER TABLE page_settings ADD COLUMN IF NOT EXISTS site_id INTEGER NOT NULL DEFAULT 1 REFERENCES sites(id) ON DELETE CASCADE;
+ALTER TABLE scheduled_ads ADD COLUMN IF NOT EXISTS site_id INTEGER NOT NULL DEFAULT 1 REFERENCES sites(id) ON DELETE CASCADE;
+ALTER TABLE collected_emails ADD COLUMN IF NOT EXISTS site_id INTEGER NOT NULL DEFAULT 1 REFERENCES sites(id) ON DELETE CASCADE;
+ALTER TABLE settings_revisions ADD COLUMN IF NOT EXISTS site_id INTEGER NOT NULL DEFAULT 1 REFERENCES sites(id) ON DELETE CASCADE;
+ALTER TABLE settings_draft ADD COLUMN IF NOT EXISTS site_id INTEGER NOT NULL DEFAULT 1 REFERENCES sites(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS scheduled_ads_site_idx ON scheduled_ads (site_id);
+CREATE INDEX IF NOT EXISTS settings_revisions_site_idx ON settings_revisions (site_id, id);
+
+-- Keys are unique per site now: page_settings (site_id, key), collected_emails (site_id, email),
+-- and settings_draft holds one draft per site
+DO $$
+BEGIN
+	IF NOT EXISTS (
+		SELECT 1 FROM pg_index i JOIN pg_class c ON c.oid = i.indrelid
+		WHERE c.relname = 'page_settings' AND i.indisprimary AND i.indnatts = 2
+	) THEN
+		ALTER TABLE page_settings DROP CONSTRAINT IF EXISTS page_settings_pkey;
+		ALTER TABLE page_settings ADD PRIMARY KEY (site_id, key);
+	END IF;
+	IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'collected_emails_email_key') THEN
+		ALTER TABLE collected_emails DROP CONSTRAINT collected_emails_email_key;
+		ALTER TABLE collected_emails ADD CONSTRAINT collected_emails_site_email_key UNIQUE (site_id, email);
+	END IF;
+	IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'settings_draft_id_check') THEN
+		ALTER TABLE settings_draft DROP CONSTRAINT settings_draft_id_check;
+		ALTER TABLE settings_draft DROP CONSTRAINT settings_draft_pkey;
+		ALTER TABLE settings_draft DROP COLUMN id;
+		ALTER TABLE settings_draft ADD PRIMARY KEY (site_id);
+	END IF;
+END $$;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS portal_themes;
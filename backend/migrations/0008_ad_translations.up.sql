@@ -0,0 +1,9 @@
+-- Per-locale ad text; settings translations live in page_settings as "<key>.<locale>"
+CREATE TABLE IF NOT EXISTS ad_translations (
+	ad_id INTEGER NOT NULL REFERENCES scheduled_ads(id) ON DELETE CASCADE,
+	locale TEXT NOT NULL,
+	title TEXT,
+	description TEXT,
+	updated_at TIMESTAMP DEFAULT NOW(),
+	PRIMARY KEY (ad_id, locale)
+);
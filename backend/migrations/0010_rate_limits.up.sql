@@ -0,0 +1,15 @@
+-- Token buckets and admin login failures of the rate limiter, shared by all
+-- instances. Bucket times are unix seconds so the refill is plain arithmetic.
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+	key TEXT PRIMARY KEY,
+	tokens DOUBLE PRECISION NOT NULL,
+	refilled_at DOUBLE PRECISION NOT NULL,
+	granted SMALLINT NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS login_failures (
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	last_failure_at TIMESTAMPTZ NOT NULL,
+	locked_until TIMESTAMPTZ
+);
@@ -0,0 +1,13 @@
+-- Back to one row per ad and day, summing the campaigns of a day together
+CREATE TABLE ad_impressions_old (
+	ad_id INTEGER NOT NULL,
+	campaign_id INTEGER,
+	day DATE NOT NULL,
+	impressions INTEGER DEFAULT 0,
+	PRIMARY KEY (ad_id, day)
+);
+INSERT INTO ad_impressions_old (ad_id, campaign_id, day, impressions)
+	SELECT ad_id, NULLIF(MAX(campaign_id), 0), day, SUM(impressions) FROM ad_impressions GROUP BY ad_id, day;
+DROP TABLE ad_impressions;
+ALTER TABLE ad_impressions_old RENAME TO ad_impressions;
+ALTER INDEX ad_impressions_old_pkey RENAME TO ad_impressions_pkey;
@@ -0,0 +1,8 @@
+-- Impressions are counted per campaign too: an ad moved to another campaign
+-- mid-day credits each campaign with what was served under it. Being part of
+-- the key, campaign_id is 0 rather than NULL for ads without a campaign.
+UPDATE ad_impressions SET campaign_id = 0 WHERE campaign_id IS NULL;
+ALTER TABLE ad_impressions ALTER COLUMN campaign_id SET DEFAULT 0;
+ALTER TABLE ad_impressions ALTER COLUMN campaign_id SET NOT NULL;
+ALTER TABLE ad_impressions DROP CONSTRAINT IF EXISTS ad_impressions_pkey;
+ALTER TABLE ad_impressions ADD PRIMARY KEY (ad_id, campaign_id, day);
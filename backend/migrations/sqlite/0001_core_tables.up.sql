@@ -0,0 +1,31 @@
+-- Portal settings, ads and the collected guest emails. Ad dates and times are
+-- kept as 'YYYY-MM-DD' and 'HH:MM:SS' text, which compares like the values.
+CREATE TABLE IF NOT EXISTS page_settings (
+	key TEXT PRIMARY KEY,
+	value TEXT,
+	setting_key TEXT,
+	setting_value TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS scheduled_ads (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT,
+	description TEXT,
+	image TEXT,
+	link TEXT,
+	start_date TEXT,
+	end_date TEXT,
+	start_time TEXT,
+	end_time TEXT,
+	is_active BOOLEAN DEFAULT TRUE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS collected_emails (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT UNIQUE NOT NULL,
+	source TEXT, -- 'manual', 'google', 'facebook'
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
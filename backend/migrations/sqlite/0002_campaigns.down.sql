@@ -0,0 +1,22 @@
+-- SQLite cannot drop a column with a foreign key, so scheduled_ads is rebuilt without it
+CREATE TABLE scheduled_ads_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT,
+	description TEXT,
+	image TEXT,
+	link TEXT,
+	start_date TEXT,
+	end_date TEXT,
+	start_time TEXT,
+	end_time TEXT,
+	is_active BOOLEAN DEFAULT TRUE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO scheduled_ads_new (id, title, description, image, link, start_date, end_date, start_time, end_time, is_active, created_at)
+	SELECT id, title, description, image, link, start_date, end_date, start_time, end_time, is_active, created_at FROM scheduled_ads;
+DROP TABLE scheduled_ads;
+ALTER TABLE scheduled_ads_new RENAME TO scheduled_ads;
+
+DROP TABLE IF EXISTS ad_impressions;
+DROP TABLE IF EXISTS ad_campaigns;
+DROP TABLE IF EXISTS advertisers;
@@ -0,0 +1,18 @@
+-- Every stored upload; storage_keys lists all storage objects (variants included).
+-- storage_keys and tags are JSON arrays of strings.
+CREATE TABLE IF NOT EXISTS media (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	hash TEXT UNIQUE NOT NULL,
+	url TEXT NOT NULL,
+	storage_keys TEXT NOT NULL,
+	content_type TEXT,
+	size INTEGER,
+	width INTEGER,
+	height INTEGER,
+	uploader TEXT,
+	original_name TEXT,
+	tags TEXT DEFAULT '[]',
+	variants TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS media_url_idx ON media (url);
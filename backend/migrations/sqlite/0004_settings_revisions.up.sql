@@ -0,0 +1,17 @@
+-- Snapshot of page_settings after every save; rows are never changed or deleted
+CREATE TABLE IF NOT EXISTS settings_revisions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	settings TEXT NOT NULL,
+	author TEXT,
+	reason TEXT,
+	restored_from INTEGER,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TRIGGER IF NOT EXISTS settings_revisions_no_update BEFORE UPDATE ON settings_revisions
+BEGIN
+	SELECT RAISE(IGNORE);
+END;
+CREATE TRIGGER IF NOT EXISTS settings_revisions_no_delete BEFORE DELETE ON settings_revisions
+BEGIN
+	SELECT RAISE(IGNORE);
+END;
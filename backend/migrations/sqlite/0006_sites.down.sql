@@ -0,0 +1,91 @@
+-- Back to a single site: only the default site's settings, ads and emails survive.
+-- The foreign keys are off while migrating, so the other sites' rows go explicitly.
+DELETE FROM admin_sites;
+DELETE FROM page_settings WHERE site_id <> 1;
+DELETE FROM scheduled_ads WHERE site_id <> 1;
+DELETE FROM collected_emails WHERE site_id <> 1;
+DELETE FROM settings_draft WHERE site_id <> 1;
+DELETE FROM sites WHERE id <> 1;
+DROP TRIGGER IF EXISTS settings_revisions_no_delete;
+DELETE FROM settings_revisions WHERE site_id <> 1;
+
+CREATE TABLE settings_draft_new (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	settings TEXT NOT NULL,
+	preview_token TEXT NOT NULL,
+	publish_at TIMESTAMP,
+	updated_by TEXT,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO settings_draft_new (id, settings, preview_token, publish_at, updated_by, updated_at)
+	SELECT 1, settings, preview_token, publish_at, updated_by, updated_at FROM settings_draft;
+DROP TABLE settings_draft;
+ALTER TABLE settings_draft_new RENAME TO settings_draft;
+
+CREATE TABLE collected_emails_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT UNIQUE NOT NULL,
+	source TEXT, -- 'manual', 'google', 'facebook'
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO collected_emails_new (id, email, source, created_at)
+	SELECT id, email, source, created_at FROM collected_emails;
+DROP TABLE collected_emails;
+ALTER TABLE collected_emails_new RENAME TO collected_emails;
+
+CREATE TABLE page_settings_new (
+	key TEXT PRIMARY KEY,
+	value TEXT,
+	setting_key TEXT,
+	setting_value TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO page_settings_new (key, value, setting_key, setting_value, created_at, updated_at)
+	SELECT key, value, setting_key, setting_value, created_at, updated_at FROM page_settings;
+DROP TABLE page_settings;
+ALTER TABLE page_settings_new RENAME TO page_settings;
+
+CREATE TABLE scheduled_ads_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT,
+	description TEXT,
+	image TEXT,
+	link TEXT,
+	start_date TEXT,
+	end_date TEXT,
+	start_time TEXT,
+	end_time TEXT,
+	is_active BOOLEAN DEFAULT TRUE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	campaign_id INTEGER REFERENCES ad_campaigns(id) ON DELETE SET NULL
+);
+INSERT INTO scheduled_ads_new (id, title, description, image, link, start_date, end_date, start_time, end_time, is_active, created_at, campaign_id)
+	SELECT id, title, description, image, link, start_date, end_date, start_time, end_time, is_active, created_at, campaign_id FROM scheduled_ads;
+DROP TABLE scheduled_ads;
+ALTER TABLE scheduled_ads_new RENAME TO scheduled_ads;
+
+-- Dropping settings_revisions drops its triggers, so they are created again
+CREATE TABLE settings_revisions_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	settings TEXT NOT NULL,
+	author TEXT,
+	reason TEXT,
+	restored_from INTEGER,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO settings_revisions_new (id, settings, author, reason, restored_from, created_at)
+	SELECT id, settings, author, reason, restored_from, created_at FROM settings_revisions;
+DROP TABLE settings_revisions;
+ALTER TABLE settings_revisions_new RENAME TO settings_revisions;
+CREATE TRIGGER settings_revisions_no_update BEFORE UPDATE ON settings_revisions
+BEGIN
+	SELECT RAISE(IGNORE);
+END;
+CREATE TRIGGER settings_revisions_no_delete BEFORE DELETE ON settings_revisions
+BEGIN
+	SELECT RAISE(IGNORE);
+END;
+
+DROP TABLE IF EXISTS admin_sites;
+DROP TABLE IF EXISTS sites;
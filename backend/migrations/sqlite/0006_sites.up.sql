@@ -0,0 +1,76 @@
+-- Sites: every venue gets its own settings, ads and collected emails.
+-- Rows from before multi-site belong to the default site (id 1).
+-- hostnames and gateways are JSON arrays of strings.
+CREATE TABLE IF NOT EXISTS sites (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	slug TEXT UNIQUE NOT NULL,
+	name TEXT NOT NULL,
+	hostnames TEXT DEFAULT '[]',
+	gateways TEXT DEFAULT '[]',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO sites (id, slug, name) VALUES (1, 'default', 'Nuanu') ON CONFLICT (id) DO NOTHING;
+
+-- Admins listed here may only manage these sites; admins without rows manage all
+CREATE TABLE IF NOT EXISTS admin_sites (
+	username TEXT NOT NULL,
+	site_id INTEGER NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+	PRIMARY KEY (username, site_id)
+);
+
+ALTER TABLE scheduled_ads ADD COLUMN site_id INTEGER NOT NULL DEFAULT 1 REFERENCES sites(id) ON DELETE CASCADE;
+ALTER TABLE settings_revisions ADD COLUMN site_id INTEGER NOT NULL DEFAULT 1 REFERENCES sites(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS scheduled_ads_site_idx ON scheduled_ads (site_id);
+CREATE INDEX IF NOT EXISTS settings_revisions_site_idx ON settings_revisions (site_id, id);
+
+-- Keys are unique per site now: page_settings (site_id, key), collected_emails (site_id, email),
+-- and settings_draft holds one draft per site. SQLite cannot change a key in place,
+-- so these tables are rebuilt.
+CREATE TABLE page_settings_new (
+	site_id INTEGER NOT NULL DEFAULT 1 REFERENCES sites(id) ON DELETE CASCADE,
+	key TEXT NOT NULL,
+	value TEXT,
+	setting_key TEXT,
+	setting_value TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (site_id, key)
+);
+INSERT INTO page_settings_new (key, value, setting_key, setting_value, created_at, updated_at)
+	SELECT key, value, setting_key, setting_value, created_at, updated_at FROM page_settings;
+DROP TABLE page_settings;
+ALTER TABLE page_settings_new RENAME TO page_settings;
+
+CREATE TABLE collected_emails_new (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	site_id INTEGER NOT NULL DEFAULT 1 REFERENCES sites(id) ON DELETE CASCADE,
+	email TEXT NOT NULL,
+	source TEXT, -- 'manual', 'google', 'facebook'
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (site_id, email)
+);
+INSERT INTO collected_emails_new (id, email, source, created_at)
+	SELECT id, email, source, created_at FROM collected_emails;
+DROP TABLE collected_emails;
+ALTER TABLE collected_emails_new RENAME TO collected_emails;
+
+CREATE TABLE settings_draft_new (
+	site_id INTEGER PRIMARY KEY REFERENCES sites(id) ON DELETE CASCADE,
+	settings TEXT NOT NULL,
+	preview_token TEXT NOT NULL,
+	publish_at TIMESTAMP,
+	updated_by TEXT,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO settings_draft_new (site_id, settings, preview_token, publish_at, updated_by, updated_at)
+	SELECT 1, settings, preview_token, publish_at, updated_by, updated_at FROM settings_draft;
+DROP TABLE settings_draft;
+ALTER TABLE settings_draft_new RENAME TO settings_draft;
+
+-- Revisions are still never deleted on their own, but go with their site
+DROP TRIGGER IF EXISTS settings_revisions_no_delete;
+CREATE TRIGGER settings_revisions_no_delete BEFORE DELETE ON settings_revisions
+	WHEN EXISTS (SELECT 1 FROM sites WHERE id = OLD.site_id)
+BEGIN
+	SELECT RAISE(IGNORE);
+END;
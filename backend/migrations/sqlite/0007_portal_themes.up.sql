@@ -0,0 +1,7 @@
+-- Uploaded portal theme packages (zip), rendered by /portal
+CREATE TABLE IF NOT EXISTS portal_themes (
+	name TEXT PRIMARY KEY,
+	archive BLOB NOT NULL,
+	uploaded_by TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,3 @@
+ALTER TABLE page_settings ADD COLUMN setting_key TEXT;
+ALTER TABLE page_settings ADD COLUMN setting_value TEXT;
+UPDATE page_settings SET setting_key = key, setting_value = value;
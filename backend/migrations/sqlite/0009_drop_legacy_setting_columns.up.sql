@@ -0,0 +1,3 @@
+-- setting_key/setting_value were kept in sync with key/value but never read
+ALTER TABLE page_settings DROP COLUMN setting_key;
+ALTER TABLE page_settings DROP COLUMN setting_value;
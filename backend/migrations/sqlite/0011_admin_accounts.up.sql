@@ -0,0 +1,8 @@
+-- Admin accounts besides the ADMIN_USERNAME one from the environment; the
+-- password is a bcrypt hash. Which sites they manage is still admin_sites.
+CREATE TABLE IF NOT EXISTS admin_accounts (
+	username TEXT PRIMARY KEY,
+	password_hash TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,15 @@
+-- Impressions are counted per campaign too: an ad moved to another campaign
+-- mid-day credits each campaign with what was served under it. Being part of
+-- the key, campaign_id is 0 rather than NULL for ads without a campaign.
+-- SQLite cannot change a key in place, so the table is rebuilt.
+CREATE TABLE ad_impressions_new (
+	ad_id INTEGER NOT NULL,
+	campaign_id INTEGER NOT NULL DEFAULT 0,
+	day DATE NOT NULL,
+	impressions INTEGER DEFAULT 0,
+	PRIMARY KEY (ad_id, campaign_id, day)
+);
+INSERT INTO ad_impressions_new (ad_id, campaign_id, day, impressions)
+	SELECT ad_id, COALESCE(campaign_id, 0), day, impressions FROM ad_impressions;
+DROP TABLE ad_impressions;
+ALTER TABLE ad_impressions_new RENAME TO ad_impressions;
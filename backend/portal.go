@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// PortalPage is the data a theme's portal.html is rendered with
+type PortalPage struct {
+	Site        Site
+	Locale      string       // negotiated guest locale, e.g. "id"
+	Settings    Settings     // translated into Locale; secrets are blanked before rendering
+	Theme       string       // name of the theme being rendered
+	Assets      string       // base URL of the theme's files; static/ assets live below it
+	Background  string       // background image URL, empty when none is set
+	Ad          *ScheduledAd // active ad, nil when there is none
+	ViewToken   string       // ad view token for the login links and email form
+	ViewSeconds int          // seconds the guest must watch the ad before connecting
+	GoogleURL   string       // Google login link, empty when disabled
+	FacebookURL string       // Facebook login link, empty when disabled
+	EmailAction string       // email form target
+	Preview     bool
+
+	day string // portal-local day the ad was picked for, for impression counting
+}
+
+// T returns one of the built-in portal texts in the page's locale, English when untranslated
+func (p PortalPage) T(key string) string {
+	if s, ok := portalStrings[p.Locale][key]; ok {
+		return s
+	}
+	return portalStrings["en"][key]
+}
+
+// portalFuncs are available to every theme template
+var portalFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// samplePortalPage exercises every field so uploads can be test-rendered
+func samplePortalPage(theme string) PortalPage {
+	return PortalPage{
+		Site:        Site{ID: defaultSiteID, Slug: "default", Name: "Sample site"},
+		Locale:      "en",
+		Settings:    portalSettings(map[string]string{}),
+		Theme:       theme,
+		Assets:      themeAssetBase(theme),
+		Background:  "/img/nuanu.png",
+		Ad:          &ScheduledAd{ID: 1, Title: "Sample ad", Description: "Description", Image: "/img/nuanu.png", Link: "https://example.org/"},
+		ViewToken:   "token",
+		ViewSeconds: 10,
+		GoogleURL:   "/auth/google/login",
+		FacebookURL: "/auth/facebook/login",
+		EmailAction: "/auth/email/login",
+		Preview:     true,
+	}
+}
+
+func themeAssetBase(theme string) string {
+	return "/portal/themes/" + url.PathEscape(theme) + "/"
+}
+
+// portalServesRoot reports whether the rendered portal also answers on "/",
+// for walled-garden setups where the backend is the only portal origin
+func portalServesRoot() bool {
+	return CleanEnv(os.Getenv("PORTAL_SERVE_ROOT")) == "true"
+}
+
+// buildPortalPage gathers everything a theme renders for a guest of the site,
+// in the guest's language. The MikroTik parameters of the request are carried
+// into every login link.
+func (s *Server) buildPortalPage(r *http.Request, site Site, stored map[string]string, theme string) (PortalPage, error) {
+	locale, chain := guestLocale(r, stored)
+	settings := portalSettings(localizeSettings(stored, chain))
+	page := PortalPage{
+		Site:       site,
+		Locale:     locale,
+		Settings:   settings,
+		Theme:      theme,
+		Assets:     themeAssetBase(theme),
+		Background: unwrapCSSURL(settings.BackgroundImage),
+	}
+	page.Settings.GoogleClientSecret = ""
+	page.Settings.FacebookAppSecret = ""
+
+	ad, day, err := s.findActiveAd(site.ID)
+	if err != nil {
+		return page, err
+	}
+	s.localizeAd(ad, chain)
+	page.Ad = ad
+	page.day = day
+
+	params := r.URL.Query()
+	params.Del("theme")
+	params.Del("draft")
+	if params.Get("site") == "" {
+		params.Set("site", site.Slug)
+	}
+	if token, wait, ok := adViewGate(r, settings, ad); ok {
+		page.ViewToken = token
+		page.ViewSeconds = wait
+		params.Set("view_token", token)
+	}
+	query := params.Encode()
+
+	if settings.GoogleLoginEnabled && settings.GoogleClientID != "" {
+		page.GoogleURL = "/auth/google/login?" + query
+	}
+	if settings.FacebookLoginEnabled && settings.FacebookAppID != "" {
+		page.FacebookURL = "/auth/facebook/login?" + query
+	}
+	params.Del("view_token") // the form posts it as a field
+	page.EmailAction = "/auth/email/login?" + params.Encode()
+	return page, nil
+}
+
+// renderPortal executes the page with its theme, falling back to the built-in
+// theme when the configured one is missing or fails to render
+func (s *Server) renderPortal(w http.ResponseWriter, page PortalPage) {
+	t, err := s.themeCache.Load(page.Theme)
+	if err != nil || t == nil {
+		slog.Warn("Portal theme unavailable, using the default", "theme", page.Theme, "default", defaultThemeName, "error", err)
+		t = defaultTheme()
+	}
+
+	var buf bytes.Buffer
+	if err := t.tmpl.ExecuteTemplate(&buf, themeEntryTemplate, page); err != nil {
+		slog.Warn("Portal theme failed to render, using the default", "theme", t.Name, "default", defaultThemeName, "error", err)
+		buf.Reset()
+		page.Theme = defaultThemeName
+		page.Assets = themeAssetBase(defaultThemeName)
+		if err := defaultTheme().tmpl.ExecuteTemplate(&buf, themeEntryTemplate, page); err != nil {
+			slog.Error("Portal render failed", "error", err)
+			http.Error(w, "Portal unavailable", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	setLocaleHeaders(w, page.Locale)
+	buf.WriteTo(w)
+}
+
+// ServePortal renders the guest portal of the resolved site with its theme, so
+// the hotspot can point at the backend alone instead of the Next.js frontend
+func (s *Server) ServePortal(w http.ResponseWriter, r *http.Request) {
+	site := s.guestSite(r)
+	stored, ok := s.liveSettings(w, site.ID)
+	if !ok {
+		return
+	}
+
+	page, err := s.buildPortalPage(r, site, stored, settingsValues(stored)["portal_theme"])
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load the portal", "error", err)
+		http.Error(w, "Portal unavailable", http.StatusInternalServerError)
+		return
+	}
+	if page.Ad != nil {
+		s.recordImpression(*page.Ad, page.day)
+	}
+	s.renderPortal(w, page)
+}
+
+// PreviewPortalTheme renders a theme with the admin's site settings, merged
+// with the site's settings draft when ?draft=true. No impression is recorded.
+func (s *Server) PreviewPortalTheme(w http.ResponseWriter, r *http.Request) {
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	t, err := s.themeCache.Load(name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to preview portal theme", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load theme", nil)
+		return
+	}
+	if t == nil {
+		writeJSONError(w, http.StatusNotFound, "Theme not found", nil)
+		return
+	}
+
+	stored, ok := s.liveSettings(w, site.ID)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("draft") == "true" {
+		d, err := s.Settings.SettingsDraft(site.ID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to preview portal theme", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load settings draft", nil)
+			return
+		}
+		if d != nil {
+			for key, value := range d.Settings {
+				stored[key] = value
+			}
+		}
+	}
+
+	page, err := s.buildPortalPage(r, site, stored, name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to preview portal theme", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to render preview", nil)
+		return
+	}
+	page.Preview = true
+	s.renderPortal(w, page)
+}
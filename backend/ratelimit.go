@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket: Burst requests at once, then Rate more per second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// parseRateLimit reads "10/m" style limits: that many requests per second
+// (s), minute (m) or hour (h), all of them allowed at once
+func parseRateLimit(raw string) (RateLimit, error) {
+	n, unit, ok := strings.Cut(raw, "/")
+	count, err := strconv.Atoi(n)
+	if !ok || err != nil || count <= 0 {
+		return RateLimit{}, fmt.Errorf("want a limit like 10/m, got %q", raw)
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if per == 0 {
+		return RateLimit{}, fmt.Errorf("unit of %q must be s, m or h", raw)
+	}
+	return RateLimit{Rate: float64(count) / per.Seconds(), Burst: count}, nil
+}
+
+// Lockout is the exponential lockout after repeated failed admin logins:
+// Threshold failures lock for Base, each further one doubles it up to Max.
+// Failures are forgotten after lockoutWindow without any.
+type Lockout struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+}
+
+const lockoutWindow = 24 * time.Hour
+
+// duration is how long failures consecutive failures lock for
+func (l Lockout) duration(failures int) time.Duration {
+	if l.Threshold <= 0 || failures < l.Threshold {
+		return 0
+	}
+	d := l.Base << uint(min(failures-l.Threshold, 30))
+	if d > l.Max || d <= 0 {
+		d = l.Max
+	}
+	return d
+}
+
+// LimiterStore keeps token buckets and login failures. The memory store is
+// per process; the SQL one lets several instances share their counts.
+type LimiterStore interface {
+	// Take removes a token from the bucket of key, returning 0 when there was
+	// one and otherwise how long until the next one
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error)
+	// LockedUntil is when the lockout of key ends (zero when not locked)
+	LockedUntil(ctx context.Context, key string) (time.Time, error)
+	// RecordFailure counts a failed login for key and returns the number of
+	// failures in a row
+	RecordFailure(ctx context.Context, key string, now time.Time) (int, error)
+	// Lock locks key out until the given time
+	Lock(ctx context.Context, key string, until time.Time) error
+	// ClearFailures forgets the failures of key after a successful login
+	ClearFailures(ctx context.Context, key string) error
+	// Sweep removes buckets and failures untouched since before
+	Sweep(ctx context.Context, before time.Time) error
+}
+
+// The limited actions
+const (
+	limitAdminLogin = "admin_login"
+	limitOAuthStart = "oauth_start"
+	limitGuestEmail = "guest_email"
+	limitUpload     = "upload"
+)
+
+// The keys a request is limited by
+const (
+	limitByIP      = "ip"
+	limitByMAC     = "mac"
+	limitByAccount = "account"
+)
+
+// defaultRateLimits are the limits per action and key; each can be changed
+// with RATE_LIMIT_<ACTION>_<KEY>, e.g. RATE_LIMIT_GUEST_EMAIL_MAC=5/m
+var defaultRateLimits = map[string]map[string]string{
+	limitAdminLogin: {limitByIP: "10/m", limitByAccount: "20/m"},
+	limitOAuthStart: {limitByIP: "60/m", limitByMAC: "10/m"},
+	limitGuestEmail: {limitByIP: "20/m", limitByMAC: "5/m", limitByAccount: "3/m"},
+	limitUpload:     {limitByIP: "30/m", limitByAccount: "300/h"},
+}
+
+// Limiter applies the rate limits and the admin lockout, configured from the
+// environment:
+//
+//	RATE_LIMITS                off disables rate limiting and the lockout
+//	RATE_LIMIT_<ACTION>_<KEY>  override of a default limit (see defaultRateLimits)
+//	RATE_LIMIT_STORE           memory or database (the default with Postgres)
+//	ADMIN_LOCKOUT_THRESHOLD    failed admin logins before a lockout (5)
+//	ADMIN_LOCKOUT_BASE         first lockout, doubled with each further failure (1m)
+//	ADMIN_LOCKOUT_MAX          longest lockout (1h)
+type Limiter struct {
+	store    LimiterStore
+	disabled bool
+	limits   map[string]map[string]RateLimit
+	lockout  Lockout
+}
+
+func NewLimiter(store LimiterStore) *Limiter {
+	l := &Limiter{
+		store:    store,
+		disabled: strings.EqualFold(CleanEnv(os.Getenv("RATE_LIMITS")), "off"),
+		limits:   map[string]map[string]RateLimit{},
+		lockout: Lockout{
+			Threshold: envInt("ADMIN_LOCKOUT_THRESHOLD", 5),
+			Base:      envDuration("ADMIN_LOCKOUT_BASE", time.Minute),
+			Max:       envDuration("ADMIN_LOCKOUT_MAX", time.Hour),
+		},
+	}
+	for action, keys := range defaultRateLimits {
+		l.limits[action] = map[string]RateLimit{}
+		for key, def := range keys {
+			name := strings.ToUpper("RATE_LIMIT_" + action + "_" + key)
+			raw := CleanEnv(os.Getenv(name))
+			limit, err := parseRateLimit(raw)
+			if err != nil {
+				if raw != "" {
+					slog.Warn("Ignoring invalid rate limit", "name", name, "error", err)
+				}
+				limit, _ = parseRateLimit(def)
+			}
+			l.limits[action][key] = limit
+		}
+	}
+	return l
+}
+
+// limiterStoreFor picks the limiter store: the database when several
+// instances may share it (Postgres), memory on a single box (SQLite)
+func limiterStoreFor(db *Database) LimiterStore {
+	switch strings.ToLower(CleanEnv(os.Getenv("RATE_LIMIT_STORE"))) {
+	case "memory":
+		return NewMemoryLimiterStore()
+	case "database":
+		return NewSQLLimiterStore(db.DB)
+	}
+	if db.Dialect == dialectPostgres {
+		return NewSQLLimiterStore(db.DB)
+	}
+	return NewMemoryLimiterStore()
+}
+
+// allow takes a token for each key of the request (empty ones are skipped).
+// When one is exhausted it answers 429 with Retry-After itself and returns
+// false. A failing store lets the request through: the limits protect the
+// portal, they should not take it down with the database.
+func (s *Server) allow(w http.ResponseWriter, r *http.Request, action string, keys map[string]string) bool {
+	l := s.limiter
+	if l.disabled {
+		return true
+	}
+	now := time.Now()
+	for _, by := range []string{limitByIP, limitByMAC, limitByAccount} {
+		value := keys[by]
+		limit, ok := l.limits[action][by]
+		if value == "" || !ok {
+			continue
+		}
+		wait, err := l.store.Take(r.Context(), action+":"+by+":"+value, limit, now)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Rate limit check failed, allowing", "action", action, "error", err)
+			continue
+		}
+		if wait > 0 {
+			s.metrics.rateLimited.WithLabelValues(action, by).Inc()
+			slog.WarnContext(r.Context(), "Rate limited", "action", action, "by", by, "retry_after", wait.String())
+			tooManyRequests(w, r, wait, "Too many attempts, please try again later.")
+			return false
+		}
+	}
+	return true
+}
+
+// guestLimitKeys limits a guest by address, by the device MAC the hotspot
+// passed along, and by the email they submit (if any)
+func guestLimitKeys(r *http.Request, params url.Values, email string) map[string]string {
+	return map[string]string{
+		limitByIP:      clientIP(r),
+		limitByMAC:     strings.ToUpper(params.Get("mac")),
+		limitByAccount: strings.ToLower(strings.TrimSpace(email)),
+	}
+}
+
+// uploadLimitKeys limits an upload by address and by the admin whose session
+// it carries; admin is the authenticated one, never a name the client sent
+func uploadLimitKeys(r *http.Request, admin string) map[string]string {
+	return map[string]string{
+		limitByIP:      clientIP(r),
+		limitByAccount: admin,
+	}
+}
+
+// adminLockKey locks out an account from one address only, so nobody can
+// lock the real admin out by guessing from elsewhere; guessing from many
+// addresses is what the per-account rate limit is for
+func adminLockKey(r *http.Request, username string) string {
+	return limitAdminLogin + ":" + strings.ToLower(username) + "|" + clientIP(r)
+}
+
+// adminLockedOut answers 429 when the account is locked out for this client
+func (s *Server) adminLockedOut(w http.ResponseWriter, r *http.Request, username string) bool {
+	l := s.limiter
+	if l.disabled {
+		return false
+	}
+	until, err := l.store.LockedUntil(r.Context(), adminLockKey(r, username))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Lockout check failed, allowing", "error", err)
+		return false
+	}
+	if wait := time.Until(until); wait > 0 {
+		s.metrics.rateLimited.WithLabelValues(limitAdminLogin, "lockout").Inc()
+		tooManyRequests(w, r, wait, "Too many failed logins, please try again later.")
+		return true
+	}
+	return false
+}
+
+// adminLoginFailed counts a failed admin login and starts or extends the lockout
+func (s *Server) adminLoginFailed(r *http.Request, username string) {
+	l := s.limiter
+	if l.disabled {
+		return
+	}
+	key := adminLockKey(r, username)
+	now := time.Now()
+	failures, err := l.store.RecordFailure(r.Context(), key, now)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record admin login failure", "error", err)
+		return
+	}
+	if d := l.lockout.duration(failures); d > 0 {
+		if err := l.store.Lock(r.Context(), key, now.Add(d)); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to lock out admin login", "error", err)
+			return
+		}
+		slog.WarnContext(r.Context(), "Admin login locked out", "failures", failures, "duration", d.String(), "remote", clientIP(r))
+	}
+}
+
+// adminLoginSucceeded forgets the failures before a successful login
+func (s *Server) adminLoginSucceeded(r *http.Request, username string) {
+	if s.limiter.disabled {
+		return
+	}
+	if err := s.limiter.store.ClearFailures(r.Context(), adminLockKey(r, username)); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to clear admin login failures", "error", err)
+	}
+}
+
+// tooManyRequests is the 429 answer, JSON for the API and text for the guest
+// login pages
+func tooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeJSONError(w, http.StatusTooManyRequests, msg, nil)
+		return
+	}
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// startLimiterSweeper drops idle buckets and old failures every hour
+func (s *Server) startLimiterSweeper() {
+	go func() {
+		for range time.Tick(time.Hour) {
+			if err := s.limiter.store.Sweep(context.Background(), time.Now().Add(-lockoutWindow)); err != nil {
+				slog.Warn("Rate limit sweep failed", "error", err)
+			}
+		}
+	}()
+}
+
+// MemoryLimiterStore keeps the buckets and failures of one process
+type MemoryLimiterStore struct {
+	mu       sync.Mutex
+	buckets  map[string]*memoryBucket
+	failures map[string]*memoryFailures
+}
+
+type memoryBucket struct {
+	tokens     float64
+	refilledAt time.Time
+}
+
+type memoryFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewMemoryLimiterStore() *MemoryLimiterStore {
+	return &MemoryLimiterStore{buckets: map[string]*memoryBucket{}, failures: map[string]*memoryFailures{}}
+}
+
+func (m *MemoryLimiterStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(limit.Burst), refilledAt: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.refilledAt).Seconds()*limit.Rate)
+	b.refilledAt = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+	return waitForToken(b.tokens, limit), nil
+}
+
+func (m *MemoryLimiterStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.failures[key]; ok {
+		return f.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+func (m *MemoryLimiterStore) RecordFailure(ctx context.Context, key string, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.failures[key]
+	if !ok || f.lastFailure.Before(now.Add(-lockoutWindow)) {
+		f = &memoryFailures{}
+		m.failures[key] = f
+	}
+	f.count++
+	f.lastFailure = now
+	return f.count, nil
+}
+
+func (m *MemoryLimiterStore) Lock(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.failures[key]; ok {
+		f.lockedUntil = until
+	}
+	return nil
+}
+
+func (m *MemoryLimiterStore) ClearFailures(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, key)
+	return nil
+}
+
+func (m *MemoryLimiterStore) Sweep(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, b := range m.buckets {
+		if b.refilledAt.Before(before) {
+			delete(m.buckets, key)
+		}
+	}
+	for key, f := range m.failures {
+		if f.lastFailure.Before(before) && f.lockedUntil.Before(before) {
+			delete(m.failures, key)
+		}
+	}
+	return nil
+}
+
+// waitForToken is how long a bucket with tokens left takes to get a whole one
+func waitForToken(tokens float64, limit RateLimit) time.Duration {
+	return time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+}
+
+var _ LimiterStore = (*MemoryLimiterStore)(nil)
+
+// SQLLimiterStore keeps the buckets and failures in the database so that all
+// instances behind a load balancer share them. Each Take is a single upsert,
+// which is atomic on both Postgres and SQLite.
+type SQLLimiterStore struct {
+	db *sql.DB
+}
+
+func NewSQLLimiterStore(db *sql.DB) *SQLLimiterStore {
+	return &SQLLimiterStore{db: db}
+}
+
+// takeSQL refills the bucket for the time since its last use ($4 is now in
+// unix seconds, $3 the rate, $2 the burst) and takes a token if there is a
+// whole one. granted tells the two apart, SET sees the row as it was.
+var takeSQL = strings.NewReplacer(
+	"ELAPSED", "(CASE WHEN $4 > rate_limit_buckets.refilled_at THEN $4 - rate_limit_buckets.refilled_at ELSE 0 END)",
+).Replace(strings.NewReplacer(
+	"REFILLED", "(CASE WHEN rate_limit_buckets.tokens + ELAPSED * $3 > $2 THEN $2 ELSE rate_limit_buckets.tokens + ELAPSED * $3 END)",
+).Replace(`
+	INSERT INTO rate_limit_buckets (key, tokens, refilled_at, granted)
+	VALUES ($1, CAST($2 AS DOUBLE PRECISION) - 1, CAST($4 AS DOUBLE PRECISION), 1)
+	ON CONFLICT (key) DO UPDATE SET
+		tokens = CASE WHEN REFILLED >= 1 THEN REFILLED - 1 ELSE REFILLED END,
+		granted = CASE WHEN REFILLED >= 1 THEN 1 ELSE 0 END,
+		refilled_at = CASE WHEN $4 > rate_limit_buckets.refilled_at THEN $4 ELSE rate_limit_buckets.refilled_at END
+	RETURNING tokens, granted`))
+
+func (s *SQLLimiterStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	var tokens float64
+	var granted int
+	err := s.db.QueryRowContext(ctx, takeSQL, key, float64(limit.Burst), limit.Rate, unixSeconds(now)).Scan(&tokens, &granted)
+	if err != nil {
+		return 0, err
+	}
+	if granted == 1 {
+		return 0, nil
+	}
+	return waitForToken(tokens, limit), nil
+}
+
+func (s *SQLLimiterStore) LockedUntil(ctx context.Context, key string) (time.Time, error) {
+	var until sql.NullTime
+	err := s.db.QueryRowContext(ctx, "SELECT locked_until FROM login_failures WHERE key = $1", key).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return until.Time, err
+}
+
+func (s *SQLLimiterStore) RecordFailure(ctx context.Context, key string, now time.Time) (int, error) {
+	now = now.UTC()
+	var failures int
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO login_failures (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure_at < $3 THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure_at = $2
+		RETURNING failures`, key, now, now.Add(-lockoutWindow)).Scan(&failures)
+	return failures, err
+}
+
+func (s *SQLLimiterStore) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE login_failures SET locked_until = $2 WHERE key = $1", key, until.UTC())
+	return err
+}
+
+func (s *SQLLimiterStore) ClearFailures(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_failures WHERE key = $1", key)
+	return err
+}
+
+func (s *SQLLimiterStore) Sweep(ctx context.Context, before time.Time) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM rate_limit_buckets WHERE refilled_at < $1", unixSeconds(before)); err != nil {
+		return err
+	}
+	before = before.UTC()
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM login_failures WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $1)", before)
+	return err
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+var _ LimiterStore = (*SQLLimiterStore)(nil)
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLimiterStores are the limiter stores every limiter test runs against
+var testLimiterStores = []struct {
+	name string
+	open func(t *testing.T) LimiterStore
+}{
+	{"memory", func(t *testing.T) LimiterStore { return NewMemoryLimiterStore() }},
+	{"sql", func(t *testing.T) LimiterStore {
+		db, err := openDatabase("sqlite:" + t.TempDir() + "/portal.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		if _, err := migrateUp(db, 0); err != nil {
+			t.Fatal(err)
+		}
+		return NewSQLLimiterStore(db.DB)
+	}},
+}
+
+func TestLimiterStores(t *testing.T) {
+	ctx := context.Background()
+	limit := RateLimit{Rate: 1, Burst: 2}
+	for _, st := range testLimiterStores {
+		t.Run(st.name, func(t *testing.T) {
+			store := st.open(t)
+			now := time.Unix(1_700_000_000, 0)
+
+			take := func(key string, at time.Time) time.Duration {
+				t.Helper()
+				wait, err := store.Take(ctx, key, limit, at)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return wait
+			}
+			if take("a", now) != 0 || take("a", now) != 0 {
+				t.Fatal("burst not allowed")
+			}
+			if wait := take("a", now.Add(250*time.Millisecond)); wait < 700*time.Millisecond || wait > 800*time.Millisecond {
+				t.Errorf("empty bucket: wait %v, want 750ms", wait)
+			}
+			if take("b", now) != 0 {
+				t.Error("buckets are not separate")
+			}
+			if wait := take("a", now.Add(time.Second)); wait != 0 {
+				t.Errorf("refilled bucket: wait %v", wait)
+			}
+			// The refill stops at the burst
+			later := now.Add(time.Hour)
+			take("a", later)
+			take("a", later)
+			if take("a", later) == 0 {
+				t.Error("bucket refilled beyond its burst")
+			}
+
+			for i := 1; i <= 3; i++ {
+				if n, err := store.RecordFailure(ctx, "boss", now); err != nil || n != i {
+					t.Fatalf("failure %d counted as %d, %v", i, n, err)
+				}
+			}
+			if n, _ := store.RecordFailure(ctx, "boss", now.Add(lockoutWindow+time.Minute)); n != 1 {
+				t.Errorf("failures after a quiet day = %d, want 1", n)
+			}
+			until := time.Now().Add(time.Minute).Truncate(time.Second)
+			if err := store.Lock(ctx, "boss", until); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := store.LockedUntil(ctx, "boss"); err != nil || !got.Equal(until) {
+				t.Errorf("locked until %v, %v; want %v", got, err, until)
+			}
+			if err := store.ClearFailures(ctx, "boss"); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := store.LockedUntil(ctx, "boss"); !got.IsZero() {
+				t.Errorf("still locked until %v after a success", got)
+			}
+
+			if err := store.Sweep(ctx, later.Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			if take("a", later.Add(time.Minute)) != 0 {
+				t.Error("swept bucket is still empty")
+			}
+		})
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	l := Lockout{Threshold: 5, Base: time.Minute, Max: time.Hour}
+	for failures, want := range map[int]time.Duration{
+		4: 0, 5: time.Minute, 6: 2 * time.Minute, 8: 8 * time.Minute, 12: time.Hour, 100: time.Hour,
+	} {
+		if got := l.duration(failures); got != want {
+			t.Errorf("%d failures lock for %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	if l, err := parseRateLimit("30/m"); err != nil || l.Burst != 30 || l.Rate != 0.5 {
+		t.Errorf("30/m = %+v, %v", l, err)
+	}
+	for _, bad := range []string{"", "30", "0/m", "x/m", "10/d"} {
+		if _, err := parseRateLimit(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+// retryAfter checks a 429 and returns its Retry-After in seconds
+func retryAfter(t *testing.T, rec *httptest.ResponseRecorder) int {
+	t.Helper()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429: %s", rec.Code, rec.Body.String())
+	}
+	secs, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || secs <= 0 {
+		t.Fatalf("Retry-After = %q", rec.Header().Get("Retry-After"))
+	}
+	return secs
+}
+
+func TestAdminLoginLockout(t *testing.T) {
+	t.Setenv("ADMIN_USERNAME", "boss")
+	t.Setenv("ADMIN_PASSWORD", "secret")
+	t.Setenv("ADMIN_LOCKOUT_THRESHOLD", "3")
+	withStores(t, func(t *testing.T, ts *testServer) {
+		login := func(password string) *httptest.ResponseRecorder {
+			return ts.do("POST", "/api/auth/login", map[string]string{"username": "boss", "password": password})
+		}
+		for i := 0; i < 3; i++ {
+			ts.expect(login("guess"), http.StatusOK, nil)
+		}
+		// Locked out, even with the right password
+		if secs := retryAfter(t, login("secret")); secs > 60 {
+			t.Errorf("first lockout is %ds, want a minute", secs)
+		}
+
+		// Another account is not locked
+		ts.expect(ts.do("POST", "/api/auth/login", map[string]string{"username": "other", "password": "x"}), http.StatusOK, nil)
+	})
+}
+
+func TestUploadRateLimitByAdmin(t *testing.T) {
+	t.Setenv("RATE_LIMIT_UPLOAD_ACCOUNT", "2/h")
+	withStores(t, func(t *testing.T, ts *testServer) {
+		upload := func(header ...string) *httptest.ResponseRecorder {
+			return ts.multipart("/api/upload", nil, "bg.png", testPNG(t, color.White), header...)
+		}
+		ts.expect(upload(), http.StatusOK, nil)
+		ts.expect(upload(), http.StatusOK, nil)
+		// The account is the one of the session, whatever name the client sends
+		retryAfter(t, upload("X-Admin-User", "someone-else"))
+		ts.expect(upload("Authorization", ""), http.StatusUnauthorized, nil)
+	})
+}
+
+func TestGuestEmailRateLimit(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		post := func(email, mac string) *httptest.ResponseRecorder {
+			return ts.do("POST", "/auth/email/login?mac="+mac, strings.NewReader("email="+email), "Content-Type", "application/x-www-form-urlencoded")
+		}
+		// Three submissions of one address a minute...
+		for i := 0; i < 3; i++ {
+			ts.expect(post("maria.santos%40gmail.com", "AA:BB:CC:DD:EE:0"+strconv.Itoa(i)), http.StatusTemporaryRedirect, nil)
+		}
+		retryAfter(t, post("maria.santos%40gmail.com", "AA:BB:CC:DD:EE:09"))
+
+		// ...and five from one device
+		for i := 0; i < 5; i++ {
+			ts.expect(post("guest"+strconv.Itoa(i)+"%40gmail.com", "AA:BB:CC:DD:EE:FF"), http.StatusTemporaryRedirect, nil)
+		}
+		retryAfter(t, post("guest9%40gmail.com", "AA:BB:CC:DD:EE:FF"))
+
+		// The tracking endpoint shares the limits and answers in JSON
+		rec := ts.do("POST", "/api/settings", map[string]interface{}{"email": "maria.santos@gmail.com", "tracking": true})
+		retryAfter(t, rec)
+		if !strings.Contains(rec.Header().Get("Content-Type"), "json") {
+			t.Errorf("tracking 429 content type = %q", rec.Header().Get("Content-Type"))
+		}
+	})
+}
+
+func TestClientIPProxyHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.7:4711"
+	r.Header.Set("X-Real-IP", "10.0.0.1")
+	if ip := clientIP(r); ip != "203.0.113.7" {
+		t.Errorf("header from a remote peer believed: %s", ip)
+	}
+
+	r.RemoteAddr = "127.0.0.1:4711"
+	if ip := clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("X-Real-IP from the local proxy = %s", ip)
+	}
+	r.Header.Del("X-Real-IP")
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 198.51.100.9")
+	if ip := clientIP(r); ip != "198.51.100.9" {
+		t.Errorf("X-Forwarded-For from the local proxy = %s", ip)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/cors"
+)
+
+// Server holds everything the handlers need: the stores behind the admin and
+// guest endpoints, upload storage, and the caches in front of the stores
+type Server struct {
+	Settings  SettingsStore
+	Ads       AdStore
+	Campaigns CampaignStore
+	Emails    EmailStore
+	Sites     SiteStore
+	Media     MediaStore
+	Themes    ThemeStore
+	Storage   Storage
+
+	store  Store
+	client *http.Client // outbound calls to the OAuth providers
+	// schemaPending is set while the database still needs its migrations
+	schemaPending atomic.Bool
+
+	settingsCache *SettingsCache
+	metrics       *Metrics
+	limiter       *Limiter
+	siteDir       *siteDirectory
+	themeCache    *themeCache
+}
+
+// NewServer wires a server around one backend store and upload storage
+func NewServer(st Store, storage Storage) *Server {
+	s := &Server{
+		Settings:  st,
+		Ads:       st,
+		Campaigns: st,
+		Emails:    st,
+		Sites:     st,
+		Media:     st,
+		Themes:    st,
+		Storage:   storage,
+		store:     st,
+		client:    newOutboundClient(envDuration("OUTBOUND_HTTP_TIMEOUT", 10*time.Second)),
+		siteDir:   &siteDirectory{store: st},
+		metrics:   newMetrics(),
+		limiter:   NewLimiter(NewMemoryLimiterStore()),
+	}
+	s.settingsCache = NewSettingsCache(st.Settings, s.imageVariants)
+	s.metrics.watchSettingsCache(s.settingsCache)
+	s.themeCache = newThemeCache(st)
+	return s
+}
+
+// Handler is the complete HTTP API: routes, CORS, the auth interceptor, and
+// tracing, request IDs, access logs and metrics around all of them
+func (s *Server) Handler() http.Handler {
+	// Router
+	r := mux.NewRouter()
+	r.StrictSlash(true)
+	r.Use(routeFromMux)
+
+	// Auth Routes - v3.0 EXPLICIT REGISTRATION (most reliable)
+	slog.Debug("Registering explicit auth routes")
+	r.HandleFunc("/auth/google/login", s.GoogleLogin).Methods("GET")
+	r.HandleFunc("/auth/google/callback", s.GoogleCallback).Methods("GET")
+	r.HandleFunc("/auth/facebook/login", s.FacebookLogin).Methods("GET")
+	r.HandleFunc("/auth/facebook/callback", s.FacebookCallback).Methods("GET")
+	r.HandleFunc("/auth/email/login", s.EmailLogin).Methods("GET", "POST")
+	// Fallback catch-all for any other /auth paths
+	r.PathPrefix("/auth").HandlerFunc(s.AuthRouter)
+	slog.Debug("Auth routes registered")
+
+	// API Routes...
+	r.HandleFunc("/api/settings", s.GetSettings).Methods("GET")
+	r.HandleFunc("/api/settings", s.UpdateSettings).Methods("POST")
+	r.HandleFunc("/api/settings", s.PatchSettings).Methods("PATCH")
+	r.HandleFunc("/api/settings/admin", s.GetAdminSettings).Methods("GET")
+	r.HandleFunc("/api/settings/schema", GetSettingsSchema).Methods("GET")
+	r.HandleFunc("/api/settings/preview", s.PreviewSettings).Methods("GET")
+	r.HandleFunc("/api/settings/draft", s.GetSettingsDraft).Methods("GET")
+	r.HandleFunc("/api/settings/draft", s.UpdateSettingsDraft).Methods("PUT", "PATCH")
+	r.HandleFunc("/api/settings/draft", s.DiscardSettingsDraft).Methods("DELETE")
+	r.HandleFunc("/api/settings/draft/schedule", s.ScheduleSettingsDraft).Methods("POST")
+	r.HandleFunc("/api/settings/draft/publish", s.PublishSettingsDraft).Methods("POST")
+	r.HandleFunc("/api/settings/revisions", s.GetSettingsRevisions).Methods("GET")
+	r.HandleFunc("/api/settings/revisions/{id}", s.GetSettingsRevision).Methods("GET")
+	r.HandleFunc("/api/settings/revisions/{id}/restore", s.RestoreSettingsRevision).Methods("POST")
+	r.HandleFunc("/api/upload", s.UploadFile).Methods("POST")
+	r.HandleFunc("/api/media", s.GetMedia).Methods("GET")
+	r.HandleFunc("/api/media/gc", s.RunMediaGC).Methods("POST")
+	r.HandleFunc("/api/media/{id}", s.UpdateMedia).Methods("PUT", "PATCH")
+	r.HandleFunc("/api/media/{id}", s.DeleteMedia).Methods("DELETE")
+	r.HandleFunc("/api/auth/login", s.AdminLogin).Methods("POST")
+	r.HandleFunc("/api/emails", s.GetEmails).Methods("GET")
+
+	// Ads Routes...
+	r.HandleFunc("/api/ads", s.GetAds).Methods("GET")
+	r.HandleFunc("/api/ads", s.CreateAd).Methods("POST")
+	r.HandleFunc("/api/ads/{id}", s.UpdateAd).Methods("PUT")
+	r.HandleFunc("/api/ads/{id}", s.DeleteAd).Methods("DELETE")
+	r.HandleFunc("/api/active-ad", s.GetActiveAd).Methods("GET")
+	r.HandleFunc("/api/ads/{id}/translations", s.GetAdTranslations).Methods("GET")
+	r.HandleFunc("/api/ads/{id}/translations/{locale}", s.UpdateAdTranslation).Methods("PUT")
+	r.HandleFunc("/api/ads/{id}/translations/{locale}", s.DeleteAdTranslation).Methods("DELETE")
+	r.HandleFunc("/api/translations", s.GetTranslations).Methods("GET")
+	r.HandleFunc("/api/translations/settings/{locale}", s.UpdateSettingTranslations).Methods("PUT")
+
+	// Advertisers, Campaigns & Reports...
+	r.HandleFunc("/api/advertisers", s.GetAdvertisers).Methods("GET")
+	r.HandleFunc("/api/advertisers", s.CreateAdvertiser).Methods("POST")
+	r.HandleFunc("/api/advertisers/{id}", s.UpdateAdvertiser).Methods("PUT")
+	r.HandleFunc("/api/advertisers/{id}", s.DeleteAdvertiser).Methods("DELETE")
+	r.HandleFunc("/api/campaigns", s.GetCampaigns).Methods("GET")
+	r.HandleFunc("/api/campaigns", s.CreateCampaign).Methods("POST")
+	r.HandleFunc("/api/campaigns/{id}", s.UpdateCampaign).Methods("PUT")
+	r.HandleFunc("/api/campaigns/{id}", s.DeleteCampaign).Methods("DELETE")
+	r.HandleFunc("/api/reports/campaigns/{id}", s.GetCampaignReport).Methods("GET")
+
+	// Server-rendered guest portal and its themes
+	r.HandleFunc("/portal", s.ServePortal).Methods("GET")
+	r.HandleFunc("/portal/themes/{name}/static/{path:.+}", s.ServeThemeAsset).Methods("GET")
+	r.HandleFunc("/api/themes", s.GetThemes).Methods("GET")
+	r.HandleFunc("/api/themes", s.UploadTheme).Methods("POST")
+	r.HandleFunc("/api/themes/{name}", s.DeleteTheme).Methods("DELETE")
+	r.HandleFunc("/api/themes/{name}/preview", s.PreviewPortalTheme).Methods("GET")
+	if portalServesRoot() {
+		r.HandleFunc("/", s.ServePortal).Methods("GET")
+		slog.Info("Guest portal served on /")
+	}
+
+	// Sites, admin accounts and per-admin site access
+	r.HandleFunc("/api/sites", s.GetSites).Methods("GET")
+	r.HandleFunc("/api/sites", s.CreateSite).Methods("POST")
+	r.HandleFunc("/api/sites/{id}", s.UpdateSite).Methods("PUT")
+	r.HandleFunc("/api/sites/{id}", s.DeleteSite).Methods("DELETE")
+	r.HandleFunc("/api/admin-sites", s.GetAdminSites).Methods("GET")
+	r.HandleFunc("/api/admin-sites/{username}", s.SetAdminSites).Methods("PUT")
+	r.HandleFunc("/api/admins/{username}", s.SetAdminAccount).Methods("PUT")
+
+	// Liveness and readiness probes
+	r.HandleFunc("/healthz", HealthCheck).Methods("GET")
+	r.HandleFunc("/health", HealthCheck).Methods("GET")
+	r.HandleFunc("/readyz", s.ReadyCheck).Methods("GET")
+	r.Handle("/metrics", s.metrics.Handler()).Methods("GET")
+
+	// Fallback for debugging (Enhanced for v2.8)
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.InfoContext(r.Context(), "Not found", "method", r.Method, "path", r.URL.Path)
+		msg := fmt.Sprintf("404 page not found: [%s] - NUANU BACKEND v3.1", r.URL.Path)
+		http.Error(w, msg, http.StatusNotFound)
+	})
+
+	// Static files - local uploads, plus the bundled public/img assets
+	r.PathPrefix("/img/").Handler(http.StripPrefix("/img/", staticImgHandler(s.Storage)))
+
+	// CORS: Enhanced stability — includes production domain
+	c := cors.New(cors.Options{
+		AllowedOrigins: []string{
+			"http://localhost:3000",
+			"http://localhost:3001",
+			"http://127.0.0.1:3000",
+			"http://127.0.0.1:3001",
+			"https://gowifi.nuanu.io",
+			"http://gowifi.nuanu.io",
+		},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "Authorization", "X-CSRF-Token", "X-Site"},
+		AllowCredentials: true,
+		Debug:            false,
+	})
+
+	handler := c.Handler(r)
+	handler = s.AuthInterceptor(handler) // v3.1: Bypasses gorilla/mux entirely
+	handler = LoggerMiddleware(handler)
+	handler = s.metrics.instrument(handler)
+	handler = withRequestID(handler)
+	handler = traceRequests(handler)
+
+	return handler
+}
@@ -0,0 +1,1068 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer is the full HTTP API on a test store and local upload storage.
+// Requests go out logged in as an unrestricted admin unless they set their
+// own Authorization header.
+type testServer struct {
+	t       *testing.T
+	srv     *Server
+	handler http.Handler
+	token   string
+}
+
+// testStores are the backends every API test runs against
+var testStores = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return NewMemoryStore() }},
+	{"sqlite", newTestSQLiteStore},
+}
+
+// newTestSQLiteStore is a migrated SQLite database in a temporary file
+func newTestSQLiteStore(t *testing.T) Store {
+	t.Helper()
+	db, err := openDatabase("sqlite:" + t.TempDir() + "/portal.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := migrateUp(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	return NewStore(db)
+}
+
+// withStores runs a test once per backend in testStores
+func withStores(t *testing.T, test func(t *testing.T, ts *testServer)) {
+	for _, st := range testStores {
+		t.Run(st.name, func(t *testing.T) {
+			test(t, newTestServer(t, st.open(t)))
+		})
+	}
+}
+
+func newTestServer(t *testing.T, store Store) *testServer {
+	t.Helper()
+	storage, err := NewLocalStorage(t.TempDir(), "/img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(store, storage)
+	return &testServer{t: t, srv: srv, handler: srv.Handler(), token: issueAdminSession("admin", time.Now())}
+}
+
+// do sends a request; a non-nil body that is not a reader is sent as JSON
+func (ts *testServer) do(method, target string, body interface{}, header ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var reader io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+	default:
+		raw, err := json.Marshal(b)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+		contentType = "application/json"
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Authorization", "Bearer "+ts.token)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// login signs in as an admin and returns the session token
+func (ts *testServer) login(username, password string) string {
+	ts.t.Helper()
+	var resp struct {
+		Success bool   `json:"success"`
+		Token   string `json:"token"`
+	}
+	ts.expect(ts.do("POST", "/api/auth/login", map[string]string{"username": username, "password": password}), http.StatusOK, &resp)
+	if !resp.Success || resp.Token == "" {
+		ts.t.Fatalf("login as %s failed", username)
+	}
+	return resp.Token
+}
+
+// expect fails the test unless the response has the status, and decodes its JSON body into out
+func (ts *testServer) expect(rec *httptest.ResponseRecorder, status int, out interface{}) {
+	ts.t.Helper()
+	if rec.Code != status {
+		ts.t.Fatalf("status %d, want %d: %s", rec.Code, status, rec.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			ts.t.Fatalf("decode %q: %v", rec.Body.String(), err)
+		}
+	}
+}
+
+// created checks a create response and returns the new id
+func (ts *testServer) created(rec *httptest.ResponseRecorder) int {
+	ts.t.Helper()
+	var resp struct {
+		Success bool `json:"success"`
+		ID      int  `json:"id"`
+	}
+	ts.expect(rec, http.StatusOK, &resp)
+	if !resp.Success || resp.ID == 0 {
+		ts.t.Fatalf("create failed: %s", rec.Body.String())
+	}
+	return resp.ID
+}
+
+func (ts *testServer) multipart(target string, fields map[string]string, filename string, content []byte, header ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	fw.Write(content)
+	mw.Close()
+	return ts.do("POST", target, &buf, append([]string{"Content-Type", mw.FormDataContentType()}, header...)...)
+}
+
+func testPNG(t *testing.T, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 48; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testJPEGWithComment is a small JPEG carrying a comment (COM) segment
+func testJPEGWithComment(t *testing.T, comment string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 32, 32)), nil); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	n := len(comment) + 2
+	segment := append([]byte{0xFF, 0xFE, byte(n >> 8), byte(n)}, comment...)
+	return append(append(append([]byte{}, img[:2]...), segment...), img[2:]...)
+}
+
+// testPNGWithText is a small PNG carrying a tEXt chunk
+func testPNGWithText(t *testing.T, key, text string) []byte {
+	t.Helper()
+	img := testPNG(t, color.White)
+	data := append([]byte(key+"\x00"), text...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(append(chunk, "tEXt"...), data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	const afterIHDR = 8 + 25 // signature, then IHDR with its length, type and CRC
+	return append(append(append([]byte{}, img[:afterIHDR]...), chunk...), img[afterIHDR:]...)
+}
+
+func testThemeZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHealthAndNotFound(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		for _, path := range []string{"/healthz", "/health"} {
+			var health map[string]string
+			ts.expect(ts.do("GET", path, nil), http.StatusOK, &health)
+			if health["status"] != "ok" {
+				t.Errorf("%s = %v", path, health)
+			}
+		}
+
+		var ready struct {
+			Status     string                     `json:"status"`
+			Components map[string]ComponentStatus `json:"components"`
+		}
+		ts.expect(ts.do("GET", "/readyz", nil), http.StatusOK, &ready)
+		if ready.Status != "ok" || len(ready.Components) != 3 || ready.Components["storage"].Status != "ok" {
+			t.Errorf("readyz = %+v", ready)
+		}
+
+		if rec := ts.do("GET", "/no/such/route", nil); rec.Code != http.StatusNotFound {
+			t.Errorf("unknown route: status %d", rec.Code)
+		}
+	})
+}
+
+// downStore is a store whose database has gone away
+type downStore struct{ *MemoryStore }
+
+var errDatabaseDown = errors.New("connection refused")
+
+func (downStore) Ping(ctx context.Context) error                 { return errDatabaseDown }
+func (downStore) Settings(siteID int) (map[string]string, error) { return nil, errDatabaseDown }
+
+func TestDatabaseDown(t *testing.T) {
+	ts := newTestServer(t, downStore{NewMemoryStore()})
+
+	var ready struct {
+		Status     string                     `json:"status"`
+		Components map[string]ComponentStatus `json:"components"`
+	}
+	ts.expect(ts.do("GET", "/readyz", nil), http.StatusServiceUnavailable, &ready)
+	if ready.Status != "unavailable" || ready.Components["database"].Error != errDatabaseDown.Error() ||
+		ready.Components["settings"].Status != "unavailable" || ready.Components["storage"].Status != "ok" {
+		t.Errorf("readyz = %+v", ready)
+	}
+	ts.expect(ts.do("GET", "/healthz", nil), http.StatusOK, nil)
+
+	// Guests get an error rather than the defaults, which have social login off
+	ts.expect(ts.do("GET", "/api/settings", nil), http.StatusServiceUnavailable, nil)
+	ts.expect(ts.do("GET", "/auth/google/login", nil), http.StatusServiceUnavailable, nil)
+}
+
+func TestAdminLogin(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		t.Setenv("ADMIN_USERNAME", "boss")
+		t.Setenv("ADMIN_PASSWORD", "secret")
+
+		var ok map[string]interface{}
+		ts.expect(ts.do("POST", "/api/auth/login", map[string]string{"username": "boss", "password": "secret"}), http.StatusOK, &ok)
+		if ok["success"] != true || ok["token"] == "" {
+			t.Errorf("valid login = %v", ok)
+		}
+		token, _ := ok["token"].(string)
+		ts.expect(ts.do("GET", "/api/sites", nil, "Authorization", "Bearer "+token), http.StatusOK, nil)
+		if _, err := verifyAdminSession(token, time.Now().Add(adminSessionTTL)); err != errAdminSessionExpired {
+			t.Errorf("session after its lifetime: %v", err)
+		}
+
+		var bad map[string]interface{}
+		ts.expect(ts.do("POST", "/api/auth/login", map[string]string{"username": "boss", "password": "nope"}), http.StatusOK, &bad)
+		if bad["success"] != false {
+			t.Errorf("invalid login = %v", bad)
+		}
+
+		if rec := ts.do("POST", "/api/auth/login", strings.NewReader("{")); rec.Code != http.StatusBadRequest {
+			t.Errorf("malformed login: status %d", rec.Code)
+		}
+	})
+}
+
+func TestSettings(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		var schema []map[string]interface{}
+		ts.expect(ts.do("GET", "/api/settings/schema", nil), http.StatusOK, &schema)
+		if len(schema) != len(settingsSchema) {
+			t.Errorf("schema has %d settings, want %d", len(schema), len(settingsSchema))
+		}
+
+		// Values are typed as the schema declares, defaults included
+		var public map[string]interface{}
+		ts.expect(ts.do("GET", "/api/settings", nil), http.StatusOK, &public)
+		if public["page_title"] != settingsByKey["page_title"].Default {
+			t.Errorf("default page_title = %v", public["page_title"])
+		}
+		if public["google_login_enabled"] != false || public["ad_view_seconds"] != float64(10) {
+			t.Errorf("typed defaults = %v, %v", public["google_login_enabled"], public["ad_view_seconds"])
+		}
+		for _, def := range schema {
+			if def["key"] == "ad_view_required" && def["default"] != false {
+				t.Errorf("schema default of ad_view_required = %v", def["default"])
+			}
+		}
+		if _, leaked := public["google_client_secret"]; leaked {
+			t.Error("guest settings include a private key")
+		}
+
+		ts.expect(ts.do("PATCH", "/api/settings", map[string]interface{}{
+			"page_title":           "Hello",
+			"google_client_secret": "s3cr3t",
+		}), http.StatusOK, nil)
+
+		ts.expect(ts.do("GET", "/api/settings", nil), http.StatusOK, &public)
+		if public["page_title"] != "Hello" {
+			t.Errorf("page_title after PATCH = %v", public["page_title"])
+		}
+
+		var admin map[string]interface{}
+		ts.expect(ts.do("GET", "/api/settings/admin", nil), http.StatusOK, &admin)
+		if admin["google_client_secret"] != maskedSecret {
+			t.Errorf("admin secret = %v, want it masked", admin["google_client_secret"])
+		}
+
+		var invalid map[string]interface{}
+		ts.expect(ts.do("PATCH", "/api/settings", map[string]interface{}{"no_such_key": "x", "background_color": "red"}), http.StatusUnprocessableEntity, &invalid)
+		errs, _ := invalid["errors"].(map[string]interface{})
+		if errs["no_such_key"] == nil || errs["background_color"] == nil {
+			t.Errorf("validation errors = %v", invalid)
+		}
+
+		// The legacy form save
+		ts.expect(ts.do("POST", "/api/settings", map[string]interface{}{"button_text": "Go"}), http.StatusOK, nil)
+		ts.expect(ts.do("GET", "/api/settings", nil), http.StatusOK, &public)
+		if public["button_text"] != "Go" {
+			t.Errorf("button_text after POST = %v", public["button_text"])
+		}
+
+		// null clears a key back to its default
+		ts.expect(ts.do("PATCH", "/api/settings", map[string]interface{}{"button_text": nil}), http.StatusOK, nil)
+		ts.expect(ts.do("GET", "/api/settings", nil), http.StatusOK, &public)
+		if public["button_text"] != settingsByKey["button_text"].Default {
+			t.Errorf("button_text after clearing = %v", public["button_text"])
+		}
+	})
+}
+
+func TestCheckSettingBounds(t *testing.T) {
+	// Int settings may set only one bound
+	settingsByKey["test_min_only"] = SettingDef{Key: "test_min_only", Type: SettingInt, Min: intPtr(1)}
+	settingsByKey["test_max_only"] = SettingDef{Key: "test_max_only", Type: SettingInt, Max: intPtr(5)}
+	t.Cleanup(func() {
+		delete(settingsByKey, "test_min_only")
+		delete(settingsByKey, "test_max_only")
+	})
+
+	for _, c := range []struct{ key, value, want string }{
+		{"test_min_only", "0", "must be at least 1"},
+		{"test_min_only", "1000", ""},
+		{"test_max_only", "6", "must be at most 5"},
+		{"test_max_only", "-1000", ""},
+		{"ad_view_seconds", "301", "must be between 0 and 300"},
+	} {
+		got := ""
+		if _, err := checkSetting(c.key, c.value); err != nil {
+			got = err.Error()
+		}
+		if got != c.want {
+			t.Errorf("checkSetting(%s, %s) error = %q, want %q", c.key, c.value, got, c.want)
+		}
+	}
+}
+
+func TestSettingsRevisions(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		ts.expect(ts.do("PATCH", "/api/settings", map[string]interface{}{"page_title": "One"}), http.StatusOK, nil)
+		ts.expect(ts.do("PATCH", "/api/settings", map[string]interface{}{"page_title": "Two"}), http.StatusOK, nil)
+
+		var revisions []SettingsRevision
+		ts.expect(ts.do("GET", "/api/settings/revisions", nil), http.StatusOK, &revisions)
+		if len(revisions) != 2 {
+			t.Fatalf("got %d revisions, want 2", len(revisions))
+		}
+		latest, first := revisions[0], revisions[1]
+		if len(latest.Changes) != 1 || latest.Changes[0].Old != "One" || latest.Changes[0].New != "Two" {
+			t.Errorf("latest revision changes = %+v", latest.Changes)
+		}
+
+		var rev SettingsRevision
+		ts.expect(ts.do("GET", "/api/settings/revisions/"+strconv.Itoa(first.ID), nil), http.StatusOK, &rev)
+		if rev.Settings["page_title"] != "One" {
+			t.Errorf("revision snapshot = %v", rev.Settings)
+		}
+
+		var restored map[string]interface{}
+		ts.expect(ts.do("POST", "/api/settings/revisions/"+strconv.Itoa(first.ID)+"/restore", nil), http.StatusOK, &restored)
+		if restored["success"] != true {
+			t.Errorf("restore = %v", restored)
+		}
+		var public map[string]interface{}
+		ts.expect(ts.do("GET", "/api/settings", nil), http.StatusOK, &public)
+		if public["page_title"] != "One" {
+			t.Errorf("page_title after restore = %v", public["page_title"])
+		}
+
+		ts.expect(ts.do("GET", "/api/settings/revisions/99999", nil), http.StatusNotFound, nil)
+		ts.expect(ts.do("POST", "/api/settings/revisions/99999/restore", nil), http.StatusNotFound, nil)
+		ts.expect(ts.do("GET", "/api/settings/revisions/abc", nil), http.StatusBadRequest, nil)
+	})
+}
+
+func TestSettingsDraft(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		ts.expect(ts.do("GET", "/api/settings/draft", nil), http.StatusNotFound, nil)
+		ts.expect(ts.do("PUT", "/api/settings/draft", map[string]string{"google_client_secret": "x"}), http.StatusUnprocessableEntity, nil)
+
+		var draft SettingsDraft
+		ts.expect(ts.do("PUT", "/api/settings/draft", map[string]string{"page_title": "Coming soon"}), http.StatusOK, &draft)
+		if draft.PreviewToken == "" || len(draft.Changes) != 1 {
+			t.Fatalf("draft = %+v", draft)
+		}
+		ts.expect(ts.do("GET", "/api/settings/draft", nil), http.StatusOK, &draft)
+
+		var preview map[string]interface{}
+		ts.expect(ts.do("GET", "/api/settings/preview?token="+draft.PreviewToken, nil), http.StatusOK, &preview)
+		if preview["page_title"] != "Coming soon" {
+			t.Errorf("preview page_title = %v", preview["page_title"])
+		}
+		if rec := ts.do("GET", "/api/settings/preview?token=wrong", nil); rec.Code == http.StatusOK {
+			t.Error("preview with an unknown token succeeded")
+		}
+
+		publishAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		ts.expect(ts.do("POST", "/api/settings/draft/schedule", map[string]interface{}{"publish_at": publishAt}), http.StatusOK, nil)
+		ts.expect(ts.do("POST", "/api/settings/draft/schedule", map[string]interface{}{"publish_at": "2000-01-01T00:00"}), http.StatusUnprocessableEntity, nil)
+
+		// Not due yet, so the scheduler leaves it alone
+		ts.srv.publishDueDrafts()
+		var public map[string]interface{}
+		ts.expect(ts.do("GET", "/api/settings", nil), http.StatusOK, &public)
+		if public["page_title"] == "Coming soon" {
+			t.Error("draft was published before its schedule")
+		}
+
+		ts.expect(ts.do("POST", "/api/settings/draft/publish", nil), http.StatusOK, nil)
+		ts.expect(ts.do("GET", "/api/settings", nil), http.StatusOK, &public)
+		if public["page_title"] != "Coming soon" {
+			t.Errorf("page_title after publish = %v", public["page_title"])
+		}
+		ts.expect(ts.do("POST", "/api/settings/draft/publish", nil), http.StatusNotFound, nil)
+
+		ts.expect(ts.do("PUT", "/api/settings/draft", map[string]string{"button_text": "Later"}), http.StatusOK, nil)
+		ts.expect(ts.do("DELETE", "/api/settings/draft", nil), http.StatusOK, nil)
+		ts.expect(ts.do("DELETE", "/api/settings/draft", nil), http.StatusNotFound, nil)
+		ts.expect(ts.do("POST", "/api/settings/draft/schedule", map[string]interface{}{"publish_at": nil}), http.StatusNotFound, nil)
+
+		// Concurrent first stages all land in one draft, and each gets its token
+		keys := []string{"page_title", "button_text", "background_color"}
+		tokens := make(chan string, len(keys))
+		errs := make(chan error, len(keys))
+		for _, key := range keys {
+			go func() {
+				d, err := ts.srv.Settings.StageSettingsDraft(defaultSiteID, map[string]string{key: "x"}, "admin")
+				if err != nil {
+					errs <- err
+					return
+				}
+				tokens <- d.PreviewToken
+			}()
+		}
+		var got []string
+		for range keys {
+			select {
+			case err := <-errs:
+				t.Fatalf("concurrent stage: %v", err)
+			case token := <-tokens:
+				got = append(got, token)
+			}
+		}
+		stored, err := ts.srv.Settings.SettingsDraft(defaultSiteID)
+		if err != nil || stored == nil {
+			t.Fatalf("draft after concurrent stages = %+v, %v", stored, err)
+		}
+		for _, key := range keys {
+			if _, ok := stored.Settings[key]; !ok {
+				t.Errorf("concurrent stage lost %s: %v", key, stored.Settings)
+			}
+		}
+		for _, token := range got {
+			if token != stored.PreviewToken {
+				t.Errorf("stage returned token %q, stored %q", token, stored.PreviewToken)
+			}
+		}
+	})
+}
+
+func TestAds(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		var none map[string]interface{}
+		ts.expect(ts.do("GET", "/api/active-ad", nil), http.StatusOK, &none)
+		if none["ad"] != nil {
+			t.Errorf("active ad without ads = %v", none["ad"])
+		}
+
+		ts.expect(ts.do("POST", "/api/ads", map[string]string{"title": "", "image": "nope"}), http.StatusUnprocessableEntity, nil)
+		ts.expect(ts.do("POST", "/api/ads", map[string]string{"title": "Bad image", "image": "nope"}), http.StatusUnprocessableEntity, nil)
+		ts.expect(ts.do("POST", "/api/ads", map[string]string{"title": "Bad image", "image": "//evil.example/x.png"}), http.StatusUnprocessableEntity, nil)
+
+		// Text-only ads need no image
+		textOnly := ts.created(ts.do("POST", "/api/ads", map[string]interface{}{"title": "Happy hour", "is_active": false}))
+		ts.expect(ts.do("DELETE", "/api/ads/"+strconv.Itoa(textOnly), nil), http.StatusOK, nil)
+
+		id := ts.created(ts.do("POST", "/api/ads", map[string]interface{}{
+			"title": "Sunset", "description": "Drinks at six", "image": "/img/sunset.png", "link": "https://example.org/",
+		}))
+
+		var ads []ScheduledAd
+		ts.expect(ts.do("GET", "/api/ads", nil), http.StatusOK, &ads)
+		if len(ads) != 1 || ads[0].ID != id || !ads[0].IsActive {
+			t.Fatalf("ads = %+v", ads)
+		}
+
+		var active struct {
+			Ad *ScheduledAd `json:"ad"`
+		}
+		ts.expect(ts.do("GET", "/api/active-ad", nil), http.StatusOK, &active)
+		if active.Ad == nil || active.Ad.ID != id {
+			t.Fatalf("active ad = %+v", active)
+		}
+
+		// Translations are picked by Accept-Language
+		ts.expect(ts.do("PUT", "/api/ads/"+strconv.Itoa(id)+"/translations/id", map[string]string{"title": "Matahari terbenam"}), http.StatusOK, nil)
+		ts.expect(ts.do("PUT", "/api/ads/"+strconv.Itoa(id)+"/translations/xx", map[string]string{"title": "?"}), http.StatusNotFound, nil)
+		var translations map[string]AdTranslation
+		ts.expect(ts.do("GET", "/api/ads/"+strconv.Itoa(id)+"/translations", nil), http.StatusOK, &translations)
+		if translations["id"].Title != "Matahari terbenam" {
+			t.Errorf("translations = %v", translations)
+		}
+		ts.expect(ts.do("GET", "/api/active-ad", nil, "Accept-Language", "id-ID,id;q=0.9"), http.StatusOK, &active)
+		if active.Ad.Title != "Matahari terbenam" || active.Ad.Description != "Drinks at six" {
+			t.Errorf("localized ad = %+v", active.Ad)
+		}
+		ts.expect(ts.do("DELETE", "/api/ads/"+strconv.Itoa(id)+"/translations/id", nil), http.StatusOK, nil)
+		ts.expect(ts.do("DELETE", "/api/ads/"+strconv.Itoa(id)+"/translations/id", nil), http.StatusNotFound, nil)
+
+		ts.expect(ts.do("PUT", "/api/ads/"+strconv.Itoa(id), map[string]interface{}{
+			"title": "Sunset", "image": "/img/sunset.png", "is_active": false,
+		}), http.StatusOK, nil)
+		ts.expect(ts.do("GET", "/api/active-ad", nil), http.StatusOK, &none)
+		if none["ad"] != nil {
+			t.Errorf("inactive ad still served: %v", none["ad"])
+		}
+
+		ts.expect(ts.do("PUT", "/api/ads/99999", map[string]interface{}{"title": "X", "image": "/img/x.png"}), http.StatusNotFound, nil)
+		ts.expect(ts.do("PUT", "/api/ads/abc", map[string]interface{}{"title": "X", "image": "/img/x.png"}), http.StatusBadRequest, nil)
+		ts.expect(ts.do("DELETE", "/api/ads/"+strconv.Itoa(id), nil), http.StatusOK, nil)
+		ts.expect(ts.do("DELETE", "/api/ads/"+strconv.Itoa(id), nil), http.StatusNotFound, nil)
+		ts.expect(ts.do("GET", "/api/ads/"+strconv.Itoa(id)+"/translations", nil), http.StatusNotFound, nil)
+	})
+}
+
+func TestSettingTranslations(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		ts.expect(ts.do("PUT", "/api/translations/settings/id", map[string]interface{}{"page_title": "Selamat datang"}), http.StatusOK, nil)
+		ts.expect(ts.do("PUT", "/api/translations/settings/id", map[string]interface{}{"background_color": "#fff"}), http.StatusUnprocessableEntity, nil)
+
+		var translations struct {
+			Settings map[string]map[string]string `json:"settings"`
+		}
+		ts.expect(ts.do("GET", "/api/translations", nil), http.StatusOK, &translations)
+		if translations.Settings["id"]["page_title"] != "Selamat datang" {
+			t.Errorf("translations = %v", translations.Settings)
+		}
+
+		var public map[string]interface{}
+		rec := ts.do("GET", "/api/settings", nil, "Accept-Language", "id")
+		ts.expect(rec, http.StatusOK, &public)
+		if public["page_title"] != "Selamat datang" || public["locale"] != "id" {
+			t.Errorf("localized settings = %v", public)
+		}
+		if rec.Header().Get("Content-Language") != "id" {
+			t.Errorf("Content-Language = %q", rec.Header().Get("Content-Language"))
+		}
+	})
+}
+
+func TestCampaigns(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		ts.expect(ts.do("POST", "/api/advertisers", map[string]string{"name": ""}), http.StatusUnprocessableEntity, nil)
+		advertiser := ts.created(ts.do("POST", "/api/advertisers", map[string]string{"name": "Beach Club", "contact_email": "ads@beach.example"}))
+		ts.expect(ts.do("PUT", "/api/advertisers/"+strconv.Itoa(advertiser), map[string]string{"name": "Beach Club Bali"}), http.StatusOK, nil)
+		var advertisers []Advertiser
+		ts.expect(ts.do("GET", "/api/advertisers", nil), http.StatusOK, &advertisers)
+		if len(advertisers) != 1 || advertisers[0].Name != "Beach Club Bali" {
+			t.Errorf("advertisers = %+v", advertisers)
+		}
+
+		ts.expect(ts.do("POST", "/api/campaigns", map[string]interface{}{"name": "Summer", "advertiser_id": 99999}), http.StatusUnprocessableEntity, nil)
+		today := time.Now().Format("2006-01-02")
+		campaign := ts.created(ts.do("POST", "/api/campaigns", map[string]interface{}{
+			"name": "Summer", "advertiser_id": advertiser, "start_date": today, "impression_goal": 100,
+		}))
+		ts.expect(ts.do("PUT", "/api/campaigns/"+strconv.Itoa(campaign), map[string]interface{}{
+			"name": "Summer 2026", "advertiser_id": advertiser, "impression_goal": 100,
+		}), http.StatusOK, nil)
+
+		var campaigns []Campaign
+		ts.expect(ts.do("GET", "/api/campaigns?advertiser_id="+strconv.Itoa(advertiser), nil), http.StatusOK, &campaigns)
+		if len(campaigns) != 1 || campaigns[0].AdvertiserName != "Beach Club Bali" {
+			t.Errorf("campaigns = %+v", campaigns)
+		}
+		ts.expect(ts.do("GET", "/api/campaigns?advertiser_id=x", nil), http.StatusBadRequest, nil)
+
+		ts.expect(ts.do("POST", "/api/ads", map[string]interface{}{"title": "X", "image": "/img/x.png", "campaign_id": 99999}), http.StatusUnprocessableEntity, nil)
+		ad := ts.created(ts.do("POST", "/api/ads", map[string]interface{}{"title": "Happy hour", "image": "/img/x.png", "campaign_id": campaign}))
+
+		// Every served ad counts towards the campaign
+		for i := 0; i < 3; i++ {
+			ts.expect(ts.do("GET", "/api/active-ad", nil), http.StatusOK, nil)
+		}
+
+		var report CampaignReport
+		ts.expect(ts.do("GET", "/api/reports/campaigns/"+strconv.Itoa(campaign), nil), http.StatusOK, &report)
+		if report.Impressions != 3 || len(report.Ads) != 1 || report.Ads[0].AdID != ad {
+			t.Errorf("report = %+v", report)
+		}
+
+		// Moving the ad to another campaign mid-day: each campaign keeps what it served
+		other := ts.created(ts.do("POST", "/api/campaigns", map[string]interface{}{"name": "Autumn", "advertiser_id": advertiser}))
+		ts.expect(ts.do("PUT", "/api/ads/"+strconv.Itoa(ad), map[string]interface{}{"title": "Happy hour", "image": "/img/x.png", "campaign_id": other, "is_active": true}), http.StatusOK, nil)
+		for i := 0; i < 2; i++ {
+			ts.expect(ts.do("GET", "/api/active-ad", nil), http.StatusOK, nil)
+		}
+		for id, want := range map[int]int{campaign: 3, other: 2} {
+			ts.expect(ts.do("GET", "/api/reports/campaigns/"+strconv.Itoa(id), nil), http.StatusOK, &report)
+			if report.Impressions != want || len(report.Daily) != 1 || report.Daily[0].Impressions != want {
+				t.Errorf("campaign %d after moving the ad: %d impressions, want %d: %+v", id, report.Impressions, want, report)
+			}
+		}
+
+		if rec := ts.do("GET", "/api/reports/campaigns/"+strconv.Itoa(campaign)+"?format=csv", nil); rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+			t.Errorf("csv report: status %d, type %q", rec.Code, rec.Header().Get("Content-Type"))
+		}
+		if rec := ts.do("GET", "/api/reports/campaigns/"+strconv.Itoa(campaign)+"?format=pdf", nil); rec.Code != http.StatusOK || !bytes.HasPrefix(rec.Body.Bytes(), []byte("%PDF")) {
+			t.Errorf("pdf report: status %d", rec.Code)
+		}
+		ts.expect(ts.do("GET", "/api/reports/campaigns/"+strconv.Itoa(campaign)+"?format=xml", nil), http.StatusBadRequest, nil)
+		ts.expect(ts.do("GET", "/api/reports/campaigns/99999", nil), http.StatusNotFound, nil)
+
+		// Deleting the advertiser takes its campaigns along and detaches their ads
+		ts.expect(ts.do("DELETE", "/api/advertisers/"+strconv.Itoa(advertiser), nil), http.StatusOK, nil)
+		ts.expect(ts.do("DELETE", "/api/campaigns/"+strconv.Itoa(campaign), nil), http.StatusNotFound, nil)
+		var ads []ScheduledAd
+		ts.expect(ts.do("GET", "/api/ads", nil), http.StatusOK, &ads)
+		if len(ads) != 1 || ads[0].CampaignID != nil {
+			t.Errorf("ads after advertiser delete = %+v", ads)
+		}
+		ts.expect(ts.do("DELETE", "/api/advertisers/"+strconv.Itoa(advertiser), nil), http.StatusNotFound, nil)
+	})
+}
+
+func TestEmailLogin(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		rec := ts.do("POST", "/auth/email/login?link-login-only="+url.QueryEscape("http://10.5.50.1/login")+"&dst="+url.QueryEscape("https://example.org/"),
+			strings.NewReader("email=maria.santos%40gmail.com"), "Content-Type", "application/x-www-form-urlencoded")
+		if rec.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("email login: status %d: %s", rec.Code, rec.Body.String())
+		}
+		if loc := rec.Header().Get("Location"); !strings.HasPrefix(loc, "http://10.5.50.1/login?") {
+			t.Errorf("redirect = %q", loc)
+		}
+
+		ts.expect(ts.do("POST", "/auth/email/login", strings.NewReader("email=sdfg%40test.com"), "Content-Type", "application/x-www-form-urlencoded"), http.StatusBadRequest, nil)
+
+		// Tracking through the settings endpoint, and the same address twice
+		ts.expect(ts.do("POST", "/api/settings", map[string]interface{}{"email": "maria.santos@gmail.com", "tracking": true}), http.StatusOK, nil)
+		ts.expect(ts.do("POST", "/api/settings", map[string]interface{}{"email": "john.doe@yahoo.com", "tracking": true}), http.StatusOK, nil)
+
+		var emails []map[string]interface{}
+		ts.expect(ts.do("GET", "/api/emails", nil), http.StatusOK, &emails)
+		if len(emails) != 2 || emails[0]["email"] != "john.doe@yahoo.com" || emails[1]["source"] != "welcome nuanu wifi" {
+			t.Errorf("emails = %v", emails)
+		}
+	})
+}
+
+func TestAdViewRequired(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		ts.expect(ts.do("PATCH", "/api/settings", map[string]interface{}{"ad_view_required": true, "ad_view_seconds": 0}), http.StatusOK, nil)
+		ts.created(ts.do("POST", "/api/ads", map[string]interface{}{"title": "Watch me", "image": "/img/x.png"}))
+
+		form := "email=maria.santos%40gmail.com"
+		ts.expect(ts.do("POST", "/auth/email/login", strings.NewReader(form), "Content-Type", "application/x-www-form-urlencoded"), http.StatusForbidden, nil)
+
+		var active struct {
+			ViewToken string `json:"view_token"`
+		}
+		ts.expect(ts.do("GET", "/api/active-ad", nil), http.StatusOK, &active)
+		rec := ts.do("POST", "/auth/email/login", strings.NewReader(form+"&view_token="+url.QueryEscape(active.ViewToken)), "Content-Type", "application/x-www-form-urlencoded")
+		if rec.Code != http.StatusTemporaryRedirect {
+			t.Errorf("login with a view token: status %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+}
+
+func TestOAuthRoutes(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		ts.expect(ts.do("GET", "/auth/google/login", nil), http.StatusForbidden, nil)
+		ts.expect(ts.do("GET", "/auth/facebook/login", nil), http.StatusForbidden, nil)
+
+		ts.expect(ts.do("PATCH", "/api/settings", map[string]interface{}{
+			"google_login_enabled": true, "google_client_id": "google-id",
+			"facebook_login_enabled": true, "facebook_app_id": "facebook-id",
+		}), http.StatusOK, nil)
+
+		rec := ts.do("GET", "/auth/google/login?mac=AA:BB:CC:DD:EE:FF", nil)
+		loc, _ := url.Parse(rec.Header().Get("Location"))
+		if rec.Code != http.StatusTemporaryRedirect || loc.Host != "accounts.google.com" || loc.Query().Get("client_id") != "google-id" {
+			t.Errorf("google login: status %d, location %v", rec.Code, loc)
+		}
+		if state, _ := url.ParseQuery(loc.Query().Get("state")); state.Get("site") != "default" || state.Get("mac") == "" {
+			t.Errorf("google state = %q", loc.Query().Get("state"))
+		}
+
+		rec = ts.do("GET", "/auth/facebook/login", nil)
+		loc, _ = url.Parse(rec.Header().Get("Location"))
+		if rec.Code != http.StatusTemporaryRedirect || loc.Host != "www.facebook.com" || loc.Query().Get("client_id") != "facebook-id" {
+			t.Errorf("facebook login: status %d, location %v", rec.Code, loc)
+		}
+
+		ts.expect(ts.do("GET", "/auth/google/callback", nil), http.StatusBadRequest, nil)
+		ts.expect(ts.do("GET", "/auth/facebook/callback", nil), http.StatusBadRequest, nil)
+		ts.expect(ts.do("GET", "/auth/twitter/login", nil), http.StatusNotFound, nil)
+
+		// The interceptor catches auth paths whatever their case or prefix
+		if rec := ts.do("GET", "/AUTH/GOOGLE/LOGIN/", nil); rec.Code != http.StatusTemporaryRedirect {
+			t.Errorf("intercepted google login: status %d", rec.Code)
+		}
+	})
+}
+
+func TestUploadAndMedia(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		img := testPNG(t, color.RGBA{200, 80, 20, 255})
+		var upload struct {
+			Success      bool   `json:"success"`
+			URL          string `json:"url"`
+			Media        Media  `json:"media"`
+			Deduplicated bool   `json:"deduplicated"`
+		}
+		ts.expect(ts.multipart("/api/upload", map[string]string{"is_ad": "true", "tags": "beach, Summer"}, "beach.png", img), http.StatusOK, &upload)
+		if !upload.Success || upload.Media.ID == 0 || upload.Media.Variants == nil || upload.Deduplicated {
+			t.Fatalf("upload = %+v", upload)
+		}
+
+		if rec := ts.do("GET", upload.URL, nil); rec.Code != http.StatusOK {
+			t.Errorf("GET %s: status %d", upload.URL, rec.Code)
+		}
+
+		ts.expect(ts.multipart("/api/upload", map[string]string{"is_ad": "true", "tags": "sunset"}, "again.png", img), http.StatusOK, &upload)
+		if !upload.Deduplicated {
+			t.Error("identical upload was not deduplicated")
+		}
+
+		var items []Media
+		ts.expect(ts.do("GET", "/api/media?tag=sunset", nil), http.StatusOK, &items)
+		if len(items) != 1 || len(items[0].Tags) != 3 {
+			t.Fatalf("media by tag = %+v", items)
+		}
+		id := strconv.Itoa(items[0].ID)
+
+		ts.expect(ts.do("PATCH", "/api/media/"+id, map[string]interface{}{"tags": []string{"archive"}}), http.StatusOK, nil)
+		ts.expect(ts.do("GET", "/api/media?search=archive", nil), http.StatusOK, &items)
+		if len(items) != 1 {
+			t.Errorf("media by search = %+v", items)
+		}
+
+		ts.expect(ts.multipart("/api/upload", nil, "notes.txt", []byte("plain text")), http.StatusUnsupportedMediaType, nil)
+		ts.expect(ts.do("POST", "/api/upload", strings.NewReader("not multipart"), "Content-Type", "text/plain"), http.StatusBadRequest, nil)
+
+		// Markup hidden in image metadata is refused, also past the sniffed head
+		padding := strings.Repeat("x", 1024)
+		ts.expect(ts.multipart("/api/upload", nil, "comment.jpg", testJPEGWithComment(t, padding+"<svg onload=alert(1)>")), http.StatusUnprocessableEntity, nil)
+		ts.expect(ts.multipart("/api/upload", nil, "text.png", testPNGWithText(t, "Comment", padding+"<script>alert(1)</script>")), http.StatusUnprocessableEntity, nil)
+		ts.expect(ts.multipart("/api/upload", nil, "camera.jpg", testJPEGWithComment(t, "Shot on a phone")), http.StatusOK, nil)
+
+		// A background upload is in use by the settings, so it can be neither deleted nor collected
+		var bg struct {
+			Media Media `json:"media"`
+		}
+		ts.expect(ts.multipart("/api/upload", nil, "bg.png", testPNG(t, color.RGBA{10, 10, 200, 255})), http.StatusOK, &bg)
+		ts.expect(ts.do("DELETE", "/api/media/"+strconv.Itoa(bg.Media.ID), nil), http.StatusConflict, nil)
+
+		// A background for a site the admin may not manage is refused before anything is stored
+		city := ts.created(ts.do("POST", "/api/sites", map[string]interface{}{"slug": "city", "name": "City"}))
+		ts.expect(ts.do("PUT", "/api/admins/wayan", map[string]string{"password": "wayan-secret-1"}), http.StatusOK, nil)
+		ts.expect(ts.do("PUT", "/api/admin-sites/wayan", map[string]interface{}{"site_ids": []int{city}}), http.StatusOK, nil)
+		wayan := "Bearer " + ts.login("wayan", "wayan-secret-1")
+		var before, after []Media
+		ts.expect(ts.do("GET", "/api/media", nil), http.StatusOK, &before)
+		ts.expect(ts.multipart("/api/upload", nil, "other.png", testPNG(t, color.RGBA{10, 200, 10, 255}), "Authorization", wayan), http.StatusForbidden, nil)
+		ts.expect(ts.do("GET", "/api/media", nil), http.StatusOK, &after)
+		if len(after) != len(before) {
+			t.Errorf("refused upload left a library entry: %d before, %d after", len(before), len(after))
+		}
+
+		var gc MediaGCReport
+		ts.expect(ts.do("POST", "/api/media/gc?dry_run=true", nil), http.StatusOK, &gc)
+		if !gc.DryRun || gc.MediaRemoved != 0 {
+			t.Errorf("gc within the grace period = %+v", gc)
+		}
+
+		ts.expect(ts.do("DELETE", "/api/media/"+id, nil), http.StatusOK, nil)
+		ts.expect(ts.do("DELETE", "/api/media/"+id, nil), http.StatusNotFound, nil)
+		ts.expect(ts.do("PATCH", "/api/media/"+id, map[string]interface{}{"tags": []string{}}), http.StatusNotFound, nil)
+	})
+}
+
+func TestThemeCache(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		cache := ts.srv.themeCache
+		cached := func() int {
+			cache.mu.Lock()
+			defer cache.mu.Unlock()
+			return len(cache.themes)
+		}
+
+		// Guests asking for themes that do not exist leave nothing behind
+		for _, name := range []string{"nope", "Not-A-Name", strings.Repeat("a", 100)} {
+			ts.expect(ts.do("GET", "/portal/themes/"+url.PathEscape(name)+"/static/x.css", nil), http.StatusNotFound, nil)
+		}
+		if n := cached(); n != 0 {
+			t.Errorf("%d misses cached", n)
+		}
+
+		// A broken stored theme is unpacked once per themeCacheTTL, not on every view
+		if err := ts.srv.Themes.SaveTheme(StoredTheme{Name: "broken", Archive: []byte("not a zip")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.Load("broken"); err == nil {
+			t.Fatal("broken theme loaded")
+		}
+		if err := ts.srv.Themes.SaveTheme(StoredTheme{Name: "broken", Archive: testThemeZip(t, map[string]string{"portal.html": "fixed"})}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.Load("broken"); err == nil {
+			t.Error("failure not cached")
+		}
+		cache.Forget("broken")
+		if theme, err := cache.Load("broken"); err != nil || theme == nil {
+			t.Errorf("fixed theme: %v, %v", theme, err)
+		}
+	})
+}
+
+func TestThemesAndPortal(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		rec := ts.do("GET", "/portal", nil)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), settingsByKey["page_title"].Default) {
+			t.Fatalf("default portal: status %d", rec.Code)
+		}
+
+		var themes []PortalTheme
+		ts.expect(ts.do("GET", "/api/themes", nil), http.StatusOK, &themes)
+		if len(themes) != 1 || themes[0].Name != defaultThemeName || !themes[0].BuiltIn {
+			t.Errorf("themes = %+v", themes)
+		}
+
+		archive := testThemeZip(t, map[string]string{
+			"dark/portal.html":     `<h1 class="dark">{{.Settings.PageTitle}}</h1><link href="{{.Assets}}static/dark.css">`,
+			"dark/theme.json":      `{"description": "Dark mode"}`,
+			"dark/static/dark.css": `h1 { color: white }`,
+		})
+		ts.expect(ts.multipart("/api/themes", nil, "dark.zip", archive), http.StatusOK, nil)
+		ts.expect(ts.multipart("/api/themes", map[string]string{"name": "broken"}, "broken.zip", testThemeZip(t, map[string]string{"index.html": "x"})), http.StatusUnprocessableEntity, nil)
+
+		// Files within the per-file limit still cannot add up past the total
+		bomb := map[string]string{"portal.html": `{{define "portal.html"}}x{{end}}`}
+		for i := 0; i < maxThemeUnpackedBytes/maxThemeFileBytes; i++ {
+			bomb["pad"+strconv.Itoa(i)+".css"] = strings.Repeat(" ", maxThemeFileBytes)
+		}
+		ts.expect(ts.multipart("/api/themes", map[string]string{"name": "bomb"}, "bomb.zip", testThemeZip(t, bomb)), http.StatusUnprocessableEntity, nil)
+		ts.expect(ts.multipart("/api/themes", nil, "default.zip", archive), http.StatusUnprocessableEntity, nil)
+
+		rec = ts.do("GET", "/api/themes/dark/preview", nil)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `class="dark"`) {
+			t.Errorf("theme preview: status %d", rec.Code)
+		}
+		ts.expect(ts.do("GET", "/api/themes/missing/preview", nil), http.StatusNotFound, nil)
+		if rec := ts.do("GET", "/portal/themes/dark/static/dark.css", nil); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "color: white") {
+			t.Errorf("theme asset: status %d", rec.Code)
+		}
+
+		ts.expect(ts.do("PATCH", "/api/settings", map[string]interface{}{"portal_theme": "dark"}), http.StatusOK, nil)
+		if rec := ts.do("GET", "/portal", nil); !strings.Contains(rec.Body.String(), `class="dark"`) {
+			t.Errorf("portal does not use the site's theme: %s", rec.Body.String())
+		}
+		ts.expect(ts.do("DELETE", "/api/themes/dark", nil), http.StatusConflict, nil)
+
+		ts.expect(ts.do("PATCH", "/api/settings", map[string]interface{}{"portal_theme": nil}), http.StatusOK, nil)
+		ts.expect(ts.do("DELETE", "/api/themes/dark", nil), http.StatusOK, nil)
+		ts.expect(ts.do("DELETE", "/api/themes/dark", nil), http.StatusNotFound, nil)
+		ts.expect(ts.do("DELETE", "/api/themes/default", nil), http.StatusConflict, nil)
+	})
+}
+
+func TestSites(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		ts.expect(ts.do("POST", "/api/sites", map[string]interface{}{"slug": "Bad Slug", "name": ""}), http.StatusUnprocessableEntity, nil)
+		id := ts.created(ts.do("POST", "/api/sites", map[string]interface{}{
+			"slug": "city", "name": "Nuanu City", "hostnames": []string{"wifi.city.example"}, "gateways": []string{"hotspot-city"},
+		}))
+		ts.expect(ts.do("POST", "/api/sites", map[string]interface{}{"slug": "city", "name": "Again"}), http.StatusUnprocessableEntity, nil)
+
+		var sites []Site
+		ts.expect(ts.do("GET", "/api/sites", nil), http.StatusOK, &sites)
+		if len(sites) != 2 {
+			t.Fatalf("sites = %+v", sites)
+		}
+
+		// Settings are per site; guests are matched by gateway or hostname
+		ts.expect(ts.do("PATCH", "/api/settings?site=city", map[string]interface{}{"page_title": "City"}), http.StatusOK, nil)
+		var public map[string]interface{}
+		ts.expect(ts.do("GET", "/api/settings?server-name=hotspot-city", nil), http.StatusOK, &public)
+		if public["page_title"] != "City" {
+			t.Errorf("page_title by gateway = %v", public["page_title"])
+		}
+		req := httptest.NewRequest("GET", "/api/settings", nil)
+		req.Host = "wifi.city.example"
+		rec := httptest.NewRecorder()
+		ts.handler.ServeHTTP(rec, req)
+		ts.expect(rec, http.StatusOK, &public)
+		if public["page_title"] != "City" {
+			t.Errorf("page_title by hostname = %v", public["page_title"])
+		}
+		ts.expect(ts.do("GET", "/api/settings", nil), http.StatusOK, &public)
+		if public["page_title"] == "City" {
+			t.Error("default site sees another site's settings")
+		}
+		ts.expect(ts.do("GET", "/api/settings/admin?site=nowhere", nil), http.StatusNotFound, nil)
+
+		ts.expect(ts.do("PUT", "/api/sites/"+strconv.Itoa(id), map[string]interface{}{"slug": "city", "name": "City Centre"}), http.StatusOK, nil)
+		ts.expect(ts.do("PUT", "/api/sites/99999", map[string]interface{}{"slug": "x", "name": "X"}), http.StatusNotFound, nil)
+
+		// Restricted admins only see and manage their sites
+		ts.expect(ts.do("PUT", "/api/admin-sites/ketut", map[string]interface{}{"site_ids": []int{id}}), http.StatusOK, nil)
+		ts.expect(ts.do("PUT", "/api/admin-sites/ketut", map[string]interface{}{"site_ids": []int{99999}}), http.StatusUnprocessableEntity, nil)
+		var access map[string][]int
+		ts.expect(ts.do("GET", "/api/admin-sites", nil), http.StatusOK, &access)
+		if len(access["ketut"]) != 1 || access["ketut"][0] != id {
+			t.Errorf("admin access = %v", access)
+		}
+
+		// They log in with their own account; who they are comes from the session only
+		ts.expect(ts.do("PUT", "/api/admins/ketut", map[string]string{"password": "short"}), http.StatusUnprocessableEntity, nil)
+		ts.expect(ts.do("PUT", "/api/admins/ketut", map[string]string{"password": "ketut-secret-1"}), http.StatusOK, nil)
+		ketut := "Bearer " + ts.login("ketut", "ketut-secret-1")
+		ts.expect(ts.do("GET", "/api/sites", nil, "Authorization", ketut), http.StatusOK, &sites)
+		if len(sites) != 1 || sites[0].ID != id {
+			t.Errorf("restricted admin sees %+v", sites)
+		}
+		ts.expect(ts.do("GET", "/api/settings/admin", nil, "Authorization", ketut), http.StatusForbidden, nil)
+		ts.expect(ts.do("GET", "/api/settings/admin", nil, "Authorization", ketut, "X-Admin-User", "admin"), http.StatusForbidden, nil)
+		ts.expect(ts.do("GET", "/api/settings/admin?site=city", nil, "Authorization", ketut), http.StatusOK, nil)
+		ts.expect(ts.do("POST", "/api/sites", map[string]interface{}{"slug": "mine", "name": "Mine"}, "Authorization", ketut), http.StatusForbidden, nil)
+		ts.expect(ts.do("POST", "/api/sites", map[string]interface{}{"slug": "mine", "name": "Mine"}, "Authorization", ketut, "X-Admin-User", "admin"), http.StatusForbidden, nil)
+		ts.expect(ts.do("PUT", "/api/admin-sites/ketut", map[string]interface{}{"site_ids": []int{}}, "Authorization", ketut), http.StatusForbidden, nil)
+		ts.expect(ts.do("PUT", "/api/admins/other", map[string]string{"password": "other-secret-1"}, "Authorization", ketut), http.StatusForbidden, nil)
+
+		// What all sites share is left to unrestricted admins
+		advertiser := ts.created(ts.do("POST", "/api/advertisers", map[string]interface{}{"name": "Bintang"}))
+		campaign := ts.created(ts.do("POST", "/api/campaigns", map[string]interface{}{"advertiser_id": advertiser, "name": "Launch", "start_date": "2026-01-01", "end_date": "2026-12-31"}))
+		for _, req := range []struct{ method, target string }{
+			{"GET", "/api/advertisers"},
+			{"PUT", "/api/advertisers/" + strconv.Itoa(advertiser)},
+			{"GET", "/api/campaigns"},
+			{"POST", "/api/campaigns"},
+			{"DELETE", "/api/campaigns/" + strconv.Itoa(campaign)},
+			{"GET", "/api/reports/campaigns/" + strconv.Itoa(campaign)},
+			{"PATCH", "/api/media/1"},
+			{"DELETE", "/api/media/1"},
+			{"POST", "/api/media/gc"},
+			{"POST", "/api/themes"},
+			{"DELETE", "/api/themes/summer"},
+		} {
+			if rec := ts.do(req.method, req.target, map[string]interface{}{}, "Authorization", ketut); rec.Code != http.StatusForbidden {
+				t.Errorf("restricted %s %s: status %d", req.method, req.target, rec.Code)
+			}
+		}
+		ad := map[string]interface{}{"title": "Sale", "image": "/img/sale.png", "link": "https://example.com", "start_date": "2026-01-01", "end_date": "2026-12-31", "campaign_id": campaign}
+		ts.expect(ts.do("POST", "/api/ads?site=city", ad, "Authorization", ketut), http.StatusUnprocessableEntity, nil)
+		adID := ts.created(ts.do("POST", "/api/ads?site=city", ad))
+		ad["title"] = "Big sale"
+		ts.expect(ts.do("PUT", "/api/ads/"+strconv.Itoa(adID)+"?site=city", ad, "Authorization", ketut), http.StatusOK, nil)
+		delete(ad, "campaign_id")
+		ts.expect(ts.do("PUT", "/api/ads/"+strconv.Itoa(adID)+"?site=city", ad, "Authorization", ketut), http.StatusUnprocessableEntity, nil)
+
+		// Without a valid session nobody is an admin, whatever the headers say
+		for _, auth := range []string{"", "Bearer forged", ketut + "x"} {
+			ts.expect(ts.do("GET", "/api/sites", nil, "Authorization", auth, "X-Admin-User", "admin"), http.StatusUnauthorized, nil)
+			ts.expect(ts.do("GET", "/api/settings/admin", nil, "Authorization", auth, "X-Admin-User", "admin"), http.StatusUnauthorized, nil)
+		}
+
+		ts.expect(ts.do("DELETE", "/api/sites/"+strconv.Itoa(defaultSiteID), nil), http.StatusConflict, nil)
+		ts.expect(ts.do("DELETE", "/api/sites/"+strconv.Itoa(id), nil), http.StatusOK, nil)
+		ts.expect(ts.do("DELETE", "/api/sites/"+strconv.Itoa(id), nil), http.StatusNotFound, nil)
+		access = nil
+		ts.expect(ts.do("GET", "/api/admin-sites", nil), http.StatusOK, &access)
+		if len(access) != 0 {
+			t.Errorf("admin access after site delete = %v", access)
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	withStores(t, func(t *testing.T, ts *testServer) {
+		ts.expect(ts.do("GET", "/api/settings", nil), http.StatusOK, nil)
+		ts.expect(ts.do("GET", "/api/settings", nil), http.StatusOK, nil)
+		ts.do("GET", "/api/ads/7/translations", nil)
+		ts.do("GET", "/no/such/page", nil)
+		ts.do("BREW", "/no/such/page", nil)
+		ts.do("POST", "/auth/email/login?link-login-only="+url.QueryEscape("http://10.5.50.1/login"),
+			strings.NewReader("email=maria.santos%40gmail.com"), "Content-Type", "application/x-www-form-urlencoded")
+		ts.do("POST", "/auth/email/login", strings.NewReader("email=nope"), "Content-Type", "application/x-www-form-urlencoded")
+
+		rec := ts.do("GET", "/metrics", nil)
+		ts.expect(rec, http.StatusOK, nil)
+		body := rec.Body.String()
+		for _, want := range []string{
+			`wifi_portal_http_requests_total{code="200",method="GET",route="/api/settings"} 2`,
+			`wifi_portal_http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+			`wifi_portal_http_requests_total{code="404",method="OTHER",route="unmatched"} 1`,
+			`route="/api/ads/{id}/translations"`,
+			`wifi_portal_http_request_duration_seconds_count{method="POST",route="/auth/email/login"} 2`,
+			`wifi_portal_guest_logins_total{provider="email",result="started"} 2`,
+			`wifi_portal_guest_logins_total{provider="email",result="success"} 1`,
+			`wifi_portal_guest_logins_total{provider="email",result="failure"} 1`,
+			`wifi_portal_hotspot_authorize_redirects_total{provider="email"} 1`,
+			"wifi_portal_settings_cache_hits_total",
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("metrics lack %s", want)
+			}
+		}
+		if strings.Contains(body, `method="BREW"`) {
+			t.Error("unknown method used as a label value")
+		}
+	})
+}
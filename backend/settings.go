@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// SettingType is the declared type of a page_settings key. Values are stored
+// as text; the type drives validation, normalization and the admin form widget.
+type SettingType string
+
+const (
+	SettingString     SettingType = "string"
+	SettingBool       SettingType = "boolean"
+	SettingInt        SettingType = "integer"
+	SettingColor      SettingType = "color"
+	SettingImage      SettingType = "image"
+	SettingCredential SettingType = "credential"
+)
+
+// SettingDef declares one portal setting. Public settings are served to guests
+// by GET /api/settings; the rest only through the admin endpoints. Secret
+// values never leave the server in clear text.
+type SettingDef struct {
+	Key         string      `json:"key"`
+	Type        SettingType `json:"type"`
+	Default     string      `json:"default"`
+	Label       string      `json:"label"`
+	Group       string      `json:"group"`
+	Description string      `json:"description,omitempty"`
+	Public      bool        `json:"public"`
+	Secret      bool        `json:"secret"`
+	Draftable   bool        `json:"draftable"`
+	Localized   bool        `json:"localized"` // has per-locale variants, see i18n.go
+	MaxLength   int         `json:"max_length,omitempty"`
+	Min         *int        `json:"min,omitempty"`
+	Max         *int        `json:"max,omitempty"`
+	Enum        []string    `json:"enum,omitempty"`
+}
+
+// MarshalJSON serves the default typed like the setting's values
+func (d SettingDef) MarshalJSON() ([]byte, error) {
+	type plain SettingDef
+	return json.Marshal(struct {
+		plain
+		Default interface{} `json:"default"`
+	}{plain(d), typedSetting(d.Key, d.Default)})
+}
+
+func intPtr(n int) *int { return &n }
+
+// settingsSchema is the registry of every page_settings key, in form order
+var settingsSchema = []SettingDef{
+	{Key: "page_title", Type: SettingString, Default: "Welcome To NUANU Free WiFi", Label: "Page title", Group: "appearance", Public: true, Draftable: true, Localized: true, MaxLength: 200},
+	{Key: "button_text", Type: SettingString, Default: "Connect to WiFi", Label: "Button text", Group: "appearance", Public: true, Draftable: true, Localized: true, MaxLength: 100},
+	{Key: "background_color", Type: SettingColor, Default: "#667eea", Label: "Background color", Group: "appearance", Public: true, Draftable: true},
+	{Key: "background_image", Type: SettingImage, Default: "url(/img/nuanu.png)", Label: "Background image", Group: "appearance", Public: true, Draftable: true},
+	{Key: "background_image_type", Type: SettingString, Default: "url", Label: "Background image type", Group: "appearance", Public: true, Enum: []string{"url", "upload"}},
+	{Key: "portal_theme", Type: SettingString, Default: defaultThemeName, Label: "Portal theme", Group: "appearance", Description: "Theme used when the backend serves the guest portal itself (/portal)", Public: true, Draftable: true, MaxLength: 64},
+	{Key: "background_image_data", Type: SettingString, Default: "", Label: "Background image data", Group: "appearance", Public: true},
+	{Key: "default_locale", Type: SettingString, Default: "en", Label: "Default language", Group: "language", Description: "Language shown when none of the guest's languages is available", Public: true, Enum: supportedLocales},
+	{Key: "google_login_enabled", Type: SettingBool, Default: "false", Label: "Google login", Group: "google", Public: true},
+	{Key: "google_client_id", Type: SettingCredential, Default: "", Label: "Google client ID", Group: "google", MaxLength: 500},
+	{Key: "google_client_secret", Type: SettingCredential, Default: "", Label: "Google client secret", Group: "google", Secret: true, MaxLength: 500},
+	{Key: "facebook_login_enabled", Type: SettingBool, Default: "false", Label: "Facebook login", Group: "facebook", Public: true},
+	{Key: "facebook_app_id", Type: SettingCredential, Default: "", Label: "Facebook app ID", Group: "facebook", MaxLength: 500},
+	{Key: "facebook_app_secret", Type: SettingCredential, Default: "", Label: "Facebook app secret", Group: "facebook", Secret: true, MaxLength: 500},
+	{Key: "ad_view_required", Type: SettingBool, Default: "false", Label: "Require watching the ad before connecting", Group: "ads", Public: true},
+	{Key: "ad_view_seconds", Type: SettingInt, Default: "10", Label: "Ad view seconds", Group: "ads", Public: true, Min: intPtr(0), Max: intPtr(300)},
+}
+
+var settingsByKey = func() map[string]SettingDef {
+	m := make(map[string]SettingDef, len(settingsSchema))
+	for _, def := range settingsSchema {
+		m[def.Key] = def
+	}
+	return m
+}()
+
+const maskedSecret = "********"
+
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+// lookupSetting finds the definition of a key, including the per-locale
+// variants of localized settings ("page_title.id")
+func lookupSetting(key string) (SettingDef, bool) {
+	if def, ok := settingsByKey[key]; ok {
+		return def, true
+	}
+	base, locale, ok := strings.Cut(key, ".")
+	def, known := settingsByKey[base]
+	if !ok || !known || !def.Localized || !isSupportedLocale(locale) {
+		return SettingDef{}, false
+	}
+	def.Key = key
+	def.Label += " (" + locale + ")"
+	def.Default = ""
+	return def, true
+}
+
+func isSecretSetting(key string) bool {
+	def, _ := lookupSetting(key)
+	return def.Secret
+}
+
+// settingsValues applies the registry defaults to stored key/values; unknown keys are dropped
+func settingsValues(stored map[string]string) map[string]string {
+	values := make(map[string]string, len(settingsSchema))
+	for _, def := range settingsSchema {
+		values[def.Key] = def.Default
+		if v, ok := stored[def.Key]; ok {
+			values[def.Key] = v
+		}
+	}
+	return values
+}
+
+// portalSettings fills Settings from stored key/values over the registry
+// defaults, decoding each value as its schema type
+func portalSettings(stored map[string]string) Settings {
+	values := settingsValues(stored)
+	typed := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		typed[key] = typedSetting(key, value)
+	}
+	var settings Settings
+	// Settings' JSON tags are the setting keys, so no per-field mapping is needed
+	raw, _ := json.Marshal(typed)
+	json.Unmarshal(raw, &settings)
+	return settings
+}
+
+// siteSettings is a site's live portal settings over the registry defaults;
+// like liveSettings it answers 503 when they cannot be loaded
+func (s *Server) siteSettings(w http.ResponseWriter, siteID int) (Settings, bool) {
+	stored, ok := s.liveSettings(w, siteID)
+	if !ok {
+		return Settings{}, false
+	}
+	return portalSettings(stored), true
+}
+
+// typedSetting is a stored value as its schema type, for JSON responses:
+// booleans and integers as JSON booleans and numbers, everything else as is.
+// A value that does not parse (written before validation existed) falls
+// back to the type's zero value.
+func typedSetting(key, value string) interface{} {
+	def, _ := lookupSetting(key)
+	switch def.Type {
+	case SettingBool:
+		b, _ := strconv.ParseBool(value)
+		return b
+	case SettingInt:
+		n, _ := strconv.Atoi(value)
+		return n
+	}
+	return value
+}
+
+// typedSettings masks and types a set of stored values for a response
+func typedSettings(values map[string]string) map[string]interface{} {
+	typed := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		typed[key] = typedSetting(key, *maskSetting(key, value))
+	}
+	return typed
+}
+
+// settingsView is the JSON served for a site's settings: public keys only for
+// guests, everything (secrets masked) for the admin UI
+func (s *Server) settingsView(siteID int, stored map[string]string, admin bool) map[string]interface{} {
+	values := settingsValues(stored)
+	view := make(map[string]interface{}, len(values)+1)
+	for _, def := range settingsSchema {
+		if !def.Public && !admin {
+			continue
+		}
+		view[def.Key] = typedSetting(def.Key, *maskSetting(def.Key, values[def.Key]))
+	}
+	if variants := s.settingsCache.ImageVariants(siteID, values["background_image"]); variants != nil {
+		view["background_image_variants"] = variants
+	}
+	return view
+}
+
+// GetSettings serves the public settings of the guest's site, translated into
+// the negotiated locale
+func (s *Server) GetSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site := s.guestSite(r)
+	stored, ok := s.liveSettings(w, site.ID)
+	if !ok {
+		return
+	}
+	locale, chain := guestLocale(r, stored)
+	setLocaleHeaders(w, locale)
+
+	view := s.settingsView(site.ID, localizeSettings(stored, chain), false)
+	view["locale"] = locale
+	view["locales"] = supportedLocales
+	json.NewEncoder(w).Encode(view)
+}
+
+// GetAdminSettings serves every setting for the admin form; secrets come back masked
+func (s *Server) GetAdminSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	stored, err := s.settingsCache.Get(site.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load admin settings", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load settings", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(s.settingsView(site.ID, stored, true))
+}
+
+// GetSettingsSchema describes every setting so the admin UI can render its forms
+func GetSettingsSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settingsSchema)
+}
+
+// checkSetting validates a value in its stored string form and normalizes it
+func checkSetting(key, value string) (string, error) {
+	def, ok := lookupSetting(key)
+	if !ok {
+		return "", errors.New("is not a known setting")
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", errors.New("must not be empty (send null to clear it)")
+	}
+
+	switch def.Type {
+	case SettingString, SettingCredential:
+		if def.MaxLength > 0 && utf8.RuneCountInString(value) > def.MaxLength {
+			return "", fmt.Errorf("must be at most %d characters", def.MaxLength)
+		}
+		if def.Type == SettingCredential && strings.ContainsAny(value, " \t\r\n") {
+			return "", errors.New("must not contain whitespace")
+		}
+	case SettingBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", errors.New("must be a boolean")
+		}
+		value = strconv.FormatBool(b)
+	case SettingInt:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", errors.New("must be a whole number")
+		}
+		switch {
+		case def.Min != nil && def.Max != nil && (n < *def.Min || n > *def.Max):
+			return "", fmt.Errorf("must be between %d and %d", *def.Min, *def.Max)
+		case def.Min != nil && n < *def.Min:
+			return "", fmt.Errorf("must be at least %d", *def.Min)
+		case def.Max != nil && n > *def.Max:
+			return "", fmt.Errorf("must be at most %d", *def.Max)
+		}
+		value = strconv.Itoa(n)
+	case SettingColor:
+		if !hexColor.MatchString(value) {
+			return "", errors.New("must be a hex color like #667eea")
+		}
+		value = strings.ToLower(value)
+	case SettingImage:
+		if err := checkImageRef(value); err != nil {
+			return "", err
+		}
+	}
+
+	if len(def.Enum) > 0 {
+		for _, allowed := range def.Enum {
+			if value == allowed {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("must be one of %s", strings.Join(def.Enum, ", "))
+	}
+	return value, nil
+}
+
+// unwrapCSSURL strips a CSS url(...) wrapper from an image setting
+func unwrapCSSURL(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if strings.HasPrefix(ref, "url(") && strings.HasSuffix(ref, ")") {
+		ref = strings.Trim(ref[4:len(ref)-1], `'" `)
+	}
+	return ref
+}
+
+// checkImageRef accepts a site path, an http(s) URL, or either wrapped in CSS url(...)
+func checkImageRef(value string) error {
+	ref := unwrapCSSURL(value)
+	if strings.HasPrefix(ref, "/") && !strings.HasPrefix(ref, "//") {
+		return nil
+	}
+	if u, err := url.Parse(ref); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return nil
+	}
+	return errors.New("must be a site path (e.g. /img/...) or an http(s) URL")
+}
+
+// decodeSetting turns one JSON value into its stored form. With strict set
+// (PATCH), booleans and numbers must be real JSON booleans and numbers; the
+// legacy POST form also accepts them as strings. null clears the key.
+func decodeSetting(key string, raw json.RawMessage, strict bool) (*string, error) {
+	def, ok := lookupSetting(key)
+	if !ok {
+		return nil, errors.New("is not a known setting")
+	}
+	if string(raw) == "null" {
+		return nil, nil
+	}
+
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil || (strict && (def.Type == SettingBool || def.Type == SettingInt)) {
+		switch def.Type {
+		case SettingBool:
+			var b bool
+			if err := json.Unmarshal(raw, &b); err != nil {
+				return nil, errors.New("must be a boolean")
+			}
+			value = strconv.FormatBool(b)
+		case SettingInt:
+			var n json.Number
+			if err := json.Unmarshal(raw, &n); err != nil {
+				return nil, errors.New("must be a number")
+			}
+			value = n.String()
+		default:
+			return nil, errors.New("must be a string")
+		}
+	}
+
+	normalized, err := checkSetting(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return &normalized, nil
+}
+
+// decodeSettingChanges validates a settings body against the registry. Masked
+// secrets echoed back by the admin form mean "unchanged" and are skipped. The
+// legacy POST form (strict unset) also skips empty values and unknown keys,
+// since it carries the guest's email and tracking fields.
+func decodeSettingChanges(body map[string]json.RawMessage, strict bool) (map[string]*string, ValidationErrors) {
+	changes := map[string]*string{}
+	errs := ValidationErrors{}
+	for key, raw := range body {
+		if _, known := lookupSetting(key); !known && !strict {
+			continue
+		}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			if s == maskedSecret && isSecretSetting(key) {
+				continue
+			}
+			if s == "" && !strict {
+				continue
+			}
+		}
+		value, err := decodeSetting(key, raw, strict)
+		if err != nil {
+			errs.Add(key, "%s", err.Error())
+			continue
+		}
+		changes[key] = value
+	}
+	return changes, errs
+}
+
+// PatchSettings updates only the keys present in the body; null clears a key.
+// Every key is validated first and either all changes are written or none.
+func (s *Server) PatchSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+
+	changes, errs := decodeSettingChanges(body, true)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	revision, err := s.saveSettings(site.ID, changes, requestAdmin(r), "update")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to patch settings", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save settings, nothing was changed", nil)
+		return
+	}
+	if revision > 0 {
+		slog.InfoContext(r.Context(), "Settings patched", "site", site.Slug, "revision", revision, "keys", len(changes))
+	}
+
+	stored, ok := s.liveSettings(w, site.ID)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"revision_id": revision,
+		"settings":    s.settingsView(site.ID, stored, true),
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// settingsChannel is the Postgres NOTIFY channel every settings write signals on
+	settingsChannel = "settings_changed"
+	// settingsCacheTTL is a safety net in case a notification is lost
+	settingsCacheTTL = 5 * time.Minute
+	// settingsRetryDelay keeps a struggling database from being hit on every request
+	settingsRetryDelay = 5 * time.Second
+)
+
+// SettingsCache keeps each site's page_settings in memory so the guest login
+// path does not need a database round-trip. Writes invalidate it locally and,
+// through LISTEN/NOTIFY, on every other instance. When a reload fails the last
+// known values keep being served.
+type SettingsCache struct {
+	load     func(siteID int) (map[string]string, error)
+	variants func(ref string) *ImageVariantSet
+
+	mu    sync.Mutex
+	sites map[int]*siteSettings
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// siteSettings is one site's cached settings
+type siteSettings struct {
+	mu       sync.RWMutex
+	values   map[string]string
+	valid    bool
+	loadedAt time.Time
+	retryAt  time.Time
+	variants map[string]*ImageVariantSet // image manifests referenced by the settings
+}
+
+// NewSettingsCache caches what load returns; variants looks up the image
+// manifests settings point at
+func NewSettingsCache(load func(siteID int) (map[string]string, error), variants func(ref string) *ImageVariantSet) *SettingsCache {
+	return &SettingsCache{load: load, variants: variants, sites: map[int]*siteSettings{}}
+}
+
+func copySettings(values map[string]string) map[string]string {
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		out[k] = v
+	}
+	return out
+}
+
+func (c *SettingsCache) site(siteID int) *siteSettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.sites[siteID]
+	if !ok {
+		s = &siteSettings{}
+		c.sites[siteID] = s
+	}
+	return s
+}
+
+// Get returns a copy of a site's current settings key/values
+func (c *SettingsCache) Get(siteID int) (map[string]string, error) {
+	s := c.site(siteID)
+	s.mu.RLock()
+	if s.valid && time.Since(s.loadedAt) < settingsCacheTTL {
+		values := copySettings(s.values)
+		s.mu.RUnlock()
+		c.hits.Add(1)
+		return values, nil
+	}
+	s.mu.RUnlock()
+	return c.reload(siteID, s)
+}
+
+func (c *SettingsCache) reload(siteID int, s *siteSettings) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Another request may have reloaded while we waited for the lock
+	if s.valid && time.Since(s.loadedAt) < settingsCacheTTL {
+		c.hits.Add(1)
+		return copySettings(s.values), nil
+	}
+	if s.values != nil && time.Now().Before(s.retryAt) {
+		c.hits.Add(1)
+		return copySettings(s.values), nil
+	}
+
+	c.misses.Add(1)
+	values, err := c.load(siteID)
+	if err != nil {
+		if s.values != nil {
+			s.retryAt = time.Now().Add(settingsRetryDelay)
+			slog.Warn("Settings reload failed, serving cached values", "site_id", siteID, "loaded_at", s.loadedAt, "error", err)
+			return copySettings(s.values), nil
+		}
+		return nil, err
+	}
+	s.values = values
+	s.variants = map[string]*ImageVariantSet{}
+	s.valid = true
+	s.loadedAt = time.Now()
+	s.retryAt = time.Time{}
+	return copySettings(values), nil
+}
+
+// Invalidate makes the next Get for the site reload; the old values stay as a fallback
+func (c *SettingsCache) Invalidate(siteID int) {
+	s := c.site(siteID)
+	s.mu.Lock()
+	s.valid = false
+	s.retryAt = time.Time{}
+	s.mu.Unlock()
+}
+
+// InvalidateAll is Invalidate for every cached site
+func (c *SettingsCache) InvalidateAll() {
+	c.mu.Lock()
+	ids := make([]int, 0, len(c.sites))
+	for id := range c.sites {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+	for _, id := range ids {
+		c.Invalidate(id)
+	}
+}
+
+// ImageVariants memoizes the variants lookup for images a site's settings
+// point at, until its next reload
+func (c *SettingsCache) ImageVariants(siteID int, ref string) *ImageVariantSet {
+	s := c.site(siteID)
+	s.mu.RLock()
+	set, ok := s.variants[ref]
+	s.mu.RUnlock()
+	if ok {
+		return set
+	}
+	set = c.variants(ref)
+	s.mu.Lock()
+	if s.variants != nil {
+		s.variants[ref] = set
+	}
+	s.mu.Unlock()
+	return set
+}
+
+// Stats reports cache hits and misses since startup
+func (c *SettingsCache) Stats() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// liveSettings returns a site's live settings key/values. When they cannot be
+// loaded (and none are cached) it answers 503 and returns false: falling back
+// to the registry defaults would quietly switch social login off.
+func (s *Server) liveSettings(w http.ResponseWriter, siteID int) (map[string]string, bool) {
+	values, err := s.settingsCache.Get(siteID)
+	if err != nil {
+		slog.Error("Settings unavailable", "site_id", siteID, "error", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "Settings are temporarily unavailable", nil)
+		return nil, false
+	}
+	return values, true
+}
+
+// listenForChanges warms the default site's cache and subscribes to the
+// settings and site change notifications of a Postgres store
+func (s *Server) listenForChanges(connStr string) {
+	if _, err := s.settingsCache.Get(defaultSiteID); err != nil {
+		slog.Warn("Settings cache not warmed", "error", err)
+	} else {
+		slog.Info("Settings cache loaded")
+	}
+
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventConnectionAttemptFailed, pq.ListenerEventDisconnected:
+			slog.Warn("Settings listener", "error", err)
+		case pq.ListenerEventReconnected:
+			// Notifications sent while we were away are lost
+			s.settingsCache.InvalidateAll()
+			s.siteDir.Invalidate()
+		}
+	})
+
+	go func() {
+		// Listen blocks until the first connection succeeds
+		if err := listener.Listen(settingsChannel); err != nil {
+			slog.Warn("Settings listener not started, relying on cache expiry", "ttl", settingsCacheTTL.String(), "error", err)
+			return
+		}
+		if err := listener.Listen(sitesChannel); err != nil {
+			slog.Warn("Sites listener not started, relying on cache expiry", "ttl", siteDirectoryTTL.String(), "error", err)
+		}
+		for {
+			select {
+			case n := <-listener.Notify:
+				switch {
+				case n == nil:
+					// The connection was re-established
+					s.settingsCache.InvalidateAll()
+					s.siteDir.Invalidate()
+				case n.Channel == sitesChannel:
+					s.siteDir.Invalidate()
+				default:
+					if siteID, err := strconv.Atoi(n.Extra); err == nil {
+						s.settingsCache.Invalidate(siteID)
+					} else {
+						s.settingsCache.InvalidateAll()
+					}
+					slog.Debug("Settings changed", "site_id", n.Extra, "notifier_pid", n.BePid)
+				}
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+			}
+		}
+	}()
+}
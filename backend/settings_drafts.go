@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// draftPublishInterval is how often the scheduler looks for due drafts
+const draftPublishInterval = 30 * time.Second
+
+// SettingsDraft is a site's single staged set of portal settings
+type SettingsDraft struct {
+	SiteID       int               `json:"site_id"`
+	Settings     map[string]string `json:"settings"`
+	Changes      []SettingChange   `json:"changes"`
+	PreviewToken string            `json:"preview_token"`
+	PublishAt    *time.Time        `json:"publish_at"`
+	UpdatedBy    string            `json:"updated_by"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+func newPreviewToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeDraftResponse answers with the draft and its diff against the live settings
+func (s *Server) writeDraftResponse(w http.ResponseWriter, d *SettingsDraft) {
+	live, err := s.settingsCache.Get(d.SiteID)
+	if err != nil {
+		slog.Error("Failed to load settings draft", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load settings draft", nil)
+		return
+	}
+	liveDraftable := map[string]string{}
+	for key, value := range live {
+		if _, staged := d.Settings[key]; staged {
+			liveDraftable[key] = value
+		}
+	}
+	d.Changes = diffSettings(liveDraftable, d.Settings)
+	json.NewEncoder(w).Encode(struct {
+		*SettingsDraft
+		Settings map[string]interface{} `json:"settings"`
+	}{d, typedSettings(d.Settings)})
+}
+
+func (s *Server) GetSettingsDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	d, err := s.Settings.SettingsDraft(site.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load settings draft", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load settings draft", nil)
+		return
+	}
+	if d == nil {
+		writeJSONError(w, http.StatusNotFound, "No settings draft", nil)
+		return
+	}
+	s.writeDraftResponse(w, d)
+}
+
+// UpdateSettingsDraft merges staged values into the draft, creating it on first use
+func (s *Server) UpdateSettingsDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	errs := ValidationErrors{}
+	for key, value := range body {
+		if def, _ := lookupSetting(key); !def.Draftable {
+			errs.Add(key, "cannot be drafted")
+			continue
+		}
+		normalized, err := checkSetting(key, value)
+		if err != nil {
+			errs.Add(key, "%s", err.Error())
+			continue
+		}
+		body[key] = normalized
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	d, err := s.Settings.StageSettingsDraft(site.ID, body, requestAdmin(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save settings draft", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save settings draft", nil)
+		return
+	}
+	s.writeDraftResponse(w, d)
+}
+
+// DiscardSettingsDraft throws the draft (and any schedule) away; its preview token stops working
+func (s *Server) DiscardSettingsDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	found, err := s.Settings.DiscardSettingsDraft(site.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to discard settings draft", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to discard settings draft", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "No settings draft", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// ScheduleSettingsDraft sets (or with null, cancels) the time the draft goes live.
+// Times without an offset are portal local time (Asia/Makassar).
+func (s *Server) ScheduleSettingsDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		PublishAt *string `json:"publish_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+
+	var publishAt *time.Time
+	if body.PublishAt != nil {
+		t, ok := parsePublishAt(*body.PublishAt)
+		if !ok {
+			writeValidationErrors(w, ValidationErrors{"publish_at": "must be a date-time like 2026-01-01T00:00 or RFC 3339"})
+			return
+		}
+		if !t.After(time.Now()) {
+			writeValidationErrors(w, ValidationErrors{"publish_at": "must be in the future"})
+			return
+		}
+		publishAt = &t
+	}
+
+	found, err := s.Settings.ScheduleSettingsDraft(site.ID, publishAt, requestAdmin(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to schedule settings draft", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to schedule settings draft", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "No settings draft", nil)
+		return
+	}
+	if publishAt != nil {
+		slog.InfoContext(r.Context(), "Settings draft scheduled", "site", site.Slug, "publish_at", publishAt)
+	} else {
+		slog.InfoContext(r.Context(), "Settings draft schedule cancelled", "site", site.Slug)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "publish_at": publishAt})
+}
+
+func parsePublishAt(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	loc, err := time.LoadLocation("Asia/Makassar")
+	if err != nil {
+		loc = time.FixedZone("WITA", 8*60*60)
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// PublishSettingsDraft makes the draft live right away
+func (s *Server) PublishSettingsDraft(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	revision, published, err := s.publishDraft(site.ID, requestAdmin(r), false)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to publish settings draft", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to publish settings draft", nil)
+		return
+	}
+	if !published {
+		writeJSONError(w, http.StatusNotFound, "No settings draft", nil)
+		return
+	}
+	slog.InfoContext(r.Context(), "Settings draft published", "site", site.Slug, "revision", revision)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "revision_id": revision})
+}
+
+// publishDraft applies a site's draft to its settings and deletes it in one
+// step. With onlyDue it only publishes a draft whose schedule has passed.
+func (s *Server) publishDraft(siteID int, author string, onlyDue bool) (int, bool, error) {
+	revision, published, err := s.Settings.PublishSettingsDraft(siteID, author, onlyDue)
+	if err == nil && published {
+		s.settingsCache.Invalidate(siteID)
+	}
+	return revision, published, err
+}
+
+// startDraftPublisher publishes scheduled drafts once they are due
+func (s *Server) startDraftPublisher() {
+	go func() {
+		for range time.Tick(draftPublishInterval) {
+			s.publishDueDrafts()
+		}
+	}()
+}
+
+func (s *Server) publishDueDrafts() {
+	siteIDs, err := s.Settings.DueSettingsDrafts()
+	if err != nil {
+		slog.Error("Scheduled settings publish failed", "error", err)
+		return
+	}
+	for _, siteID := range siteIDs {
+		revision, published, err := s.publishDraft(siteID, "scheduler", true)
+		if err != nil {
+			slog.Error("Scheduled settings publish failed", "site_id", siteID, "error", err)
+			continue
+		}
+		if published {
+			slog.Info("Scheduled settings draft published", "site_id", siteID, "revision", revision)
+		}
+	}
+}
+
+// PreviewSettings serves the portal settings as they will look once a draft
+// is published. It is public so the guest page can render ?preview=<token>
+// on any device, but only with a draft's current preview token.
+func (s *Server) PreviewSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	// The token identifies the draft, and so the site, being previewed
+	token := r.URL.Query().Get("token")
+	d, err := s.Settings.SettingsDraftByToken(token)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to preview settings", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load preview", nil)
+		return
+	}
+	if d == nil || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(d.PreviewToken)) != 1 {
+		writeJSONError(w, http.StatusNotFound, "Preview not found or expired", nil)
+		return
+	}
+
+	siteID := d.SiteID
+	settingsMap, err := s.settingsCache.Get(siteID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to preview settings", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load preview", nil)
+		return
+	}
+	for key, value := range d.Settings {
+		settingsMap[key] = value
+	}
+
+	locale, chain := guestLocale(r, settingsMap)
+	setLocaleHeaders(w, locale)
+	view := s.settingsView(siteID, localizeSettings(settingsMap, chain), false)
+	view["locale"] = locale
+	view["locales"] = supportedLocales
+	json.NewEncoder(w).Encode(view)
+}
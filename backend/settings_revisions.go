@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SettingsRevision is an immutable snapshot of a site's page_settings taken after a save
+type SettingsRevision struct {
+	ID           int               `json:"id"`
+	SiteID       int               `json:"site_id"`
+	Author       string            `json:"author"`
+	Reason       string            `json:"reason"` // 'update', 'upload', 'publish', 'restore', 'baseline'
+	RestoredFrom *int              `json:"restored_from,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	Changes      []SettingChange   `json:"changes"`
+	Settings     map[string]string `json:"settings,omitempty"`
+}
+
+// SettingChange is one key that differs between two revisions, with the
+// values typed as in the settings schema
+type SettingChange struct {
+	Key string      `json:"key"`
+	Old interface{} `json:"old"` // nil: key did not exist
+	New interface{} `json:"new"` // nil: key was removed
+}
+
+// saveSettings writes changed keys through the store and drops the site's
+// cached settings. A nil value removes the key (the portal default applies
+// again); when nothing changes no revision is created and 0 is returned.
+func (s *Server) saveSettings(siteID int, changes map[string]*string, author, reason string) (int, error) {
+	id, err := s.Settings.SaveSettings(siteID, changes, author, reason)
+	if err == nil && id != 0 {
+		s.settingsCache.Invalidate(siteID)
+	}
+	return id, err
+}
+
+// restoreSettingsRevision makes a site's settings exactly match one of its
+// revisions (keys added since are removed) and records that as a new revision
+func (s *Server) restoreSettingsRevision(siteID, revisionID int, author string) (int, error) {
+	id, err := s.Settings.RestoreSettings(siteID, revisionID, author)
+	if err == nil {
+		s.settingsCache.Invalidate(siteID)
+	}
+	return id, err
+}
+
+// settingValues adapts plain key/values for saveSettings
+func settingValues(values map[string]string) map[string]*string {
+	changes := make(map[string]*string, len(values))
+	for key, value := range values {
+		value := value
+		changes[key] = &value
+	}
+	return changes
+}
+
+// diffSettings lists changed keys in key order; secret values are masked
+func diffSettings(old, new map[string]string) []SettingChange {
+	keys := map[string]bool{}
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range new {
+		keys[k] = true
+	}
+
+	changes := []SettingChange{}
+	for key := range keys {
+		o, hadOld := old[key]
+		n, hasNew := new[key]
+		if hadOld == hasNew && o == n {
+			continue
+		}
+		change := SettingChange{Key: key}
+		if hadOld {
+			change.Old = typedSetting(key, *maskSetting(key, o))
+		}
+		if hasNew {
+			change.New = typedSetting(key, *maskSetting(key, n))
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+func maskSetting(key, value string) *string {
+	if isSecretSetting(key) && value != "" {
+		value = maskedSecret
+	}
+	return &value
+}
+
+// GetSettingsRevisions lists a site's revisions newest first, each with its diff against the one before
+func (s *Server) GetSettingsRevisions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	// One extra row: the revision before the oldest one on this page, to diff against
+	loaded, err := s.Settings.SettingsRevisions(site.ID, limit+1, offset)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load settings revisions", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load settings history", nil)
+		return
+	}
+
+	revisions := []SettingsRevision{}
+	for i := 0; i < len(loaded) && i < limit; i++ {
+		previous := map[string]string{}
+		if i+1 < len(loaded) {
+			previous = loaded[i+1].Settings
+		}
+		rev := loaded[i]
+		rev.Changes = diffSettings(previous, rev.Settings)
+		rev.Settings = nil
+		revisions = append(revisions, rev)
+	}
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// GetSettingsRevision returns one full snapshot and what restoring it would change
+func (s *Server) GetSettingsRevision(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+	rev, err := s.Settings.SettingsRevision(site.ID, id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load settings revision", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load revision", nil)
+		return
+	}
+	if rev == nil {
+		writeJSONError(w, http.StatusNotFound, "Revision not found", nil)
+		return
+	}
+	current, err := s.settingsCache.Get(site.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load settings revision", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load revision", nil)
+		return
+	}
+
+	rev.Changes = diffSettings(current, rev.Settings)
+	json.NewEncoder(w).Encode(struct {
+		*SettingsRevision
+		Settings map[string]interface{} `json:"settings"`
+	}{rev, typedSettings(rev.Settings)})
+}
+
+// RestoreSettingsRevision rolls a site's live settings back to a revision in one transaction
+func (s *Server) RestoreSettingsRevision(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	site, ok := s.adminSite(w, r)
+	if !ok {
+		return
+	}
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+	newID, err := s.restoreSettingsRevision(site.ID, id, requestAdmin(r))
+	if err == errRevisionNotFound {
+		writeJSONError(w, http.StatusNotFound, "Revision not found", nil)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to restore settings revision", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to restore settings", nil)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Settings restored", "site", site.Slug, "from_revision", id, "revision", newID)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "revision_id": newID, "restored_from": id})
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultSiteID owns everything that existed before sites were introduced and
+// serves any request that matches no other site
+const defaultSiteID = 1
+
+// sitesChannel is the NOTIFY channel signalled when sites or admin access change
+const sitesChannel = "sites_changed"
+
+const siteDirectoryTTL = time.Minute
+
+// Site is one venue with its own settings, ads, collected emails and gateways
+type Site struct {
+	ID        int       `json:"id"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	Hostnames []string  `json:"hostnames"` // portal hostnames, e.g. wifi.nuanu-city.io
+	Gateways  []string  `json:"gateways"`  // MikroTik server-name / identity values or gateway addresses
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// siteDirectory caches the sites table; every guest request resolves a site
+type siteDirectory struct {
+	store    SiteStore
+	mu       sync.RWMutex
+	sites    []Site
+	loadedAt time.Time
+}
+
+func (d *siteDirectory) All() []Site {
+	d.mu.RLock()
+	if d.sites != nil && time.Since(d.loadedAt) < siteDirectoryTTL {
+		sites := d.sites
+		d.mu.RUnlock()
+		return sites
+	}
+	d.mu.RUnlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sites, err := d.store.Sites()
+	if err != nil {
+		slog.Warn("Failed to load sites, using cached list", "error", err)
+		if d.sites == nil {
+			return []Site{{ID: defaultSiteID, Slug: "default", Name: "Default"}}
+		}
+		return d.sites
+	}
+	d.sites = sites
+	d.loadedAt = time.Now()
+	return sites
+}
+
+func (d *siteDirectory) Invalidate() {
+	d.mu.Lock()
+	d.loadedAt = time.Time{}
+	d.mu.Unlock()
+}
+
+func (d *siteDirectory) ByID(id int) (Site, bool) {
+	for _, s := range d.All() {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return Site{}, false
+}
+
+// Lookup finds a site by slug or numeric id
+func (d *siteDirectory) Lookup(ref string) (Site, bool) {
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	if ref == "" {
+		return Site{}, false
+	}
+	if id, err := strconv.Atoi(ref); err == nil {
+		return d.ByID(id)
+	}
+	for _, s := range d.All() {
+		if s.Slug == ref {
+			return s, true
+		}
+	}
+	return Site{}, false
+}
+
+func (d *siteDirectory) Default() Site {
+	if s, ok := d.ByID(defaultSiteID); ok {
+		return s
+	}
+	return Site{ID: defaultSiteID, Slug: "default", Name: "Default"}
+}
+
+// requestHost is the hostname the guest or admin used, without port
+func requestHost(r *http.Request) string {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	host = strings.TrimSpace(strings.Split(host, ",")[0])
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// gatewayRefs are the values a MikroTik hotspot passes along that identify it:
+// the hotspot server-name, the router identity and the gateway's login address
+func gatewayRefs(params url.Values) []string {
+	var refs []string
+	for _, key := range []string{"server-name", "identity"} {
+		if v := strings.ToLower(strings.TrimSpace(params.Get(key))); v != "" {
+			refs = append(refs, v)
+		}
+	}
+	for _, key := range []string{"link-login-only", "link-login"} {
+		if u, err := url.Parse(params.Get(key)); err == nil && u.Hostname() != "" {
+			refs = append(refs, strings.ToLower(u.Hostname()))
+		}
+	}
+	return refs
+}
+
+// resolveSite picks the site for a guest request: an explicit site parameter,
+// then the MikroTik gateway parameters, then the hostname, then the default site.
+// params are the MikroTik parameters (the query, or the OAuth state on callbacks).
+func (s *Server) resolveSite(r *http.Request, params url.Values) Site {
+	if site, ok := s.siteDir.Lookup(params.Get("site")); ok {
+		return site
+	}
+	if site, ok := s.siteDir.Lookup(r.URL.Query().Get("site")); ok {
+		return site
+	}
+
+	sites := s.siteDir.All()
+	if refs := gatewayRefs(params); len(refs) > 0 {
+		for _, site := range sites {
+			for _, gw := range site.Gateways {
+				for _, ref := range refs {
+					if strings.EqualFold(gw, ref) {
+						return site
+					}
+				}
+			}
+		}
+	}
+
+	host := requestHost(r)
+	for _, site := range sites {
+		for _, h := range site.Hostnames {
+			if strings.EqualFold(h, host) {
+				return site
+			}
+		}
+	}
+	return s.siteDir.Default()
+}
+
+// guestSite resolves the site from the request's own query
+func (s *Server) guestSite(r *http.Request) Site {
+	return s.resolveSite(r, r.URL.Query())
+}
+
+// withSiteParam pins the resolved site into MikroTik params carried through OAuth,
+// since callbacks arrive on the shared redirect domain
+func withSiteParam(rawQuery string, site Site) string {
+	params, _ := url.ParseQuery(rawQuery)
+	if params.Get("site") != "" {
+		return rawQuery
+	}
+	if rawQuery != "" {
+		rawQuery += "&"
+	}
+	return rawQuery + "site=" + url.QueryEscape(site.Slug)
+}
+
+func (s *Server) adminCanAccess(username string, siteID int) (bool, error) {
+	ids, err := s.Sites.AdminSiteIDs(username)
+	if err != nil {
+		return false, err
+	}
+	if ids == nil {
+		return true, nil
+	}
+	for _, id := range ids {
+		if id == siteID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// adminSite resolves the site an admin request works on (the ?site= parameter
+// or X-Site header, else the hostname) and checks the admin may manage it.
+// On failure it has already answered the request.
+func (s *Server) adminSite(w http.ResponseWriter, r *http.Request) (Site, bool) {
+	ref := r.URL.Query().Get("site")
+	if ref == "" {
+		ref = r.Header.Get("X-Site")
+	}
+	site := s.resolveSite(r, url.Values{})
+	if ref != "" {
+		found, ok := s.siteDir.Lookup(ref)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Site not found", nil)
+			return Site{}, false
+		}
+		site = found
+	}
+
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return Site{}, false
+	}
+	allowed, err := s.adminCanAccess(admin, site.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Site access check failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check site access", nil)
+		return Site{}, false
+	}
+	if !allowed {
+		slog.WarnContext(r.Context(), "Admin denied access to site", "admin", admin, "site", site.Slug)
+		writeJSONError(w, http.StatusForbidden, "You do not have access to this site", nil)
+		return Site{}, false
+	}
+	return site, true
+}
+
+// requireSuperAdmin lets through admins that are not restricted to any site.
+// It guards the sites themselves and everything shared by all sites:
+// advertisers and campaigns, the media library and the portal themes.
+func (s *Server) requireSuperAdmin(w http.ResponseWriter, r *http.Request) bool {
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return false
+	}
+	ids, err := s.Sites.AdminSiteIDs(admin)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Site access check failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check site access", nil)
+		return false
+	}
+	if ids != nil {
+		writeJSONError(w, http.StatusForbidden, "Only unrestricted admins can do this", nil)
+		return false
+	}
+	return true
+}
+
+// sitesChanged drops the cached site list; the store tells other instances
+func (s *Server) sitesChanged() {
+	s.siteDir.Invalidate()
+}
+
+// GetSites lists the sites the admin may manage
+func (s *Server) GetSites(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	sites, err := s.Sites.Sites()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load sites", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load sites", nil)
+		return
+	}
+	ids, err := s.Sites.AdminSiteIDs(admin)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load sites", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load sites", nil)
+		return
+	}
+	if ids != nil {
+		allowed := map[int]bool{}
+		for _, id := range ids {
+			allowed[id] = true
+		}
+		visible := []Site{}
+		for _, site := range sites {
+			if allowed[site.ID] {
+				visible = append(visible, site)
+			}
+		}
+		sites = visible
+	}
+	json.NewEncoder(w).Encode(sites)
+}
+
+func (s *Server) CreateSite(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	var site Site
+	if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	if errs := validateSite(&site, 0, s.siteDir.All()); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if err := s.Sites.CreateSite(&site); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create site", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create site", nil)
+		return
+	}
+	s.sitesChanged()
+	slog.InfoContext(r.Context(), "Site created", "site_id", site.ID, "site", site.Slug)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": site.ID})
+}
+
+func (s *Server) UpdateSite(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var site Site
+	if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	if errs := validateSite(&site, id, s.siteDir.All()); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	site.ID = id
+	found, err := s.Sites.UpdateSite(site)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update site", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update site", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Site not found", nil)
+		return
+	}
+	s.sitesChanged()
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// DeleteSite removes a site with all its settings, ads and collected emails
+func (s *Server) DeleteSite(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+	id, ok := idFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if id == defaultSiteID {
+		writeJSONError(w, http.StatusConflict, "The default site cannot be deleted", nil)
+		return
+	}
+
+	found, err := s.Sites.DeleteSite(id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete site", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete site", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Site not found", nil)
+		return
+	}
+	s.sitesChanged()
+	s.settingsCache.Invalidate(id)
+	slog.InfoContext(r.Context(), "Site deleted", "site_id", id)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+var siteSlug = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// validateSite normalizes a site and checks it against the existing ones
+func validateSite(s *Site, id int, existing []Site) ValidationErrors {
+	errs := ValidationErrors{}
+	s.Slug = strings.ToLower(strings.TrimSpace(s.Slug))
+	s.Name = strings.TrimSpace(s.Name)
+	if !siteSlug.MatchString(s.Slug) {
+		errs.Add("slug", "must be lowercase letters, digits and dashes")
+	} else if _, err := strconv.Atoi(s.Slug); err == nil {
+		errs.Add("slug", "must not be a number")
+	}
+	if s.Name == "" {
+		errs.Add("name", "is required")
+	}
+	s.Hostnames = normalizeSiteRefs(s.Hostnames)
+	s.Gateways = normalizeSiteRefs(s.Gateways)
+
+	// A hostname or gateway may only point at one site, or resolution would be ambiguous
+	for _, other := range existing {
+		if other.ID == id {
+			continue
+		}
+		if other.Slug == s.Slug {
+			errs.Add("slug", "is already used by site %s", other.Name)
+		}
+		for _, h := range s.Hostnames {
+			for _, oh := range other.Hostnames {
+				if h == oh {
+					errs.Add("hostnames", "%s is already used by site %s", h, other.Name)
+				}
+			}
+		}
+		for _, g := range s.Gateways {
+			for _, og := range other.Gateways {
+				if g == og {
+					errs.Add("gateways", "%s is already used by site %s", g, other.Name)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func normalizeSiteRefs(refs []string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		ref = strings.ToLower(strings.TrimSpace(ref))
+		if ref != "" && !seen[ref] {
+			seen[ref] = true
+			out = append(out, ref)
+		}
+	}
+	return out
+}
+
+// GetAdminSites lists which admins are restricted to which sites
+func (s *Server) GetAdminSites(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	access, err := s.Sites.AdminSiteAccess()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load admin site access", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load admin access", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(access)
+}
+
+// SetAdminSites restricts an admin to the given sites; an empty list lifts the restriction
+func (s *Server) SetAdminSites(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+	username := strings.TrimSpace(mux.Vars(r)["username"])
+	if username == "" {
+		writeJSONError(w, http.StatusBadRequest, "Invalid username", nil)
+		return
+	}
+
+	var body struct {
+		SiteIDs []int `json:"site_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body", nil)
+		return
+	}
+	for _, id := range body.SiteIDs {
+		if _, ok := s.siteDir.ByID(id); !ok {
+			writeValidationErrors(w, ValidationErrors{"site_ids": "site " + strconv.Itoa(id) + " does not exist"})
+			return
+		}
+	}
+
+	if err := s.Sites.SetAdminSiteIDs(username, body.SiteIDs); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save admin site access", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update admin access", nil)
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin site access changed", "admin", username, "site_ids", body.SiteIDs)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
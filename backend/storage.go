@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Storage is where uploaded media lives. Keys are flat file names
+// (content-hash based), URLs are what guests and the admin UI load.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context) ([]StoredObject, error)
+	URL(key string) string
+	Name() string
+}
+
+// StoredObject is one entry of a Storage listing
+type StoredObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// newStorageFromEnv picks the backend from STORAGE_BACKEND ('local' or 's3')
+func newStorageFromEnv() (Storage, error) {
+	switch backend := strings.ToLower(CleanEnv(os.Getenv("STORAGE_BACKEND"))); backend {
+	case "", "local":
+		dir := CleanEnv(os.Getenv("STORAGE_LOCAL_DIR"))
+		if dir == "" {
+			dir = defaultImgDir()
+		}
+		baseURL := CleanEnv(os.Getenv("STORAGE_PUBLIC_URL"))
+		if baseURL == "" {
+			baseURL = "/img"
+		}
+		return NewLocalStorage(dir, baseURL)
+	case "s3":
+		return NewS3Storage(S3Config{
+			Endpoint:  CleanEnv(os.Getenv("S3_ENDPOINT")),
+			Region:    CleanEnv(os.Getenv("S3_REGION")),
+			Bucket:    CleanEnv(os.Getenv("S3_BUCKET")),
+			AccessKey: CleanEnv(os.Getenv("S3_ACCESS_KEY")),
+			SecretKey: CleanEnv(os.Getenv("S3_SECRET_KEY")),
+			UseSSL:    CleanEnv(os.Getenv("S3_USE_SSL")) != "false",
+			Prefix:    CleanEnv(os.Getenv("S3_PREFIX")),
+			PublicURL: CleanEnv(os.Getenv("S3_PUBLIC_URL")),
+		})
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q (use local or s3)", backend)
+	}
+}
+
+// defaultImgDir finds public/img whether we run from backend/ or the repo root
+func defaultImgDir() string {
+	cwd, _ := os.Getwd()
+	imgDir := filepath.Join(cwd, "..", "public", "img")
+	if _, err := os.Stat(imgDir); os.IsNotExist(err) {
+		imgDir = filepath.Join(cwd, "public", "img")
+	}
+	return imgDir
+}
+
+// staticImgHandler serves /img/ from local upload storage, falling back to the
+// bundled public/img assets (logos, default backgrounds) when they live elsewhere
+func staticImgHandler(storage Storage) http.Handler {
+	assetsDir := defaultImgDir()
+	dirs := []string{assetsDir}
+	if local, ok := storage.(*LocalStorage); ok && local.Dir != assetsDir {
+		dirs = []string{local.Dir, assetsDir}
+	}
+	slog.Info("Serving static files", "dirs", dirs)
+
+	servers := make([]http.Handler, len(dirs))
+	for i, dir := range dirs {
+		servers[i] = http.FileServer(http.Dir(dir))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, dir := range dirs[:len(dirs)-1] {
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))); err == nil {
+				servers[i].ServeHTTP(w, r)
+				return
+			}
+		}
+		servers[len(servers)-1].ServeHTTP(w, r)
+	})
+}
+
+// storageKey validates a key coming from a URL or the database; keys never contain paths
+func storageKey(key string) (string, error) {
+	if key == "" || key != path.Base(key) || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return key, nil
+}
+
+// LocalStorage keeps uploads in a directory served by the backend under /img/
+type LocalStorage struct {
+	Dir     string
+	BaseURL string
+}
+
+func NewLocalStorage(dir, baseURL string) (*LocalStorage, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStorage{Dir: abs, BaseURL: strings.TrimRight(baseURL, "/")}, nil
+}
+
+func (s *LocalStorage) Name() string { return "local" }
+
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	key, err := storageKey(key)
+	if err != nil {
+		return err
+	}
+	// Write next to the target and rename, so readers never see half a file
+	tmp, err := os.CreateTemp(s.Dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.Dir, key))
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	key, err := storageKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(s.Dir, key))
+}
+
+func (s *LocalStorage) Exists(ctx context.Context, key string) (bool, error) {
+	key, err := storageKey(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filepath.Join(s.Dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	key, err := storageKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(s.Dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStorage) List(ctx context.Context) ([]StoredObject, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	objects := []StoredObject{}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		objects = append(objects, StoredObject{Key: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return objects, nil
+}
+
+func (s *LocalStorage) URL(key string) string {
+	return s.BaseURL + "/" + url.PathEscape(key)
+}
+
+type S3Config struct {
+	Endpoint  string // host[:port], e.g. s3.amazonaws.com or localhost:9000 for MinIO
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	Prefix    string // optional key prefix inside the bucket, e.g. "portal/"
+	PublicURL string // optional CDN/public base URL; defaults to the endpoint's bucket URL
+}
+
+// S3Storage stores uploads in any S3-compatible bucket (AWS, MinIO, R2, ...)
+type S3Storage struct {
+	client    *minio.Client
+	bucket    string
+	prefix    string
+	publicURL string
+}
+
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required for the s3 storage backend")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	publicURL := strings.TrimRight(cfg.PublicURL, "/")
+	if publicURL == "" {
+		scheme := "https"
+		if !cfg.UseSSL {
+			scheme = "http"
+		}
+		publicURL = fmt.Sprintf("%s://%s/%s", scheme, cfg.Endpoint, cfg.Bucket)
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3Storage{client: client, bucket: cfg.Bucket, prefix: prefix, publicURL: publicURL}, nil
+}
+
+func (s *S3Storage) Name() string { return "s3" }
+
+func (s *S3Storage) objectName(key string) (string, error) {
+	key, err := storageKey(key)
+	if err != nil {
+		return "", err
+	}
+	return s.prefix + key, nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	name, err := s.objectName(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{
+		ContentType: contentType,
+		// Keys are content hashes, so objects never change
+		CacheControl: "public, max-age=31536000, immutable",
+	})
+	return err
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := s.objectName(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+}
+
+func (s *S3Storage) Exists(ctx context.Context, key string) (bool, error) {
+	name, err := s.objectName(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	name, err := s.objectName(key)
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) List(ctx context.Context) ([]StoredObject, error) {
+	objects := []StoredObject{}
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		key := strings.TrimPrefix(obj.Key, s.prefix)
+		if key == "" || strings.Contains(key, "/") {
+			continue
+		}
+		objects = append(objects, StoredObject{Key: key, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return objects, nil
+}
+
+func (s *S3Storage) URL(key string) string {
+	return s.publicURL + "/" + s.prefix + url.PathEscape(key)
+}
+
+// ensureBucket is called at startup so a misconfigured bucket fails loudly instead of on first upload
+func (s *S3Storage) ensureBucket(ctx context.Context) error {
+	ok, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("bucket %q does not exist", s.bucket)
+	}
+	return nil
+}
+
+// initStorage sets up the configured upload storage, exiting when it is misconfigured
+func initStorage() Storage {
+	storage, err := newStorageFromEnv()
+	if err != nil {
+		fatal("Storage configuration error", "error", err)
+	}
+	if s3, ok := storage.(*S3Storage); ok {
+		if err := s3.ensureBucket(context.Background()); err != nil {
+			slog.Warn("S3 bucket check failed", "error", err)
+		}
+	}
+	slog.Info("Upload storage ready", "storage", storage.Name(), "url", storage.URL(""))
+	return storage
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// The handlers reach the database only through these interfaces. PostgresStore
+// is the production implementation, MemoryStore keeps everything in maps for
+// tests and local experiments. Lookups of a single row return nil (and no
+// error) when it does not exist; updates and deletes report whether a row was
+// affected.
+
+var errRevisionNotFound = errors.New("settings revision not found")
+
+// SettingsStore keeps each site's page_settings together with their revision
+// history and the site's settings draft
+type SettingsStore interface {
+	// Settings returns a site's stored key/values
+	Settings(siteID int) (map[string]string, error)
+	// SaveSettings writes changed keys (nil removes a key) and records the
+	// resulting state as a new revision. Keys whose value is already live are
+	// ignored; when nothing changes no revision is created and 0 is returned.
+	SaveSettings(siteID int, changes map[string]*string, author, reason string) (int, error)
+	// RestoreSettings makes a site's settings exactly match one of its revisions
+	// and records that as a new revision; errRevisionNotFound when it is not the site's
+	RestoreSettings(siteID, revisionID int, author string) (int, error)
+	// SettingsRevisions lists revisions newest first, each with its full snapshot in Settings
+	SettingsRevisions(siteID, limit, offset int) ([]SettingsRevision, error)
+	SettingsRevision(siteID, id int) (*SettingsRevision, error)
+
+	SettingsDraft(siteID int) (*SettingsDraft, error)
+	SettingsDraftByToken(token string) (*SettingsDraft, error)
+	// StageSettingsDraft merges values into the site's draft, creating it on first use
+	StageSettingsDraft(siteID int, values map[string]string, author string) (*SettingsDraft, error)
+	ScheduleSettingsDraft(siteID int, publishAt *time.Time, author string) (bool, error)
+	DiscardSettingsDraft(siteID int) (bool, error)
+	// PublishSettingsDraft applies a site's draft and deletes it, atomically. With
+	// onlyDue it only publishes a draft whose schedule has passed.
+	PublishSettingsDraft(siteID int, author string, onlyDue bool) (revision int, published bool, err error)
+	// DueSettingsDrafts lists the sites whose scheduled draft is due
+	DueSettingsDrafts() ([]int, error)
+}
+
+// AdStore keeps the scheduled ads of every site, their translations and impressions
+type AdStore interface {
+	Ads(siteID int) ([]ScheduledAd, error)
+	Ad(siteID, id int) (*ScheduledAd, error)
+	CreateAd(siteID int, ad *ScheduledAd) error
+	UpdateAd(siteID int, ad ScheduledAd) (bool, error)
+	DeleteAd(siteID, id int) (bool, error)
+	// ActiveAd is the site's newest active ad scheduled for the portal-local
+	// date and time, inside its campaign's flight window; nil when there is none
+	ActiveAd(siteID int, date, clock string) (*ScheduledAd, error)
+
+	AdTranslations(adID int) (map[string]AdTranslation, error)
+	SaveAdTranslation(adID int, locale string, t AdTranslation) error
+	DeleteAdTranslation(adID int, locale string) (bool, error)
+
+	// RecordImpression counts one served ad towards the day's delivery of the
+	// campaign it is in now. Moving the ad to another campaign leaves what was
+	// counted for the old one there; each campaign keeps what it served.
+	RecordImpression(ad ScheduledAd, day string) error
+}
+
+// CampaignStore keeps advertisers, their campaigns and the campaigns' delivery
+type CampaignStore interface {
+	Advertisers() ([]Advertiser, error)
+	Advertiser(id int) (*Advertiser, error)
+	CreateAdvertiser(a *Advertiser) error
+	UpdateAdvertiser(a Advertiser) (bool, error)
+	DeleteAdvertiser(id int) (bool, error)
+
+	// Campaigns lists campaigns newest first; advertiserID 0 lists all
+	Campaigns(advertiserID int) ([]Campaign, error)
+	Campaign(id int) (*Campaign, error)
+	CreateCampaign(c *Campaign) error
+	UpdateCampaign(c Campaign) (bool, error)
+	DeleteCampaign(id int) (bool, error)
+	// CampaignDelivery totals a campaign's impressions per ad (most first) and per day
+	CampaignDelivery(id int) ([]AdDelivery, []DailyDelivery, error)
+}
+
+// CollectedEmail is one guest address gathered by a login
+type CollectedEmail struct {
+	ID        int
+	Email     string
+	Source    string // 'google', 'facebook', 'welcome nuanu wifi'
+	CreatedAt time.Time
+}
+
+// EmailStore keeps the guest emails collected per site
+type EmailStore interface {
+	// SaveEmail records an address; one the site already has is left alone
+	SaveEmail(siteID int, email, source string) error
+	// Emails lists a site's addresses newest first
+	Emails(siteID int) ([]CollectedEmail, error)
+}
+
+// SiteStore keeps the sites, the admin accounts and which admins are
+// restricted to which sites
+type SiteStore interface {
+	Sites() ([]Site, error)
+	CreateSite(s *Site) error
+	UpdateSite(s Site) (bool, error)
+	// DeleteSite removes a site with everything that belongs to it
+	DeleteSite(id int) (bool, error)
+
+	// AdminSiteIDs returns the sites an admin is restricted to; nil means all sites
+	AdminSiteIDs(username string) ([]int, error)
+	AdminSiteAccess() (map[string][]int, error)
+	// SetAdminSiteIDs replaces an admin's sites; an empty list lifts the restriction
+	SetAdminSiteIDs(username string, siteIDs []int) error
+
+	// AdminPasswordHash is an admin account's bcrypt hash; "" when there is no such account
+	AdminPasswordHash(username string) (string, error)
+	// SetAdminPasswordHash creates an admin account or replaces its password
+	SetAdminPasswordHash(username, hash string) error
+}
+
+// MediaFilter narrows a media library listing
+type MediaFilter struct {
+	Tag    string
+	Type   string // 'image', 'video' or a full content type
+	Search string // matched against the original name and tags
+	Limit  int    // 0: no limit
+	Offset int
+}
+
+// MediaStore keeps the media library
+type MediaStore interface {
+	MediaByID(id int) (*Media, error)
+	MediaByHash(hash string) (*Media, error)
+	MediaByURL(url string) (*Media, error)
+	// ListMedia returns matching entries newest first
+	ListMedia(f MediaFilter) ([]Media, error)
+	// SaveMedia stores an entry, refreshing the one with the same hash; it sets ID and CreatedAt
+	SaveMedia(m *Media) error
+	SetMediaTags(id int, tags []string) (bool, error)
+	RemoveMedia(id int) error
+	// ImageReferences lists every image reference the portal may still show:
+	// settings values, ad images, and backgrounds in revisions and drafts
+	ImageReferences() ([]string, error)
+}
+
+// StoredTheme is an uploaded theme package as stored
+type StoredTheme struct {
+	Name       string
+	Archive    []byte
+	UploadedBy string
+	CreatedAt  time.Time
+}
+
+// ThemeStore keeps the uploaded portal theme packages
+type ThemeStore interface {
+	ThemeNames() ([]string, error)
+	ThemeArchive(name string) (*StoredTheme, error)
+	// SaveTheme installs or replaces a theme
+	SaveTheme(t StoredTheme) error
+	DeleteTheme(name string) (bool, error)
+	// ThemeSites names the sites whose portal_theme setting is the theme
+	ThemeSites(name string) ([]string, error)
+}
+
+// Store is a complete backend for the server
+type Store interface {
+	// Ping checks the backend can be reached
+	Ping(ctx context.Context) error
+
+	SettingsStore
+	AdStore
+	CampaignStore
+	EmailStore
+	SiteStore
+	MediaStore
+	ThemeStore
+}
+
+// applySettingChanges applies changes to current in place and reports which
+// keys were set and which removed; unchanged keys are left out of both
+func applySettingChanges(current map[string]string, changes map[string]*string) (set map[string]string, removed []string) {
+	set = map[string]string{}
+	for key, value := range changes {
+		old, exists := current[key]
+		switch {
+		case value == nil && !exists, value != nil && exists && old == *value:
+			continue
+		case value == nil:
+			delete(current, key)
+			removed = append(removed, key)
+		default:
+			current[key] = *value
+			set[key] = *value
+		}
+	}
+	return set, removed
+}
@@ -0,0 +1,1032 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store kept in maps, for tests and running the backend
+// without a database. It mirrors the Postgres semantics: the default site
+// exists from the start, deleting a site, ad or advertiser takes everything
+// that belongs to it along, and deleting a campaign detaches its ads.
+type MemoryStore struct {
+	mu     sync.Mutex
+	nextID int
+
+	settings    map[int]map[string]string
+	revisions   []SettingsRevision
+	drafts      map[int]*SettingsDraft
+	ads         map[int]*memoryAd
+	impressions map[memoryImpressionKey]int
+	advertisers map[int]*Advertiser
+	campaigns   map[int]*Campaign
+	emails      []memoryEmail
+	sites       map[int]*Site
+	adminSites  map[string][]int
+	adminHashes map[string]string
+	media       map[int]*Media
+	themes      map[string]*StoredTheme
+}
+
+type memoryAd struct {
+	ScheduledAd
+	siteID       int
+	translations map[string]AdTranslation
+}
+
+type memoryImpressionKey struct {
+	adID       int
+	campaignID int
+	day        string
+}
+
+type memoryEmail struct {
+	CollectedEmail
+	siteID int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		nextID:      1,
+		settings:    map[int]map[string]string{},
+		drafts:      map[int]*SettingsDraft{},
+		ads:         map[int]*memoryAd{},
+		impressions: map[memoryImpressionKey]int{},
+		advertisers: map[int]*Advertiser{},
+		campaigns:   map[int]*Campaign{},
+		sites: map[int]*Site{
+			defaultSiteID: {ID: defaultSiteID, Slug: "default", Name: "Nuanu", Hostnames: []string{}, Gateways: []string{}, CreatedAt: time.Now()},
+		},
+		adminSites:  map[string][]int{},
+		adminHashes: map[string]string{},
+		media:       map[int]*Media{},
+		themes:      map[string]*StoredTheme{},
+	}
+}
+
+// id hands out the next row id; one sequence for every table is enough here
+func (m *MemoryStore) id() int {
+	m.nextID++
+	return m.nextID
+}
+
+// Ping always succeeds: there is nothing to reach
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// ---- Settings ----
+
+func (m *MemoryStore) Settings(siteID int) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return copySettings(m.settings[siteID]), nil
+}
+
+func (m *MemoryStore) SaveSettings(siteID int, changes map[string]*string, author, reason string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saveSettings(siteID, changes, author, reason), nil
+}
+
+func (m *MemoryStore) saveSettings(siteID int, changes map[string]*string, author, reason string) int {
+	current := m.lockSettings(siteID)
+	set, removed := applySettingChanges(current, changes)
+	if len(set) == 0 && len(removed) == 0 {
+		return 0
+	}
+	m.settings[siteID] = current
+	return m.insertRevision(siteID, current, author, reason, nil)
+}
+
+// lockSettings returns a copy of the site's live settings, recording them as
+// the baseline revision on the site's first write
+func (m *MemoryStore) lockSettings(siteID int) map[string]string {
+	current := copySettings(m.settings[siteID])
+	if len(current) == 0 {
+		return current
+	}
+	for _, rev := range m.revisions {
+		if rev.SiteID == siteID {
+			return current
+		}
+	}
+	m.insertRevision(siteID, current, "system", "baseline", nil)
+	return current
+}
+
+func (m *MemoryStore) insertRevision(siteID int, settings map[string]string, author, reason string, restoredFrom *int) int {
+	rev := SettingsRevision{
+		ID:           m.id(),
+		SiteID:       siteID,
+		Author:       author,
+		Reason:       reason,
+		RestoredFrom: restoredFrom,
+		CreatedAt:    time.Now(),
+		Settings:     copySettings(settings),
+	}
+	m.revisions = append(m.revisions, rev)
+	return rev.ID
+}
+
+func (m *MemoryStore) RestoreSettings(siteID, revisionID int, author string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lockSettings(siteID)
+	rev := m.revision(siteID, revisionID)
+	if rev == nil {
+		return 0, errRevisionNotFound
+	}
+	m.settings[siteID] = copySettings(rev.Settings)
+	from := revisionID
+	return m.insertRevision(siteID, rev.Settings, author, "restore", &from), nil
+}
+
+func (m *MemoryStore) revision(siteID, id int) *SettingsRevision {
+	for i := range m.revisions {
+		if m.revisions[i].ID == id && m.revisions[i].SiteID == siteID {
+			return &m.revisions[i]
+		}
+	}
+	return nil
+}
+
+func copyRevision(rev SettingsRevision) SettingsRevision {
+	rev.Settings = copySettings(rev.Settings)
+	return rev
+}
+
+func (m *MemoryStore) SettingsRevisions(siteID, limit, offset int) ([]SettingsRevision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	revisions := []SettingsRevision{}
+	for i := len(m.revisions) - 1; i >= 0; i-- {
+		if m.revisions[i].SiteID != siteID {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(revisions) == limit {
+			break
+		}
+		revisions = append(revisions, copyRevision(m.revisions[i]))
+	}
+	return revisions, nil
+}
+
+func (m *MemoryStore) SettingsRevision(siteID, id int) (*SettingsRevision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rev := m.revision(siteID, id)
+	if rev == nil {
+		return nil, nil
+	}
+	out := copyRevision(*rev)
+	return &out, nil
+}
+
+// ---- Settings drafts ----
+
+func copyDraft(d *SettingsDraft) *SettingsDraft {
+	if d == nil {
+		return nil
+	}
+	out := *d
+	out.Settings = copySettings(d.Settings)
+	if d.PublishAt != nil {
+		at := *d.PublishAt
+		out.PublishAt = &at
+	}
+	return &out
+}
+
+func (m *MemoryStore) SettingsDraft(siteID int) (*SettingsDraft, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return copyDraft(m.drafts[siteID]), nil
+}
+
+func (m *MemoryStore) SettingsDraftByToken(token string) (*SettingsDraft, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range m.drafts {
+		if d.PreviewToken == token {
+			return copyDraft(d), nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) StageSettingsDraft(siteID int, values map[string]string, author string) (*SettingsDraft, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.drafts[siteID]
+	if d == nil {
+		d = &SettingsDraft{SiteID: siteID, Settings: map[string]string{}, PreviewToken: newPreviewToken()}
+		m.drafts[siteID] = d
+	}
+	for key, value := range values {
+		d.Settings[key] = value
+	}
+	d.UpdatedBy = author
+	d.UpdatedAt = time.Now()
+	return copyDraft(d), nil
+}
+
+func (m *MemoryStore) ScheduleSettingsDraft(siteID int, publishAt *time.Time, author string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.drafts[siteID]
+	if d == nil {
+		return false, nil
+	}
+	d.PublishAt = publishAt
+	d.UpdatedBy = author
+	d.UpdatedAt = time.Now()
+	return true, nil
+}
+
+func (m *MemoryStore) DiscardSettingsDraft(siteID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.drafts[siteID]
+	delete(m.drafts, siteID)
+	return ok, nil
+}
+
+func (m *MemoryStore) PublishSettingsDraft(siteID int, author string, onlyDue bool) (int, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.drafts[siteID]
+	if d == nil {
+		return 0, false, nil
+	}
+	if onlyDue && (d.PublishAt == nil || d.PublishAt.After(time.Now())) {
+		return 0, false, nil
+	}
+	revision := m.saveSettings(siteID, settingValues(d.Settings), author, "publish")
+	delete(m.drafts, siteID)
+	return revision, true, nil
+}
+
+func (m *MemoryStore) DueSettingsDrafts() ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	now := time.Now()
+	for siteID, d := range m.drafts {
+		if d.PublishAt != nil && !d.PublishAt.After(now) {
+			ids = append(ids, siteID)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// ---- Ads ----
+
+// sortedAds lists a site's ads newest first
+func (m *MemoryStore) sortedAds(siteID int) []*memoryAd {
+	var ads []*memoryAd
+	for _, ad := range m.ads {
+		if ad.siteID == siteID {
+			ads = append(ads, ad)
+		}
+	}
+	sort.Slice(ads, func(i, j int) bool {
+		if !ads[i].CreatedAt.Equal(ads[j].CreatedAt) {
+			return ads[i].CreatedAt.After(ads[j].CreatedAt)
+		}
+		return ads[i].ID > ads[j].ID
+	})
+	return ads
+}
+
+func (m *MemoryStore) Ads(siteID int) ([]ScheduledAd, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ads := []ScheduledAd{}
+	for _, ad := range m.sortedAds(siteID) {
+		ads = append(ads, ad.ScheduledAd)
+	}
+	return ads, nil
+}
+
+func (m *MemoryStore) Ad(siteID, id int) (*ScheduledAd, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ad, ok := m.ads[id]
+	if !ok || ad.siteID != siteID {
+		return nil, nil
+	}
+	out := ad.ScheduledAd
+	return &out, nil
+}
+
+func (m *MemoryStore) CreateAd(siteID int, ad *ScheduledAd) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ad.ID = m.id()
+	ad.CreatedAt = time.Now()
+	stored := *ad
+	stored.ImageVariants = nil
+	m.ads[ad.ID] = &memoryAd{ScheduledAd: stored, siteID: siteID, translations: map[string]AdTranslation{}}
+	return nil
+}
+
+func (m *MemoryStore) UpdateAd(siteID int, ad ScheduledAd) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.ads[ad.ID]
+	if !ok || stored.siteID != siteID {
+		return false, nil
+	}
+	ad.CreatedAt = stored.CreatedAt
+	ad.ImageVariants = nil
+	stored.ScheduledAd = ad
+	return true, nil
+}
+
+func (m *MemoryStore) DeleteAd(siteID, id int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ad, ok := m.ads[id]
+	if !ok || ad.siteID != siteID {
+		return false, nil
+	}
+	delete(m.ads, id)
+	return true, nil
+}
+
+func (m *MemoryStore) ActiveAd(siteID int, date, clock string) (*ScheduledAd, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, ad := range m.sortedAds(siteID) {
+		if m.adIsActive(ad.ScheduledAd, date, clock) {
+			out := ad.ScheduledAd
+			return &out, nil
+		}
+	}
+	return nil, nil
+}
+
+// adIsActive is the WHERE clause of the Postgres ActiveAd query; the dates and
+// times are zero padded, so comparing them as strings orders them correctly
+func (m *MemoryStore) adIsActive(ad ScheduledAd, date, clock string) bool {
+	within := func(value, from, to string) bool {
+		return (from == "" || from <= value) && (to == "" || to >= value)
+	}
+	if !ad.IsActive || !within(date, ad.StartDate, ad.EndDate) || !within(clock, ad.StartTime, ad.EndTime) {
+		return false
+	}
+	if ad.CampaignID != nil {
+		if c, ok := m.campaigns[*ad.CampaignID]; ok && !within(date, c.StartDate, c.EndDate) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *MemoryStore) AdTranslations(adID int) (map[string]AdTranslation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	translations := map[string]AdTranslation{}
+	if ad, ok := m.ads[adID]; ok {
+		for locale, t := range ad.translations {
+			translations[locale] = t
+		}
+	}
+	return translations, nil
+}
+
+func (m *MemoryStore) SaveAdTranslation(adID int, locale string, t AdTranslation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ad, ok := m.ads[adID]; ok {
+		ad.translations[locale] = t
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteAdTranslation(adID int, locale string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ad, ok := m.ads[adID]
+	if !ok {
+		return false, nil
+	}
+	_, ok = ad.translations[locale]
+	delete(ad.translations, locale)
+	return ok, nil
+}
+
+func (m *MemoryStore) RecordImpression(ad ScheduledAd, day string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.impressions[memoryImpressionKey{adID: ad.ID, campaignID: impressionCampaign(ad.CampaignID), day: day}]++
+	return nil
+}
+
+// ---- Advertisers and campaigns ----
+
+func (m *MemoryStore) Advertisers() ([]Advertiser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	advertisers := []Advertiser{}
+	for _, a := range m.advertisers {
+		advertisers = append(advertisers, *a)
+	}
+	sort.Slice(advertisers, func(i, j int) bool { return advertisers[i].Name < advertisers[j].Name })
+	return advertisers, nil
+}
+
+func (m *MemoryStore) Advertiser(id int) (*Advertiser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.advertisers[id]
+	if !ok {
+		return nil, nil
+	}
+	out := *a
+	return &out, nil
+}
+
+func (m *MemoryStore) CreateAdvertiser(a *Advertiser) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a.ID = m.id()
+	a.CreatedAt = time.Now()
+	stored := *a
+	m.advertisers[a.ID] = &stored
+	return nil
+}
+
+func (m *MemoryStore) UpdateAdvertiser(a Advertiser) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.advertisers[a.ID]
+	if !ok {
+		return false, nil
+	}
+	a.CreatedAt = stored.CreatedAt
+	*stored = a
+	return true, nil
+}
+
+func (m *MemoryStore) DeleteAdvertiser(id int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.advertisers[id]; !ok {
+		return false, nil
+	}
+	delete(m.advertisers, id)
+	for _, c := range m.campaigns {
+		if c.AdvertiserID == id {
+			m.deleteCampaign(c.ID)
+		}
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) campaign(c *Campaign) Campaign {
+	out := *c
+	if a, ok := m.advertisers[c.AdvertiserID]; ok {
+		out.AdvertiserName = a.Name
+	}
+	return out
+}
+
+func (m *MemoryStore) Campaigns(advertiserID int) ([]Campaign, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	campaigns := []Campaign{}
+	for _, c := range m.campaigns {
+		if advertiserID == 0 || c.AdvertiserID == advertiserID {
+			campaigns = append(campaigns, m.campaign(c))
+		}
+	}
+	sort.Slice(campaigns, func(i, j int) bool { return campaigns[i].ID > campaigns[j].ID })
+	return campaigns, nil
+}
+
+func (m *MemoryStore) Campaign(id int) (*Campaign, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.campaigns[id]
+	if !ok {
+		return nil, nil
+	}
+	out := m.campaign(c)
+	return &out, nil
+}
+
+func (m *MemoryStore) CreateCampaign(c *Campaign) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c.ID = m.id()
+	c.CreatedAt = time.Now()
+	stored := *c
+	stored.AdvertiserName = ""
+	m.campaigns[c.ID] = &stored
+	return nil
+}
+
+func (m *MemoryStore) UpdateCampaign(c Campaign) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.campaigns[c.ID]
+	if !ok {
+		return false, nil
+	}
+	c.CreatedAt = stored.CreatedAt
+	c.AdvertiserName = ""
+	*stored = c
+	return true, nil
+}
+
+func (m *MemoryStore) DeleteCampaign(id int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.campaigns[id]; !ok {
+		return false, nil
+	}
+	m.deleteCampaign(id)
+	return true, nil
+}
+
+// deleteCampaign removes a campaign and detaches its ads
+func (m *MemoryStore) deleteCampaign(id int) {
+	delete(m.campaigns, id)
+	for _, ad := range m.ads {
+		if ad.CampaignID != nil && *ad.CampaignID == id {
+			ad.CampaignID = nil
+		}
+	}
+}
+
+func (m *MemoryStore) CampaignDelivery(id int) ([]AdDelivery, []DailyDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	perAd := map[int]int{}
+	perDay := map[string]int{}
+	for key, n := range m.impressions {
+		if key.campaignID != id {
+			continue
+		}
+		perAd[key.adID] += n
+		perDay[key.day] += n
+	}
+
+	ads := []AdDelivery{}
+	for adID, n := range perAd {
+		title := "(deleted ad)"
+		if ad, ok := m.ads[adID]; ok {
+			title = ad.Title
+		}
+		ads = append(ads, AdDelivery{AdID: adID, Title: title, Impressions: n})
+	}
+	sort.Slice(ads, func(i, j int) bool {
+		if ads[i].Impressions != ads[j].Impressions {
+			return ads[i].Impressions > ads[j].Impressions
+		}
+		return ads[i].AdID < ads[j].AdID
+	})
+
+	days := []DailyDelivery{}
+	for day, n := range perDay {
+		days = append(days, DailyDelivery{Date: day, Impressions: n})
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return ads, days, nil
+}
+
+// ---- Emails ----
+
+func (m *MemoryStore) SaveEmail(siteID int, email, source string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.emails {
+		if e.siteID == siteID && e.Email == email {
+			return nil
+		}
+	}
+	m.emails = append(m.emails, memoryEmail{
+		CollectedEmail: CollectedEmail{ID: m.id(), Email: email, Source: source, CreatedAt: time.Now()},
+		siteID:         siteID,
+	})
+	return nil
+}
+
+func (m *MemoryStore) Emails(siteID int) ([]CollectedEmail, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var emails []CollectedEmail
+	for i := len(m.emails) - 1; i >= 0; i-- {
+		if m.emails[i].siteID == siteID {
+			emails = append(emails, m.emails[i].CollectedEmail)
+		}
+	}
+	return emails, nil
+}
+
+// ---- Sites ----
+
+func copySite(site Site) Site {
+	site.Hostnames = append([]string{}, site.Hostnames...)
+	site.Gateways = append([]string{}, site.Gateways...)
+	return site
+}
+
+func (m *MemoryStore) Sites() ([]Site, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sites := []Site{}
+	for _, site := range m.sites {
+		sites = append(sites, copySite(*site))
+	}
+	sort.Slice(sites, func(i, j int) bool { return sites[i].ID < sites[j].ID })
+	return sites, nil
+}
+
+func (m *MemoryStore) CreateSite(site *Site) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	site.ID = m.id()
+	site.CreatedAt = time.Now()
+	stored := copySite(*site)
+	m.sites[site.ID] = &stored
+	return nil
+}
+
+func (m *MemoryStore) UpdateSite(site Site) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.sites[site.ID]
+	if !ok {
+		return false, nil
+	}
+	site.CreatedAt = stored.CreatedAt
+	*stored = copySite(site)
+	return true, nil
+}
+
+func (m *MemoryStore) DeleteSite(id int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sites[id]; !ok {
+		return false, nil
+	}
+	delete(m.sites, id)
+	delete(m.settings, id)
+	delete(m.drafts, id)
+
+	revisions := m.revisions[:0]
+	for _, rev := range m.revisions {
+		if rev.SiteID != id {
+			revisions = append(revisions, rev)
+		}
+	}
+	m.revisions = revisions
+
+	for adID, ad := range m.ads {
+		if ad.siteID == id {
+			delete(m.ads, adID)
+		}
+	}
+
+	emails := m.emails[:0]
+	for _, e := range m.emails {
+		if e.siteID != id {
+			emails = append(emails, e)
+		}
+	}
+	m.emails = emails
+
+	for username, ids := range m.adminSites {
+		kept := []int{}
+		for _, siteID := range ids {
+			if siteID != id {
+				kept = append(kept, siteID)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.adminSites, username)
+		} else {
+			m.adminSites[username] = kept
+		}
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) AdminSiteIDs(username string) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := m.adminSites[username]
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return append([]int{}, ids...), nil
+}
+
+func (m *MemoryStore) AdminSiteAccess() (map[string][]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	access := map[string][]int{}
+	for username, ids := range m.adminSites {
+		access[username] = append([]int{}, ids...)
+	}
+	return access, nil
+}
+
+func (m *MemoryStore) SetAdminSiteIDs(username string, siteIDs []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := map[int]bool{}
+	ids := []int{}
+	for _, id := range siteIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	if len(ids) == 0 {
+		delete(m.adminSites, username)
+	} else {
+		m.adminSites[username] = ids
+	}
+	return nil
+}
+
+func (m *MemoryStore) AdminPasswordHash(username string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.adminHashes[username], nil
+}
+
+func (m *MemoryStore) SetAdminPasswordHash(username, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.adminHashes[username] = hash
+	return nil
+}
+
+// ---- Media ----
+
+func copyMedia(item Media) Media {
+	item.Keys = append([]string{}, item.Keys...)
+	item.Tags = append([]string{}, item.Tags...)
+	return item
+}
+
+// mediaWhere returns the first entry (by id) that matches
+func (m *MemoryStore) mediaWhere(match func(*Media) bool) (*Media, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var found *Media
+	for _, item := range m.media {
+		if match(item) && (found == nil || item.ID < found.ID) {
+			found = item
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	out := copyMedia(*found)
+	return &out, nil
+}
+
+func (m *MemoryStore) MediaByID(id int) (*Media, error) {
+	return m.mediaWhere(func(item *Media) bool { return item.ID == id })
+}
+
+func (m *MemoryStore) MediaByHash(hash string) (*Media, error) {
+	return m.mediaWhere(func(item *Media) bool { return item.Hash == hash })
+}
+
+func (m *MemoryStore) MediaByURL(url string) (*Media, error) {
+	return m.mediaWhere(func(item *Media) bool { return item.URL == url })
+}
+
+func (m *MemoryStore) ListMedia(f MediaFilter) ([]Media, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	search := strings.ToLower(f.Search)
+	items := []Media{}
+	for _, item := range m.media {
+		if f.Tag != "" && !containsString(item.Tags, f.Tag) {
+			continue
+		}
+		if f.Type != "" && !strings.HasPrefix(item.ContentType, f.Type) {
+			continue
+		}
+		if search != "" &&
+			!strings.Contains(strings.ToLower(item.OriginalName), search) &&
+			!strings.Contains(strings.ToLower(strings.Join(item.Tags, ",")), search) {
+			continue
+		}
+		items = append(items, copyMedia(*item))
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].CreatedAt.Equal(items[j].CreatedAt) {
+			return items[i].CreatedAt.After(items[j].CreatedAt)
+		}
+		return items[i].ID > items[j].ID
+	})
+
+	if f.Limit > 0 {
+		if f.Offset >= len(items) {
+			return []Media{}, nil
+		}
+		items = items[f.Offset:]
+		if len(items) > f.Limit {
+			items = items[:f.Limit]
+		}
+	}
+	return items, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) SaveMedia(item *Media) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, stored := range m.media {
+		if stored.Hash != item.Hash {
+			continue
+		}
+		// Same file again: refresh where it lives but keep its identity and tags
+		stored.URL = item.URL
+		stored.Keys = append([]string{}, item.Keys...)
+		stored.ContentType = item.ContentType
+		stored.Size = item.Size
+		stored.Width = item.Width
+		stored.Height = item.Height
+		stored.Variants = item.Variants
+		item.ID = stored.ID
+		item.CreatedAt = stored.CreatedAt
+		return nil
+	}
+
+	item.ID = m.id()
+	item.CreatedAt = time.Now()
+	stored := copyMedia(*item)
+	stored.InUse = false
+	m.media[item.ID] = &stored
+	return nil
+}
+
+func (m *MemoryStore) SetMediaTags(id int, tags []string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.media[id]
+	if !ok {
+		return false, nil
+	}
+	item.Tags = append([]string{}, tags...)
+	return true, nil
+}
+
+func (m *MemoryStore) RemoveMedia(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.media, id)
+	return nil
+}
+
+func (m *MemoryStore) ImageReferences() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var refs []string
+	for _, values := range m.settings {
+		for _, v := range values {
+			refs = append(refs, v)
+		}
+	}
+	for _, ad := range m.ads {
+		refs = append(refs, ad.Image)
+	}
+	for _, rev := range m.revisions {
+		if v, ok := rev.Settings["background_image"]; ok {
+			refs = append(refs, v)
+		}
+	}
+	for _, d := range m.drafts {
+		refs = append(refs, d.Settings["background_image"])
+	}
+	return refs, nil
+}
+
+// ---- Themes ----
+
+func (m *MemoryStore) ThemeNames() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := []string{}
+	for name := range m.themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemoryStore) ThemeArchive(name string) (*StoredTheme, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.themes[name]
+	if !ok {
+		return nil, nil
+	}
+	out := *t
+	return &out, nil
+}
+
+func (m *MemoryStore) SaveTheme(t StoredTheme) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t.CreatedAt = time.Now()
+	m.themes[t.Name] = &t
+	return nil
+}
+
+func (m *MemoryStore) DeleteTheme(name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.themes[name]
+	delete(m.themes, name)
+	return ok, nil
+}
+
+func (m *MemoryStore) ThemeSites(name string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := []string{}
+	for siteID, values := range m.settings {
+		if site, ok := m.sites[siteID]; ok && values["portal_theme"] == name {
+			names = append(names, site.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// compile-time check that the in-memory store is complete
+var _ Store = (*MemoryStore)(nil)
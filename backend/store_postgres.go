@@ -0,0 +1,1123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// settingsLockID serialises every write to a site's page_settings (saves,
+// restores) so each revision is an exact snapshot of what was live after it
+const settingsLockID = 7310001
+
+// PostgresStore is the Store on the production Postgres database. Settings
+// and site changes are announced with NOTIFY so every instance drops its caches.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type rowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// ---- Settings ----
+
+func (s *PostgresStore) Settings(siteID int) (map[string]string, error) {
+	return loadSettingsMap(s.db, siteID)
+}
+
+func loadSettingsMap(q queryer, siteID int) (map[string]string, error) {
+	rows, err := q.Query("SELECT key, COALESCE(value, '') FROM page_settings WHERE site_id = $1", siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		settings[key] = value
+	}
+	return settings, rows.Err()
+}
+
+func (s *PostgresStore) SaveSettings(siteID int, changes map[string]*string, author, reason string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := saveSettingsTx(tx, siteID, changes, author, reason)
+	if err != nil || id == 0 {
+		return id, err
+	}
+	return id, tx.Commit()
+}
+
+// saveSettingsTx is SaveSettings inside a caller's transaction
+func saveSettingsTx(tx *sql.Tx, siteID int, changes map[string]*string, author, reason string) (int, error) {
+	current, err := lockSettings(tx, siteID)
+	if err != nil {
+		return 0, err
+	}
+
+	set, removed := applySettingChanges(current, changes)
+	if len(set) == 0 && len(removed) == 0 {
+		return 0, nil
+	}
+	for _, key := range removed {
+		if _, err := tx.Exec("DELETE FROM page_settings WHERE site_id = $1 AND key = $2", siteID, key); err != nil {
+			return 0, err
+		}
+	}
+	for key, value := range set {
+		if err := upsertSetting(tx, siteID, key, value); err != nil {
+			return 0, err
+		}
+	}
+	if err := notifySettingsChanged(tx, siteID); err != nil {
+		return 0, err
+	}
+	return insertRevision(tx, siteID, current, author, reason, nil)
+}
+
+// lockSettings takes the site's settings write lock and returns its live
+// key/values. The site's first write ever also records the pre-existing state
+// as a baseline revision, so the settings from before versioning can be
+// restored too.
+func lockSettings(tx *sql.Tx, siteID int) (map[string]string, error) {
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1, $2)", settingsLockID, siteID); err != nil {
+		return nil, err
+	}
+	return settingsForWrite(tx, siteID)
+}
+
+// settingsForWrite is lockSettings once the lock is held
+func settingsForWrite(tx *sql.Tx, siteID int) (map[string]string, error) {
+	current, err := loadSettingsMap(tx, siteID)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM settings_revisions WHERE site_id = $1", siteID).Scan(&revisions); err != nil {
+		return nil, err
+	}
+	if revisions == 0 && len(current) > 0 {
+		if _, err := insertRevision(tx, siteID, current, "system", "baseline", nil); err != nil {
+			return nil, err
+		}
+	}
+	return current, nil
+}
+
+func upsertSetting(tx *sql.Tx, siteID int, key, value string) error {
+	_, err := tx.Exec(`
+		INSERT INTO page_settings (site_id, key, value, updated_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (site_id, key) DO UPDATE SET value = $3, updated_at = NOW()
+	`, siteID, key, value)
+	return err
+}
+
+func insertRevision(tx *sql.Tx, siteID int, settings map[string]string, author, reason string, restoredFrom *int) (int, error) {
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO settings_revisions (site_id, settings, author, reason, restored_from)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id
+	`, siteID, string(raw), author, reason, restoredFrom).Scan(&id)
+	return id, err
+}
+
+// notifySettingsChanged tells every instance (this one included) to drop its
+// cached settings for the site once the transaction commits
+func notifySettingsChanged(tx *sql.Tx, siteID int) error {
+	_, err := tx.Exec("SELECT pg_notify($1, $2)", settingsChannel, strconv.Itoa(siteID))
+	return err
+}
+
+func (s *PostgresStore) RestoreSettings(siteID, revisionID int, author string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockSettings(tx, siteID); err != nil {
+		return 0, err
+	}
+
+	var raw string
+	err = tx.QueryRow("SELECT settings FROM settings_revisions WHERE id = $1 AND site_id = $2", revisionID, siteID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return 0, errRevisionNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	var snapshot map[string]string
+	if err := json.Unmarshal([]byte(raw), &snapshot); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM page_settings WHERE site_id = $1", siteID); err != nil {
+		return 0, err
+	}
+	for key, value := range snapshot {
+		if err := upsertSetting(tx, siteID, key, value); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := notifySettingsChanged(tx, siteID); err != nil {
+		return 0, err
+	}
+	id, err := insertRevision(tx, siteID, snapshot, author, "restore", &revisionID)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+const revisionColumns = "id, site_id, settings, author, reason, restored_from, created_at"
+
+func scanRevision(row rowScanner) (SettingsRevision, error) {
+	var rev SettingsRevision
+	var raw string
+	var author, reason sql.NullString
+	var restoredFrom sql.NullInt64
+	if err := row.Scan(&rev.ID, &rev.SiteID, &raw, &author, &reason, &restoredFrom, &rev.CreatedAt); err != nil {
+		return rev, err
+	}
+	rev.Author = author.String
+	rev.Reason = reason.String
+	if restoredFrom.Valid {
+		from := int(restoredFrom.Int64)
+		rev.RestoredFrom = &from
+	}
+	err := json.Unmarshal([]byte(raw), &rev.Settings)
+	return rev, err
+}
+
+func (s *PostgresStore) SettingsRevisions(siteID, limit, offset int) ([]SettingsRevision, error) {
+	rows, err := s.db.Query("SELECT "+revisionColumns+" FROM settings_revisions WHERE site_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3", siteID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []SettingsRevision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+func (s *PostgresStore) SettingsRevision(siteID, id int) (*SettingsRevision, error) {
+	rev, err := scanRevision(s.db.QueryRow("SELECT "+revisionColumns+" FROM settings_revisions WHERE id = $1 AND site_id = $2", id, siteID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// ---- Settings drafts ----
+
+// loadDraft returns a site's current draft, nil when there is none
+func loadDraft(q rowQueryer, siteID int, forUpdate bool) (*SettingsDraft, error) {
+	query := "SELECT settings, preview_token, publish_at, updated_by, updated_at FROM settings_draft WHERE site_id = $1"
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	d := SettingsDraft{SiteID: siteID}
+	var raw string
+	var publishAt sql.NullTime
+	var updatedBy sql.NullString
+	err := q.QueryRow(query, siteID).Scan(&raw, &d.PreviewToken, &publishAt, &updatedBy, &d.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(raw), &d.Settings); err != nil {
+		return nil, err
+	}
+	if publishAt.Valid {
+		d.PublishAt = &publishAt.Time
+	}
+	d.UpdatedBy = updatedBy.String
+	return &d, nil
+}
+
+func (s *PostgresStore) SettingsDraft(siteID int) (*SettingsDraft, error) {
+	return loadDraft(s.db, siteID, false)
+}
+
+func (s *PostgresStore) SettingsDraftByToken(token string) (*SettingsDraft, error) {
+	var siteID int
+	err := s.db.QueryRow("SELECT site_id FROM settings_draft WHERE preview_token = $1", token).Scan(&siteID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loadDraft(s.db, siteID, false)
+}
+
+// StageSettingsDraft creates the draft row first, so that concurrent first
+// stages queue on its lock and merge into each other instead of one
+// overwriting the other; the preview token returned is always the stored one
+func (s *PostgresStore) StageSettingsDraft(siteID int, values map[string]string, author string) (*SettingsDraft, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO settings_draft (site_id, settings, preview_token, updated_by, updated_at)
+		VALUES ($1, '{}', $2, $3, NOW())
+		ON CONFLICT (site_id) DO NOTHING
+	`, siteID, newPreviewToken(), author)
+	if err != nil {
+		return nil, err
+	}
+	// The row exists now and is locked until this transaction ends
+	d, err := loadDraft(tx, siteID, true)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		d.Settings[key] = value
+	}
+	d.UpdatedBy = author
+
+	raw, _ := json.Marshal(d.Settings)
+	err = tx.QueryRow(`
+		UPDATE settings_draft SET settings = $1, updated_by = $2, updated_at = NOW()
+		WHERE site_id = $3
+		RETURNING updated_at
+	`, string(raw), d.UpdatedBy, siteID).Scan(&d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return d, tx.Commit()
+}
+
+func (s *PostgresStore) ScheduleSettingsDraft(siteID int, publishAt *time.Time, author string) (bool, error) {
+	res, err := s.db.Exec("UPDATE settings_draft SET publish_at = $1, updated_by = $2, updated_at = NOW() WHERE site_id = $3", publishAt, author, siteID)
+	return affected(res, err)
+}
+
+func (s *PostgresStore) DiscardSettingsDraft(siteID int) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM settings_draft WHERE site_id = $1", siteID))
+}
+
+// PublishSettingsDraft holds the draft's row lock throughout, so only one
+// instance publishes a scheduled draft
+func (s *PostgresStore) PublishSettingsDraft(siteID int, author string, onlyDue bool) (int, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	d, err := loadDraft(tx, siteID, true)
+	if err != nil || d == nil {
+		return 0, false, err
+	}
+	if onlyDue && (d.PublishAt == nil || d.PublishAt.After(time.Now())) {
+		return 0, false, nil
+	}
+
+	revision, err := saveSettingsTx(tx, siteID, settingValues(d.Settings), author, "publish")
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := tx.Exec("DELETE FROM settings_draft WHERE site_id = $1", siteID); err != nil {
+		return 0, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return revision, true, nil
+}
+
+func (s *PostgresStore) DueSettingsDrafts() ([]int, error) {
+	return scanIDs(s.db.Query("SELECT site_id FROM settings_draft WHERE publish_at <= NOW()"))
+}
+
+// ---- Ads ----
+
+const adColumns = "id, title, description, image, link, start_date, end_date, start_time, end_time, is_active, campaign_id, created_at"
+
+func scanAd(row rowScanner) (ScheduledAd, error) {
+	var ad ScheduledAd
+	var description, image, link, sd, ed, st, et sql.NullString
+	var active sql.NullBool
+	var cid sql.NullInt64
+	var createdAt sql.NullTime
+	if err := row.Scan(&ad.ID, &ad.Title, &description, &image, &link, &sd, &ed, &st, &et, &active, &cid, &createdAt); err != nil {
+		return ad, err
+	}
+	ad.Description = description.String
+	ad.Image = image.String
+	ad.Link = link.String
+	ad.StartDate = sd.String
+	ad.EndDate = ed.String
+	ad.StartTime = st.String
+	ad.EndTime = et.String
+	ad.IsActive = active.Bool
+	if cid.Valid {
+		id := int(cid.Int64)
+		ad.CampaignID = &id
+	}
+	ad.CreatedAt = createdAt.Time
+	return ad, nil
+}
+
+func (s *PostgresStore) Ads(siteID int) ([]ScheduledAd, error) {
+	rows, err := s.db.Query("SELECT "+adColumns+" FROM scheduled_ads WHERE site_id = $1 ORDER BY created_at DESC", siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ads := []ScheduledAd{}
+	for rows.Next() {
+		ad, err := scanAd(rows)
+		if err != nil {
+			return nil, err
+		}
+		ads = append(ads, ad)
+	}
+	return ads, rows.Err()
+}
+
+func (s *PostgresStore) Ad(siteID, id int) (*ScheduledAd, error) {
+	ad, err := scanAd(s.db.QueryRow("SELECT "+adColumns+" FROM scheduled_ads WHERE id = $1 AND site_id = $2", id, siteID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ad, nil
+}
+
+func (s *PostgresStore) CreateAd(siteID int, ad *ScheduledAd) error {
+	return s.db.QueryRow(`
+		INSERT INTO scheduled_ads (title, description, image, link, start_date, end_date, start_time, end_time, is_active, campaign_id, site_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id, created_at
+	`, ad.Title, ad.Description, ad.Image, nullIfEmpty(ad.Link),
+		nullIfEmpty(ad.StartDate), nullIfEmpty(ad.EndDate),
+		nullIfEmpty(ad.StartTime), nullIfEmpty(ad.EndTime), ad.IsActive, ad.CampaignID, siteID).Scan(&ad.ID, &ad.CreatedAt)
+}
+
+func (s *PostgresStore) UpdateAd(siteID int, ad ScheduledAd) (bool, error) {
+	return affected(s.db.Exec(`
+		UPDATE scheduled_ads
+		SET title = $1, description = $2, image = $3, link = $4, start_date = $5, end_date = $6, start_time = $7, end_time = $8, is_active = $9, campaign_id = $10
+		WHERE id = $11 AND site_id = $12
+	`, ad.Title, ad.Description, ad.Image, nullIfEmpty(ad.Link),
+		nullIfEmpty(ad.StartDate), nullIfEmpty(ad.EndDate),
+		nullIfEmpty(ad.StartTime), nullIfEmpty(ad.EndTime), ad.IsActive, ad.CampaignID, ad.ID, siteID))
+}
+
+func (s *PostgresStore) DeleteAd(siteID, id int) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM scheduled_ads WHERE id = $1 AND site_id = $2", id, siteID))
+}
+
+func (s *PostgresStore) ActiveAd(siteID int, date, clock string) (*ScheduledAd, error) {
+	// Ads attached to a campaign are only served inside the campaign's flight window
+	ad, err := scanAd(s.db.QueryRow(`
+		SELECT a.id, a.title, a.description, a.image, a.link, a.start_date, a.end_date, a.start_time, a.end_time, a.is_active, a.campaign_id, a.created_at
+		FROM scheduled_ads a
+		LEFT JOIN ad_campaigns c ON c.id = a.campaign_id
+		WHERE a.site_id = $3 AND a.is_active = TRUE
+		AND (a.start_date IS NULL OR a.start_date <= $1)
+		AND (a.end_date IS NULL OR a.end_date >= $1)
+		AND (a.start_time IS NULL OR a.start_time <= $2)
+		AND (a.end_time IS NULL OR a.end_time >= $2)
+		AND (c.start_date IS NULL OR c.start_date <= $1)
+		AND (c.end_date IS NULL OR c.end_date >= $1)
+		ORDER BY a.created_at DESC LIMIT 1
+	`, date, clock, siteID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ad, nil
+}
+
+func (s *PostgresStore) AdTranslations(adID int) (map[string]AdTranslation, error) {
+	rows, err := s.db.Query("SELECT locale, title, description FROM ad_translations WHERE ad_id = $1", adID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := map[string]AdTranslation{}
+	for rows.Next() {
+		var locale string
+		var title, description sql.NullString
+		if err := rows.Scan(&locale, &title, &description); err != nil {
+			return nil, err
+		}
+		translations[locale] = AdTranslation{Title: title.String, Description: description.String}
+	}
+	return translations, rows.Err()
+}
+
+func (s *PostgresStore) SaveAdTranslation(adID int, locale string, t AdTranslation) error {
+	_, err := s.db.Exec(`
+		INSERT INTO ad_translations (ad_id, locale, title, description, updated_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (ad_id, locale) DO UPDATE SET title = $3, description = $4, updated_at = NOW()
+	`, adID, locale, t.Title, t.Description)
+	return err
+}
+
+func (s *PostgresStore) DeleteAdTranslation(adID int, locale string) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM ad_translations WHERE ad_id = $1 AND locale = $2", adID, locale))
+}
+
+// impressionCampaign is the campaign_id of an impression row; being part of
+// the key it is 0 rather than NULL for ads without a campaign
+func impressionCampaign(campaignID *int) int {
+	if campaignID == nil {
+		return 0
+	}
+	return *campaignID
+}
+
+func (s *PostgresStore) RecordImpression(ad ScheduledAd, day string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO ad_impressions (ad_id, campaign_id, day, impressions)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (ad_id, campaign_id, day) DO UPDATE SET impressions = ad_impressions.impressions + 1
+	`, ad.ID, impressionCampaign(ad.CampaignID), day)
+	return err
+}
+
+// ---- Advertisers and campaigns ----
+
+const advertiserColumns = "id, name, contact_name, contact_email, created_at"
+
+func scanAdvertiser(row rowScanner) (Advertiser, error) {
+	var a Advertiser
+	var contactName, contactEmail sql.NullString
+	err := row.Scan(&a.ID, &a.Name, &contactName, &contactEmail, &a.CreatedAt)
+	a.ContactName = contactName.String
+	a.ContactEmail = contactEmail.String
+	return a, err
+}
+
+func (s *PostgresStore) Advertisers() ([]Advertiser, error) {
+	rows, err := s.db.Query("SELECT " + advertiserColumns + " FROM advertisers ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	advertisers := []Advertiser{}
+	for rows.Next() {
+		a, err := scanAdvertiser(rows)
+		if err != nil {
+			return nil, err
+		}
+		advertisers = append(advertisers, a)
+	}
+	return advertisers, rows.Err()
+}
+
+func (s *PostgresStore) Advertiser(id int) (*Advertiser, error) {
+	a, err := scanAdvertiser(s.db.QueryRow("SELECT "+advertiserColumns+" FROM advertisers WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *PostgresStore) CreateAdvertiser(a *Advertiser) error {
+	return s.db.QueryRow(`
+		INSERT INTO advertisers (name, contact_name, contact_email)
+		VALUES ($1, $2, $3) RETURNING id, created_at
+	`, a.Name, nullIfEmpty(a.ContactName), nullIfEmpty(a.ContactEmail)).Scan(&a.ID, &a.CreatedAt)
+}
+
+func (s *PostgresStore) UpdateAdvertiser(a Advertiser) (bool, error) {
+	return affected(s.db.Exec(`
+		UPDATE advertisers SET name = $1, contact_name = $2, contact_email = $3
+		WHERE id = $4
+	`, a.Name, nullIfEmpty(a.ContactName), nullIfEmpty(a.ContactEmail), a.ID))
+}
+
+func (s *PostgresStore) DeleteAdvertiser(id int) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM advertisers WHERE id = $1", id))
+}
+
+const campaignColumns = "c.id, c.advertiser_id, a.name, c.name, c.start_date, c.end_date, c.impression_goal, c.created_at"
+
+func scanCampaign(row rowScanner) (Campaign, error) {
+	var c Campaign
+	var sd, ed sql.NullTime
+	var goal sql.NullInt64
+	if err := row.Scan(&c.ID, &c.AdvertiserID, &c.AdvertiserName, &c.Name, &sd, &ed, &goal, &c.CreatedAt); err != nil {
+		return c, err
+	}
+	if sd.Valid {
+		c.StartDate = sd.Time.Format("2006-01-02")
+	}
+	if ed.Valid {
+		c.EndDate = ed.Time.Format("2006-01-02")
+	}
+	c.ImpressionGoal = int(goal.Int64)
+	return c, nil
+}
+
+func (s *PostgresStore) Campaigns(advertiserID int) ([]Campaign, error) {
+	query := "SELECT " + campaignColumns + " FROM ad_campaigns c JOIN advertisers a ON a.id = c.advertiser_id"
+	args := []interface{}{}
+	if advertiserID > 0 {
+		query += " WHERE c.advertiser_id = $1"
+		args = append(args, advertiserID)
+	}
+	query += " ORDER BY c.created_at DESC"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := []Campaign{}
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, rows.Err()
+}
+
+func (s *PostgresStore) Campaign(id int) (*Campaign, error) {
+	c, err := scanCampaign(s.db.QueryRow("SELECT "+campaignColumns+" FROM ad_campaigns c JOIN advertisers a ON a.id = c.advertiser_id WHERE c.id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *PostgresStore) CreateCampaign(c *Campaign) error {
+	return s.db.QueryRow(`
+		INSERT INTO ad_campaigns (advertiser_id, name, start_date, end_date, impression_goal)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at
+	`, c.AdvertiserID, c.Name, nullIfEmpty(c.StartDate), nullIfEmpty(c.EndDate), c.ImpressionGoal).Scan(&c.ID, &c.CreatedAt)
+}
+
+func (s *PostgresStore) UpdateCampaign(c Campaign) (bool, error) {
+	return affected(s.db.Exec(`
+		UPDATE ad_campaigns
+		SET advertiser_id = $1, name = $2, start_date = $3, end_date = $4, impression_goal = $5
+		WHERE id = $6
+	`, c.AdvertiserID, c.Name, nullIfEmpty(c.StartDate), nullIfEmpty(c.EndDate), c.ImpressionGoal, c.ID))
+}
+
+func (s *PostgresStore) DeleteCampaign(id int) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM ad_campaigns WHERE id = $1", id))
+}
+
+func (s *PostgresStore) CampaignDelivery(id int) ([]AdDelivery, []DailyDelivery, error) {
+	// Per-ad delivery (includes ads since deleted, by their impression rows)
+	rows, err := s.db.Query(`
+		SELECT i.ad_id, COALESCE(a.title, '(deleted ad)'), SUM(i.impressions)
+		FROM ad_impressions i
+		LEFT JOIN scheduled_ads a ON a.id = i.ad_id
+		WHERE i.campaign_id = $1
+		GROUP BY i.ad_id, a.title
+		ORDER BY SUM(i.impressions) DESC
+	`, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	ads := []AdDelivery{}
+	for rows.Next() {
+		var d AdDelivery
+		if err := rows.Scan(&d.AdID, &d.Title, &d.Impressions); err != nil {
+			return nil, nil, err
+		}
+		ads = append(ads, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	daily, err := s.db.Query(`
+		SELECT day, SUM(impressions) FROM ad_impressions
+		WHERE campaign_id = $1
+		GROUP BY day ORDER BY day
+	`, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer daily.Close()
+	days := []DailyDelivery{}
+	for daily.Next() {
+		var day time.Time
+		var d DailyDelivery
+		if err := daily.Scan(&day, &d.Impressions); err != nil {
+			return nil, nil, err
+		}
+		d.Date = day.Format("2006-01-02")
+		days = append(days, d)
+	}
+	return ads, days, daily.Err()
+}
+
+// ---- Emails ----
+
+func (s *PostgresStore) SaveEmail(siteID int, email, source string) error {
+	_, err := s.db.Exec("INSERT INTO collected_emails (site_id, email, source) VALUES ($1, $2, $3) ON CONFLICT (site_id, email) DO NOTHING", siteID, email, source)
+	return err
+}
+
+func (s *PostgresStore) Emails(siteID int) ([]CollectedEmail, error) {
+	rows, err := s.db.Query("SELECT id, email, COALESCE(source, ''), created_at FROM collected_emails WHERE site_id = $1 ORDER BY created_at DESC", siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []CollectedEmail
+	for rows.Next() {
+		var e CollectedEmail
+		if err := rows.Scan(&e.ID, &e.Email, &e.Source, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+// ---- Sites ----
+
+const siteColumns = "id, slug, name, hostnames, gateways, created_at"
+
+// pgArray scans a TEXT[] column
+func pgArray(a *[]string) interface{} { return pq.Array(a) }
+
+// scanSite reads a siteColumns row; array scans its string list columns
+func scanSite(row rowScanner, array func(*[]string) interface{}) (Site, error) {
+	var s Site
+	err := row.Scan(&s.ID, &s.Slug, &s.Name, array(&s.Hostnames), array(&s.Gateways), &s.CreatedAt)
+	if s.Hostnames == nil {
+		s.Hostnames = []string{}
+	}
+	if s.Gateways == nil {
+		s.Gateways = []string{}
+	}
+	return s, err
+}
+
+func (s *PostgresStore) Sites() ([]Site, error) {
+	rows, err := s.db.Query("SELECT " + siteColumns + " FROM sites ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sites := []Site{}
+	for rows.Next() {
+		site, err := scanSite(rows, pgArray)
+		if err != nil {
+			return nil, err
+		}
+		sites = append(sites, site)
+	}
+	return sites, rows.Err()
+}
+
+// notifySitesChanged makes the other instances reload their site directory
+func (s *PostgresStore) notifySitesChanged() {
+	if _, err := s.db.Exec("SELECT pg_notify($1, '')", sitesChannel); err != nil {
+		slog.Warn("Failed to notify site change", "error", err)
+	}
+}
+
+func (s *PostgresStore) CreateSite(site *Site) error {
+	err := s.db.QueryRow(`
+		INSERT INTO sites (slug, name, hostnames, gateways) VALUES ($1, $2, $3, $4) RETURNING id, created_at
+	`, site.Slug, site.Name, pq.Array(site.Hostnames), pq.Array(site.Gateways)).Scan(&site.ID, &site.CreatedAt)
+	if err == nil {
+		s.notifySitesChanged()
+	}
+	return err
+}
+
+func (s *PostgresStore) UpdateSite(site Site) (bool, error) {
+	ok, err := affected(s.db.Exec(`
+		UPDATE sites SET slug = $1, name = $2, hostnames = $3, gateways = $4 WHERE id = $5
+	`, site.Slug, site.Name, pq.Array(site.Hostnames), pq.Array(site.Gateways), site.ID))
+	if ok {
+		s.notifySitesChanged()
+	}
+	return ok, err
+}
+
+func (s *PostgresStore) DeleteSite(id int) (bool, error) {
+	ok, err := affected(s.db.Exec("DELETE FROM sites WHERE id = $1", id))
+	if ok {
+		s.notifySitesChanged()
+	}
+	return ok, err
+}
+
+func (s *PostgresStore) AdminSiteIDs(username string) ([]int, error) {
+	return scanIDs(s.db.Query("SELECT site_id FROM admin_sites WHERE username = $1 ORDER BY site_id", username))
+}
+
+func (s *PostgresStore) AdminSiteAccess() (map[string][]int, error) {
+	rows, err := s.db.Query("SELECT username, site_id FROM admin_sites ORDER BY username, site_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	access := map[string][]int{}
+	for rows.Next() {
+		var username string
+		var siteID int
+		if err := rows.Scan(&username, &siteID); err != nil {
+			return nil, err
+		}
+		access[username] = append(access[username], siteID)
+	}
+	return access, rows.Err()
+}
+
+func (s *PostgresStore) SetAdminSiteIDs(username string, siteIDs []int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM admin_sites WHERE username = $1", username); err != nil {
+		return err
+	}
+	for _, id := range siteIDs {
+		if _, err := tx.Exec("INSERT INTO admin_sites (username, site_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", username, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) AdminPasswordHash(username string) (string, error) {
+	var hash string
+	err := s.db.QueryRow("SELECT password_hash FROM admin_accounts WHERE username = $1", username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+func (s *PostgresStore) SetAdminPasswordHash(username, hash string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO admin_accounts (username, password_hash) VALUES ($1, $2)
+		ON CONFLICT (username) DO UPDATE SET password_hash = EXCLUDED.password_hash, updated_at = CURRENT_TIMESTAMP
+	`, username, hash)
+	return err
+}
+
+// ---- Media ----
+
+const mediaColumns = `id, hash, url, storage_keys, content_type, size, width, height, uploader, original_name, tags, variants, created_at`
+
+// scanMedia reads a mediaColumns row; array scans its string list columns
+func scanMedia(row rowScanner, array func(*[]string) interface{}) (Media, error) {
+	var m Media
+	var contentType, uploader, originalName, variants sql.NullString
+	var size, width, height sql.NullInt64
+	var keys, tags []string
+	err := row.Scan(&m.ID, &m.Hash, &m.URL, array(&keys), &contentType, &size, &width, &height,
+		&uploader, &originalName, array(&tags), &variants, &m.CreatedAt)
+	if err != nil {
+		return m, err
+	}
+	m.Keys = keys
+	m.Tags = tags
+	if m.Tags == nil {
+		m.Tags = []string{}
+	}
+	m.ContentType = contentType.String
+	m.Size = size.Int64
+	m.Width = int(width.Int64)
+	m.Height = int(height.Int64)
+	m.Uploader = uploader.String
+	m.OriginalName = originalName.String
+	if variants.Valid {
+		var set ImageVariantSet
+		if json.Unmarshal([]byte(variants.String), &set) == nil {
+			m.Variants = &set
+		}
+	}
+	return m, nil
+}
+
+func (s *PostgresStore) mediaWhere(column string, value interface{}) (*Media, error) {
+	m, err := scanMedia(s.db.QueryRow("SELECT "+mediaColumns+" FROM media WHERE "+column+" = $1 ORDER BY id LIMIT 1", value), pgArray)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *PostgresStore) MediaByID(id int) (*Media, error)        { return s.mediaWhere("id", id) }
+func (s *PostgresStore) MediaByHash(hash string) (*Media, error) { return s.mediaWhere("hash", hash) }
+func (s *PostgresStore) MediaByURL(url string) (*Media, error)   { return s.mediaWhere("url", url) }
+
+func (s *PostgresStore) ListMedia(f MediaFilter) ([]Media, error) {
+	query := "SELECT " + mediaColumns + " FROM media WHERE 1=1"
+	args := []interface{}{}
+	if f.Tag != "" {
+		args = append(args, f.Tag)
+		query += fmt.Sprintf(" AND $%d = ANY(tags)", len(args))
+	}
+	if f.Type != "" {
+		args = append(args, f.Type+"%")
+		query += fmt.Sprintf(" AND content_type LIKE $%d", len(args))
+	}
+	if f.Search != "" {
+		args = append(args, "%"+f.Search+"%")
+		query += fmt.Sprintf(" AND (original_name ILIKE $%d OR array_to_string(tags, ',') ILIKE $%d)", len(args), len(args))
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+	if f.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d OFFSET %d", f.Limit, f.Offset)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Media{}
+	for rows.Next() {
+		m, err := scanMedia(rows, pgArray)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, m)
+	}
+	return items, rows.Err()
+}
+
+func (s *PostgresStore) SaveMedia(m *Media) error {
+	var variants interface{}
+	if m.Variants != nil {
+		raw, err := json.Marshal(m.Variants)
+		if err != nil {
+			return err
+		}
+		variants = string(raw)
+	}
+	return s.db.QueryRow(`
+		INSERT INTO media (hash, url, storage_keys, content_type, size, width, height, uploader, original_name, tags, variants)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (hash) DO UPDATE SET
+			url = $2, storage_keys = $3, content_type = $4, size = $5, width = $6, height = $7, variants = $11
+		RETURNING id, created_at
+	`, m.Hash, m.URL, pq.Array(m.Keys), m.ContentType, m.Size, m.Width, m.Height,
+		m.Uploader, m.OriginalName, pq.Array(m.Tags), variants).Scan(&m.ID, &m.CreatedAt)
+}
+
+func (s *PostgresStore) SetMediaTags(id int, tags []string) (bool, error) {
+	return affected(s.db.Exec("UPDATE media SET tags = $1 WHERE id = $2", pq.Array(tags), id))
+}
+
+func (s *PostgresStore) RemoveMedia(id int) error {
+	_, err := s.db.Exec("DELETE FROM media WHERE id = $1", id)
+	return err
+}
+
+func (s *PostgresStore) ImageReferences() ([]string, error) {
+	var refs []string
+	queries := []string{
+		"SELECT COALESCE(value, '') FROM page_settings",
+		"SELECT COALESCE(image, '') FROM scheduled_ads",
+		"SELECT s.value FROM settings_revisions r, jsonb_each_text(r.settings) s WHERE s.key = 'background_image'",
+		"SELECT COALESCE(settings->>'background_image', '') FROM settings_draft",
+	}
+	for _, q := range queries {
+		rows, err := s.db.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var ref string
+			if err := rows.Scan(&ref); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			refs = append(refs, ref)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// ---- Themes ----
+
+func (s *PostgresStore) ThemeNames() ([]string, error) {
+	rows, err := s.db.Query("SELECT name FROM portal_themes ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func (s *PostgresStore) ThemeArchive(name string) (*StoredTheme, error) {
+	t := StoredTheme{Name: name}
+	err := s.db.QueryRow("SELECT archive, COALESCE(uploaded_by, ''), created_at FROM portal_themes WHERE name = $1", name).Scan(&t.Archive, &t.UploadedBy, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *PostgresStore) SaveTheme(t StoredTheme) error {
+	_, err := s.db.Exec(`
+		INSERT INTO portal_themes (name, archive, uploaded_by, created_at) VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (name) DO UPDATE SET archive = $2, uploaded_by = $3, created_at = NOW()
+	`, t.Name, t.Archive, t.UploadedBy)
+	return err
+}
+
+func (s *PostgresStore) DeleteTheme(name string) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM portal_themes WHERE name = $1", name))
+}
+
+func (s *PostgresStore) ThemeSites(name string) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT s.name FROM page_settings p JOIN sites s ON s.id = p.site_id
+		WHERE p.key = 'portal_theme' AND p.value = $1 ORDER BY s.name
+	`, name)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+// ---- helpers ----
+
+// affected adapts an Exec result to "did it touch a row"
+func affected(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func scanIDs(rows *sql.Rows, err error) ([]int, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func scanStrings(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// compile-time check that the Postgres store is complete
+var _ Store = (*PostgresStore)(nil)
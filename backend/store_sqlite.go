@@ -0,0 +1,835 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SQLiteStore is the Store on an embedded SQLite database, for single-box
+// deployments that don't want to run Postgres. It runs the same schema
+// (migrations/sqlite) with string lists and JSON kept as JSON text. There is
+// only one instance, so changes need no announcing; transactions take the
+// write lock when they begin (see sqliteOptions), which stands in for
+// Postgres' advisory and row locks.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db}
+}
+
+// jsonStrings keeps a []string as a JSON array, SQLite's stand-in for TEXT[]
+type jsonStrings []string
+
+func (a jsonStrings) Value() (driver.Value, error) {
+	if a == nil {
+		return "[]", nil
+	}
+	raw, err := json.Marshal([]string(a))
+	return string(raw), err
+}
+
+func (a *jsonStrings) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), (*[]string)(a))
+	case []byte:
+		return json.Unmarshal(v, (*[]string)(a))
+	}
+	return fmt.Errorf("cannot scan %T into a string list", src)
+}
+
+// sqliteArray scans a JSON array column
+func sqliteArray(a *[]string) interface{} { return (*jsonStrings)(a) }
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// ---- Settings ----
+
+func (s *SQLiteStore) Settings(siteID int) (map[string]string, error) {
+	return loadSettingsMap(s.db, siteID)
+}
+
+func (s *SQLiteStore) SaveSettings(siteID int, changes map[string]*string, author, reason string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := sqliteSaveSettingsTx(tx, siteID, changes, author, reason)
+	if err != nil || id == 0 {
+		return id, err
+	}
+	return id, tx.Commit()
+}
+
+// sqliteSaveSettingsTx is SaveSettings inside a caller's transaction
+func sqliteSaveSettingsTx(tx *sql.Tx, siteID int, changes map[string]*string, author, reason string) (int, error) {
+	current, err := settingsForWrite(tx, siteID)
+	if err != nil {
+		return 0, err
+	}
+
+	set, removed := applySettingChanges(current, changes)
+	if len(set) == 0 && len(removed) == 0 {
+		return 0, nil
+	}
+	for _, key := range removed {
+		if _, err := tx.Exec("DELETE FROM page_settings WHERE site_id = $1 AND key = $2", siteID, key); err != nil {
+			return 0, err
+		}
+	}
+	for key, value := range set {
+		if err := sqliteUpsertSetting(tx, siteID, key, value); err != nil {
+			return 0, err
+		}
+	}
+	return insertRevision(tx, siteID, current, author, reason, nil)
+}
+
+func sqliteUpsertSetting(tx *sql.Tx, siteID int, key, value string) error {
+	_, err := tx.Exec(`
+		INSERT INTO page_settings (site_id, key, value, updated_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (site_id, key) DO UPDATE SET value = $3, updated_at = CURRENT_TIMESTAMP
+	`, siteID, key, value)
+	return err
+}
+
+func (s *SQLiteStore) RestoreSettings(siteID, revisionID int, author string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := settingsForWrite(tx, siteID); err != nil {
+		return 0, err
+	}
+
+	var raw string
+	err = tx.QueryRow("SELECT settings FROM settings_revisions WHERE id = $1 AND site_id = $2", revisionID, siteID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return 0, errRevisionNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	var snapshot map[string]string
+	if err := json.Unmarshal([]byte(raw), &snapshot); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM page_settings WHERE site_id = $1", siteID); err != nil {
+		return 0, err
+	}
+	for key, value := range snapshot {
+		if err := sqliteUpsertSetting(tx, siteID, key, value); err != nil {
+			return 0, err
+		}
+	}
+
+	id, err := insertRevision(tx, siteID, snapshot, author, "restore", &revisionID)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (s *SQLiteStore) SettingsRevisions(siteID, limit, offset int) ([]SettingsRevision, error) {
+	rows, err := s.db.Query("SELECT "+revisionColumns+" FROM settings_revisions WHERE site_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3", siteID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []SettingsRevision{}
+	for rows.Next() {
+		rev, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+func (s *SQLiteStore) SettingsRevision(siteID, id int) (*SettingsRevision, error) {
+	rev, err := scanRevision(s.db.QueryRow("SELECT "+revisionColumns+" FROM settings_revisions WHERE id = $1 AND site_id = $2", id, siteID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// ---- Settings drafts ----
+
+func (s *SQLiteStore) SettingsDraft(siteID int) (*SettingsDraft, error) {
+	return loadDraft(s.db, siteID, false)
+}
+
+func (s *SQLiteStore) SettingsDraftByToken(token string) (*SettingsDraft, error) {
+	var siteID int
+	err := s.db.QueryRow("SELECT site_id FROM settings_draft WHERE preview_token = $1", token).Scan(&siteID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loadDraft(s.db, siteID, false)
+}
+
+// StageSettingsDraft runs its transaction with the write lock taken up front
+// (see sqliteOptions), so concurrent stages merge in turn. Like PostgresStore
+// it creates the row first; the preview token returned is the stored one.
+func (s *SQLiteStore) StageSettingsDraft(siteID int, values map[string]string, author string) (*SettingsDraft, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO settings_draft (site_id, settings, preview_token, updated_by, updated_at)
+		VALUES ($1, '{}', $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (site_id) DO NOTHING
+	`, siteID, newPreviewToken(), author)
+	if err != nil {
+		return nil, err
+	}
+	d, err := loadDraft(tx, siteID, false)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		d.Settings[key] = value
+	}
+	d.UpdatedBy = author
+
+	raw, _ := json.Marshal(d.Settings)
+	err = tx.QueryRow(`
+		UPDATE settings_draft SET settings = $1, updated_by = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE site_id = $3
+		RETURNING updated_at
+	`, string(raw), d.UpdatedBy, siteID).Scan(&d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return d, tx.Commit()
+}
+
+func (s *SQLiteStore) ScheduleSettingsDraft(siteID int, publishAt *time.Time, author string) (bool, error) {
+	res, err := s.db.Exec("UPDATE settings_draft SET publish_at = $1, updated_by = $2, updated_at = CURRENT_TIMESTAMP WHERE site_id = $3", utcTime(publishAt), author, siteID)
+	return affected(res, err)
+}
+
+// utcTime normalises a schedule to UTC: SQLite compares times as text
+func utcTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+func (s *SQLiteStore) DiscardSettingsDraft(siteID int) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM settings_draft WHERE site_id = $1", siteID))
+}
+
+func (s *SQLiteStore) PublishSettingsDraft(siteID int, author string, onlyDue bool) (int, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	d, err := loadDraft(tx, siteID, false)
+	if err != nil || d == nil {
+		return 0, false, err
+	}
+	if onlyDue && (d.PublishAt == nil || d.PublishAt.After(time.Now())) {
+		return 0, false, nil
+	}
+
+	revision, err := sqliteSaveSettingsTx(tx, siteID, settingValues(d.Settings), author, "publish")
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := tx.Exec("DELETE FROM settings_draft WHERE site_id = $1", siteID); err != nil {
+		return 0, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return revision, true, nil
+}
+
+func (s *SQLiteStore) DueSettingsDrafts() ([]int, error) {
+	return scanIDs(s.db.Query("SELECT site_id FROM settings_draft WHERE publish_at <= $1", time.Now().UTC()))
+}
+
+// ---- Ads ----
+
+func (s *SQLiteStore) Ads(siteID int) ([]ScheduledAd, error) {
+	rows, err := s.db.Query("SELECT "+adColumns+" FROM scheduled_ads WHERE site_id = $1 ORDER BY created_at DESC, id DESC", siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ads := []ScheduledAd{}
+	for rows.Next() {
+		ad, err := scanAd(rows)
+		if err != nil {
+			return nil, err
+		}
+		ads = append(ads, ad)
+	}
+	return ads, rows.Err()
+}
+
+func (s *SQLiteStore) Ad(siteID, id int) (*ScheduledAd, error) {
+	ad, err := scanAd(s.db.QueryRow("SELECT "+adColumns+" FROM scheduled_ads WHERE id = $1 AND site_id = $2", id, siteID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ad, nil
+}
+
+func (s *SQLiteStore) CreateAd(siteID int, ad *ScheduledAd) error {
+	return s.db.QueryRow(`
+		INSERT INTO scheduled_ads (title, description, image, link, start_date, end_date, start_time, end_time, is_active, campaign_id, site_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id, created_at
+	`, ad.Title, ad.Description, ad.Image, nullIfEmpty(ad.Link),
+		nullIfEmpty(ad.StartDate), nullIfEmpty(ad.EndDate),
+		nullIfEmpty(ad.StartTime), nullIfEmpty(ad.EndTime), ad.IsActive, ad.CampaignID, siteID).Scan(&ad.ID, &ad.CreatedAt)
+}
+
+func (s *SQLiteStore) UpdateAd(siteID int, ad ScheduledAd) (bool, error) {
+	return affected(s.db.Exec(`
+		UPDATE scheduled_ads
+		SET title = $1, description = $2, image = $3, link = $4, start_date = $5, end_date = $6, start_time = $7, end_time = $8, is_active = $9, campaign_id = $10
+		WHERE id = $11 AND site_id = $12
+	`, ad.Title, ad.Description, ad.Image, nullIfEmpty(ad.Link),
+		nullIfEmpty(ad.StartDate), nullIfEmpty(ad.EndDate),
+		nullIfEmpty(ad.StartTime), nullIfEmpty(ad.EndTime), ad.IsActive, ad.CampaignID, ad.ID, siteID))
+}
+
+func (s *SQLiteStore) DeleteAd(siteID, id int) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM scheduled_ads WHERE id = $1 AND site_id = $2", id, siteID))
+}
+
+func (s *SQLiteStore) ActiveAd(siteID int, date, clock string) (*ScheduledAd, error) {
+	// Dates and times are stored as text in a fixed format, so they compare as text
+	ad, err := scanAd(s.db.QueryRow(`
+		SELECT a.id, a.title, a.description, a.image, a.link, a.start_date, a.end_date, a.start_time, a.end_time, a.is_active, a.campaign_id, a.created_at
+		FROM scheduled_ads a
+		LEFT JOIN ad_campaigns c ON c.id = a.campaign_id
+		WHERE a.site_id = $3 AND a.is_active = TRUE
+		AND (a.start_date IS NULL OR a.start_date <= $1)
+		AND (a.end_date IS NULL OR a.end_date >= $1)
+		AND (a.start_time IS NULL OR a.start_time <= $2)
+		AND (a.end_time IS NULL OR a.end_time >= $2)
+		AND (c.start_date IS NULL OR c.start_date <= $1)
+		AND (c.end_date IS NULL OR c.end_date >= $1)
+		ORDER BY a.created_at DESC, a.id DESC LIMIT 1
+	`, date, clock, siteID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ad, nil
+}
+
+func (s *SQLiteStore) AdTranslations(adID int) (map[string]AdTranslation, error) {
+	rows, err := s.db.Query("SELECT locale, title, description FROM ad_translations WHERE ad_id = $1", adID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := map[string]AdTranslation{}
+	for rows.Next() {
+		var locale string
+		var title, description sql.NullString
+		if err := rows.Scan(&locale, &title, &description); err != nil {
+			return nil, err
+		}
+		translations[locale] = AdTranslation{Title: title.String, Description: description.String}
+	}
+	return translations, rows.Err()
+}
+
+func (s *SQLiteStore) SaveAdTranslation(adID int, locale string, t AdTranslation) error {
+	_, err := s.db.Exec(`
+		INSERT INTO ad_translations (ad_id, locale, title, description, updated_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+		ON CONFLICT (ad_id, locale) DO UPDATE SET title = $3, description = $4, updated_at = CURRENT_TIMESTAMP
+	`, adID, locale, t.Title, t.Description)
+	return err
+}
+
+func (s *SQLiteStore) DeleteAdTranslation(adID int, locale string) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM ad_translations WHERE ad_id = $1 AND locale = $2", adID, locale))
+}
+
+func (s *SQLiteStore) RecordImpression(ad ScheduledAd, day string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO ad_impressions (ad_id, campaign_id, day, impressions)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (ad_id, campaign_id, day) DO UPDATE SET impressions = ad_impressions.impressions + 1
+	`, ad.ID, impressionCampaign(ad.CampaignID), day)
+	return err
+}
+
+// ---- Advertisers and campaigns ----
+
+func (s *SQLiteStore) Advertisers() ([]Advertiser, error) {
+	rows, err := s.db.Query("SELECT " + advertiserColumns + " FROM advertisers ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	advertisers := []Advertiser{}
+	for rows.Next() {
+		a, err := scanAdvertiser(rows)
+		if err != nil {
+			return nil, err
+		}
+		advertisers = append(advertisers, a)
+	}
+	return advertisers, rows.Err()
+}
+
+func (s *SQLiteStore) Advertiser(id int) (*Advertiser, error) {
+	a, err := scanAdvertiser(s.db.QueryRow("SELECT "+advertiserColumns+" FROM advertisers WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *SQLiteStore) CreateAdvertiser(a *Advertiser) error {
+	return s.db.QueryRow(`
+		INSERT INTO advertisers (name, contact_name, contact_email)
+		VALUES ($1, $2, $3) RETURNING id, created_at
+	`, a.Name, nullIfEmpty(a.ContactName), nullIfEmpty(a.ContactEmail)).Scan(&a.ID, &a.CreatedAt)
+}
+
+func (s *SQLiteStore) UpdateAdvertiser(a Advertiser) (bool, error) {
+	return affected(s.db.Exec(`
+		UPDATE advertisers SET name = $1, contact_name = $2, contact_email = $3
+		WHERE id = $4
+	`, a.Name, nullIfEmpty(a.ContactName), nullIfEmpty(a.ContactEmail), a.ID))
+}
+
+func (s *SQLiteStore) DeleteAdvertiser(id int) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM advertisers WHERE id = $1", id))
+}
+
+func (s *SQLiteStore) Campaigns(advertiserID int) ([]Campaign, error) {
+	query := "SELECT " + campaignColumns + " FROM ad_campaigns c JOIN advertisers a ON a.id = c.advertiser_id"
+	args := []interface{}{}
+	if advertiserID > 0 {
+		query += " WHERE c.advertiser_id = $1"
+		args = append(args, advertiserID)
+	}
+	query += " ORDER BY c.created_at DESC, c.id DESC"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	campaigns := []Campaign{}
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	return campaigns, rows.Err()
+}
+
+func (s *SQLiteStore) Campaign(id int) (*Campaign, error) {
+	c, err := scanCampaign(s.db.QueryRow("SELECT "+campaignColumns+" FROM ad_campaigns c JOIN advertisers a ON a.id = c.advertiser_id WHERE c.id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *SQLiteStore) CreateCampaign(c *Campaign) error {
+	return s.db.QueryRow(`
+		INSERT INTO ad_campaigns (advertiser_id, name, start_date, end_date, impression_goal)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at
+	`, c.AdvertiserID, c.Name, nullIfEmpty(c.StartDate), nullIfEmpty(c.EndDate), c.ImpressionGoal).Scan(&c.ID, &c.CreatedAt)
+}
+
+func (s *SQLiteStore) UpdateCampaign(c Campaign) (bool, error) {
+	return affected(s.db.Exec(`
+		UPDATE ad_campaigns
+		SET advertiser_id = $1, name = $2, start_date = $3, end_date = $4, impression_goal = $5
+		WHERE id = $6
+	`, c.AdvertiserID, c.Name, nullIfEmpty(c.StartDate), nullIfEmpty(c.EndDate), c.ImpressionGoal, c.ID))
+}
+
+func (s *SQLiteStore) DeleteCampaign(id int) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM ad_campaigns WHERE id = $1", id))
+}
+
+func (s *SQLiteStore) CampaignDelivery(id int) ([]AdDelivery, []DailyDelivery, error) {
+	// Per-ad delivery (includes ads since deleted, by their impression rows)
+	rows, err := s.db.Query(`
+		SELECT i.ad_id, COALESCE(a.title, '(deleted ad)'), SUM(i.impressions)
+		FROM ad_impressions i
+		LEFT JOIN scheduled_ads a ON a.id = i.ad_id
+		WHERE i.campaign_id = $1
+		GROUP BY i.ad_id, a.title
+		ORDER BY SUM(i.impressions) DESC
+	`, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	ads := []AdDelivery{}
+	for rows.Next() {
+		var d AdDelivery
+		if err := rows.Scan(&d.AdID, &d.Title, &d.Impressions); err != nil {
+			return nil, nil, err
+		}
+		ads = append(ads, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	daily, err := s.db.Query(`
+		SELECT day, SUM(impressions) FROM ad_impressions
+		WHERE campaign_id = $1
+		GROUP BY day ORDER BY day
+	`, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer daily.Close()
+	days := []DailyDelivery{}
+	for daily.Next() {
+		var day time.Time
+		var d DailyDelivery
+		if err := daily.Scan(&day, &d.Impressions); err != nil {
+			return nil, nil, err
+		}
+		d.Date = day.Format("2006-01-02")
+		days = append(days, d)
+	}
+	return ads, days, daily.Err()
+}
+
+// ---- Emails ----
+
+func (s *SQLiteStore) SaveEmail(siteID int, email, source string) error {
+	_, err := s.db.Exec("INSERT INTO collected_emails (site_id, email, source) VALUES ($1, $2, $3) ON CONFLICT (site_id, email) DO NOTHING", siteID, email, source)
+	return err
+}
+
+func (s *SQLiteStore) Emails(siteID int) ([]CollectedEmail, error) {
+	rows, err := s.db.Query("SELECT id, email, COALESCE(source, ''), created_at FROM collected_emails WHERE site_id = $1 ORDER BY created_at DESC, id DESC", siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []CollectedEmail
+	for rows.Next() {
+		var e CollectedEmail
+		if err := rows.Scan(&e.ID, &e.Email, &e.Source, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+// ---- Sites ----
+
+func (s *SQLiteStore) Sites() ([]Site, error) {
+	rows, err := s.db.Query("SELECT " + siteColumns + " FROM sites ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sites := []Site{}
+	for rows.Next() {
+		site, err := scanSite(rows, sqliteArray)
+		if err != nil {
+			return nil, err
+		}
+		sites = append(sites, site)
+	}
+	return sites, rows.Err()
+}
+
+func (s *SQLiteStore) CreateSite(site *Site) error {
+	return s.db.QueryRow(`
+		INSERT INTO sites (slug, name, hostnames, gateways) VALUES ($1, $2, $3, $4) RETURNING id, created_at
+	`, site.Slug, site.Name, jsonStrings(site.Hostnames), jsonStrings(site.Gateways)).Scan(&site.ID, &site.CreatedAt)
+}
+
+func (s *SQLiteStore) UpdateSite(site Site) (bool, error) {
+	return affected(s.db.Exec(`
+		UPDATE sites SET slug = $1, name = $2, hostnames = $3, gateways = $4 WHERE id = $5
+	`, site.Slug, site.Name, jsonStrings(site.Hostnames), jsonStrings(site.Gateways), site.ID))
+}
+
+func (s *SQLiteStore) DeleteSite(id int) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM sites WHERE id = $1", id))
+}
+
+func (s *SQLiteStore) AdminSiteIDs(username string) ([]int, error) {
+	return scanIDs(s.db.Query("SELECT site_id FROM admin_sites WHERE username = $1 ORDER BY site_id", username))
+}
+
+func (s *SQLiteStore) AdminSiteAccess() (map[string][]int, error) {
+	rows, err := s.db.Query("SELECT username, site_id FROM admin_sites ORDER BY username, site_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	access := map[string][]int{}
+	for rows.Next() {
+		var username string
+		var siteID int
+		if err := rows.Scan(&username, &siteID); err != nil {
+			return nil, err
+		}
+		access[username] = append(access[username], siteID)
+	}
+	return access, rows.Err()
+}
+
+func (s *SQLiteStore) SetAdminSiteIDs(username string, siteIDs []int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM admin_sites WHERE username = $1", username); err != nil {
+		return err
+	}
+	for _, id := range siteIDs {
+		if _, err := tx.Exec("INSERT INTO admin_sites (username, site_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", username, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) AdminPasswordHash(username string) (string, error) {
+	var hash string
+	err := s.db.QueryRow("SELECT password_hash FROM admin_accounts WHERE username = $1", username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+func (s *SQLiteStore) SetAdminPasswordHash(username, hash string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO admin_accounts (username, password_hash) VALUES ($1, $2)
+		ON CONFLICT (username) DO UPDATE SET password_hash = EXCLUDED.password_hash, updated_at = CURRENT_TIMESTAMP
+	`, username, hash)
+	return err
+}
+
+// ---- Media ----
+
+func (s *SQLiteStore) mediaWhere(column string, value interface{}) (*Media, error) {
+	m, err := scanMedia(s.db.QueryRow("SELECT "+mediaColumns+" FROM media WHERE "+column+" = $1 ORDER BY id LIMIT 1", value), sqliteArray)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *SQLiteStore) MediaByID(id int) (*Media, error)        { return s.mediaWhere("id", id) }
+func (s *SQLiteStore) MediaByHash(hash string) (*Media, error) { return s.mediaWhere("hash", hash) }
+func (s *SQLiteStore) MediaByURL(url string) (*Media, error)   { return s.mediaWhere("url", url) }
+
+func (s *SQLiteStore) ListMedia(f MediaFilter) ([]Media, error) {
+	query := "SELECT " + mediaColumns + " FROM media WHERE 1=1"
+	args := []interface{}{}
+	if f.Tag != "" {
+		args = append(args, f.Tag)
+		query += fmt.Sprintf(" AND EXISTS (SELECT 1 FROM json_each(tags) WHERE value = $%d)", len(args))
+	}
+	if f.Type != "" {
+		args = append(args, f.Type+"%")
+		query += fmt.Sprintf(" AND content_type LIKE $%d", len(args))
+	}
+	if f.Search != "" {
+		// LIKE ignores ASCII case in SQLite
+		args = append(args, "%"+f.Search+"%")
+		query += fmt.Sprintf(" AND (original_name LIKE $%d OR EXISTS (SELECT 1 FROM json_each(tags) WHERE value LIKE $%d))", len(args), len(args))
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+	if f.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d OFFSET %d", f.Limit, f.Offset)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Media{}
+	for rows.Next() {
+		m, err := scanMedia(rows, sqliteArray)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, m)
+	}
+	return items, rows.Err()
+}
+
+func (s *SQLiteStore) SaveMedia(m *Media) error {
+	var variants interface{}
+	if m.Variants != nil {
+		raw, err := json.Marshal(m.Variants)
+		if err != nil {
+			return err
+		}
+		variants = string(raw)
+	}
+	return s.db.QueryRow(`
+		INSERT INTO media (hash, url, storage_keys, content_type, size, width, height, uploader, original_name, tags, variants)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (hash) DO UPDATE SET
+			url = $2, storage_keys = $3, content_type = $4, size = $5, width = $6, height = $7, variants = $11
+		RETURNING id, created_at
+	`, m.Hash, m.URL, jsonStrings(m.Keys), m.ContentType, m.Size, m.Width, m.Height,
+		m.Uploader, m.OriginalName, jsonStrings(m.Tags), variants).Scan(&m.ID, &m.CreatedAt)
+}
+
+func (s *SQLiteStore) SetMediaTags(id int, tags []string) (bool, error) {
+	return affected(s.db.Exec("UPDATE media SET tags = $1 WHERE id = $2", jsonStrings(tags), id))
+}
+
+func (s *SQLiteStore) RemoveMedia(id int) error {
+	_, err := s.db.Exec("DELETE FROM media WHERE id = $1", id)
+	return err
+}
+
+func (s *SQLiteStore) ImageReferences() ([]string, error) {
+	var refs []string
+	queries := []string{
+		"SELECT COALESCE(value, '') FROM page_settings",
+		"SELECT COALESCE(image, '') FROM scheduled_ads",
+		"SELECT json_extract(settings, '$.background_image') FROM settings_revisions WHERE json_type(settings, '$.background_image') = 'text'",
+		"SELECT COALESCE(json_extract(settings, '$.background_image'), '') FROM settings_draft",
+	}
+	for _, q := range queries {
+		rows, err := s.db.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var ref string
+			if err := rows.Scan(&ref); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			refs = append(refs, ref)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// ---- Themes ----
+
+func (s *SQLiteStore) ThemeNames() ([]string, error) {
+	rows, err := s.db.Query("SELECT name FROM portal_themes ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func (s *SQLiteStore) ThemeArchive(name string) (*StoredTheme, error) {
+	t := StoredTheme{Name: name}
+	err := s.db.QueryRow("SELECT archive, COALESCE(uploaded_by, ''), created_at FROM portal_themes WHERE name = $1", name).Scan(&t.Archive, &t.UploadedBy, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *SQLiteStore) SaveTheme(t StoredTheme) error {
+	_, err := s.db.Exec(`
+		INSERT INTO portal_themes (name, archive, uploaded_by, created_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (name) DO UPDATE SET archive = $2, uploaded_by = $3, created_at = CURRENT_TIMESTAMP
+	`, t.Name, t.Archive, t.UploadedBy)
+	return err
+}
+
+func (s *SQLiteStore) DeleteTheme(name string) (bool, error) {
+	return affected(s.db.Exec("DELETE FROM portal_themes WHERE name = $1", name))
+}
+
+func (s *SQLiteStore) ThemeSites(name string) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT s.name FROM page_settings p JOIN sites s ON s.id = p.site_id
+		WHERE p.key = 'portal_theme' AND p.value = $1 ORDER BY s.name
+	`, name)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+// compile-time check that the SQLite store is complete
+var _ Store = (*SQLiteStore)(nil)
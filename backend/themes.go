@@ -0,0 +1,435 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultThemeName = "default"
+	// themeEntryTemplate is the template every theme must define; other .html
+	// files in the package are available to it as partials
+	themeEntryTemplate = "portal.html"
+	themeCacheTTL      = time.Minute
+
+	maxThemeArchiveBytes = 10 << 20
+	maxThemeFileBytes    = 5 << 20
+	maxThemeFiles        = 200
+	// maxThemeUnpackedBytes caps all files of a theme together, so a small
+	// archive cannot unpack into hundreds of maximum-size files
+	maxThemeUnpackedBytes = 4 * maxThemeArchiveBytes
+)
+
+//go:embed themes/default
+var builtinThemeFS embed.FS
+
+var themeName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// themeAssetTypes are the static file types a theme package may ship
+var themeAssetTypes = map[string]bool{
+	".css": true, ".js": true, ".png": true, ".jpg": true, ".jpeg": true, ".gif": true,
+	".webp": true, ".svg": true, ".ico": true, ".woff": true, ".woff2": true, ".ttf": true,
+}
+
+// PortalTheme is a parsed theme package: html/template files plus static assets
+// served under /portal/themes/<name>/static/
+type PortalTheme struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	BuiltIn     bool       `json:"built_in"`
+	UploadedBy  string     `json:"uploaded_by,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	Files       []string   `json:"files"`
+
+	tmpl   *template.Template
+	assets map[string][]byte
+}
+
+// themeManifest is the optional theme.json at the root of a package
+type themeManifest struct {
+	Description string `json:"description"`
+}
+
+// newTheme parses a theme package from its files, keyed by slash-separated path
+func newTheme(name string, files map[string][]byte) (*PortalTheme, error) {
+	t := &PortalTheme{Name: name, Files: []string{}, assets: map[string][]byte{}}
+	if _, ok := files[themeEntryTemplate]; !ok {
+		return nil, fmt.Errorf("%s is missing", themeEntryTemplate)
+	}
+
+	t.tmpl = template.New("").Funcs(portalFuncs)
+	for p, data := range files {
+		t.Files = append(t.Files, p)
+		switch {
+		case p == "theme.json":
+			var m themeManifest
+			if err := json.Unmarshal(data, &m); err != nil {
+				return nil, fmt.Errorf("theme.json: %v", err)
+			}
+			t.Description = m.Description
+		case path.Ext(p) == ".html" && !strings.HasPrefix(p, "static/"):
+			if _, err := t.tmpl.New(p).Parse(string(data)); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(p, "static/") && themeAssetTypes[strings.ToLower(path.Ext(p))]:
+			t.assets[strings.TrimPrefix(p, "static/")] = data
+		default:
+			return nil, fmt.Errorf("%s: only .html templates, theme.json and static/ assets are allowed", p)
+		}
+	}
+	sort.Strings(t.Files)
+
+	// A template that parses can still fail on data it does not expect
+	if err := t.tmpl.ExecuteTemplate(io.Discard, themeEntryTemplate, samplePortalPage(name)); err != nil {
+		return nil, fmt.Errorf("render check failed: %v", err)
+	}
+	return t, nil
+}
+
+// readThemeArchive unpacks a theme zip. A single top-level folder (as created
+// by zipping the theme directory) is stripped.
+func readThemeArchive(data []byte) (map[string][]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.New("not a zip archive")
+	}
+
+	var entries []*zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(path.Base(f.Name), ".") || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		if path.IsAbs(f.Name) || path.Clean(f.Name) != f.Name || strings.HasPrefix(f.Name, "../") || strings.Contains(f.Name, "\\") {
+			return nil, fmt.Errorf("%s: invalid path", f.Name)
+		}
+		entries = append(entries, f)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("archive is empty")
+	}
+	if len(entries) > maxThemeFiles {
+		return nil, fmt.Errorf("archive has more than %d files", maxThemeFiles)
+	}
+
+	prefix := ""
+	if first, _, ok := strings.Cut(entries[0].Name, "/"); ok {
+		prefix = first + "/"
+		for _, f := range entries {
+			if !strings.HasPrefix(f.Name, prefix) {
+				prefix = ""
+				break
+			}
+		}
+	}
+
+	// The sizes in the headers are only claims: both limits are checked
+	// again on the bytes actually unpacked
+	errTooLarge := fmt.Errorf("archive unpacks to more than %d MB", maxThemeUnpackedBytes>>20)
+	var declared uint64
+	for _, f := range entries {
+		declared += f.UncompressedSize64
+	}
+	if declared > maxThemeUnpackedBytes {
+		return nil, errTooLarge
+	}
+
+	files := map[string][]byte{}
+	total := 0
+	for _, f := range entries {
+		name := strings.TrimPrefix(f.Name, prefix)
+		if f.UncompressedSize64 > maxThemeFileBytes {
+			return nil, fmt.Errorf("%s: larger than %d MB", name, maxThemeFileBytes>>20)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		content, err := io.ReadAll(io.LimitReader(rc, int64(min(maxThemeFileBytes, maxThemeUnpackedBytes-total))+1))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if len(content) > maxThemeFileBytes {
+			return nil, fmt.Errorf("%s: larger than %d MB", name, maxThemeFileBytes>>20)
+		}
+		if total += len(content); total > maxThemeUnpackedBytes {
+			return nil, errTooLarge
+		}
+		files[name] = content
+	}
+	return files, nil
+}
+
+var (
+	builtinThemeOnce sync.Once
+	builtinTheme     *PortalTheme
+)
+
+// defaultTheme is the theme compiled into the binary; it always renders
+func defaultTheme() *PortalTheme {
+	builtinThemeOnce.Do(func() {
+		root := "themes/" + defaultThemeName
+		files := map[string][]byte{}
+		err := fs.WalkDir(builtinThemeFS, root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := builtinThemeFS.ReadFile(p)
+			files[strings.TrimPrefix(p, root+"/")] = data
+			return err
+		})
+		if err == nil {
+			builtinTheme, err = newTheme(defaultThemeName, files)
+		}
+		if err != nil {
+			fatal("Built-in portal theme is broken", "error", err)
+		}
+		builtinTheme.BuiltIn = true
+		builtinTheme.Description = "Built-in theme"
+	})
+	return builtinTheme
+}
+
+type cachedTheme struct {
+	theme    *PortalTheme
+	err      error // the stored archive is broken
+	loadedAt time.Time
+}
+
+// themeCache keeps parsed uploaded themes, and the error of a broken one so
+// it is not unpacked again on every page view; other instances pick up a
+// replaced theme within themeCacheTTL. Names that are not stored are not
+// cached: they come from guests, who could fill the cache with them.
+type themeCache struct {
+	store ThemeStore
+
+	mu     sync.Mutex
+	themes map[string]cachedTheme
+}
+
+func newThemeCache(store ThemeStore) *themeCache {
+	return &themeCache{store: store, themes: map[string]cachedTheme{}}
+}
+
+// Load returns a parsed theme by name, nil when it does not exist
+func (c *themeCache) Load(name string) (*PortalTheme, error) {
+	if name == defaultThemeName {
+		return defaultTheme(), nil
+	}
+	if !themeName.MatchString(name) {
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	cached, ok := c.themes[name]
+	c.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < themeCacheTTL {
+		return cached.theme, cached.err
+	}
+
+	stored, err := c.store.ThemeArchive(name)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	t, err := parseStoredTheme(name, stored)
+	c.mu.Lock()
+	c.themes[name] = cachedTheme{theme: t, err: err, loadedAt: time.Now()}
+	c.mu.Unlock()
+	return t, err
+}
+
+func parseStoredTheme(name string, stored *StoredTheme) (*PortalTheme, error) {
+	files, err := readThemeArchive(stored.Archive)
+	if err != nil {
+		return nil, fmt.Errorf("theme %q: %v", name, err)
+	}
+	t, err := newTheme(name, files)
+	if err != nil {
+		return nil, fmt.Errorf("theme %q: %v", name, err)
+	}
+	t.UploadedBy = stored.UploadedBy
+	t.CreatedAt = &stored.CreatedAt
+	return t, nil
+}
+
+func (c *themeCache) Forget(name string) {
+	c.mu.Lock()
+	delete(c.themes, name)
+	c.mu.Unlock()
+}
+
+// GetThemes lists the built-in theme and every uploaded one
+func (s *Server) GetThemes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	names, err := s.Themes.ThemeNames()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load themes", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load themes", nil)
+		return
+	}
+
+	themes := []*PortalTheme{defaultTheme()}
+	for _, name := range names {
+		t, err := s.themeCache.Load(name)
+		if err != nil || t == nil {
+			slog.WarnContext(r.Context(), "Theme unusable", "theme", name, "error", err)
+			continue
+		}
+		themes = append(themes, t)
+	}
+	json.NewEncoder(w).Encode(themes)
+}
+
+// UploadTheme installs (or replaces) a theme from a zip upload. The name comes
+// from the "name" form field, else the file name. The package is parsed and
+// test-rendered before it is stored.
+func (s *Server) UploadTheme(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+	admin := requestAdmin(r)
+	if !s.allow(w, r, limitUpload, uploadLimitKeys(r, admin)) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxThemeArchiveBytes+(1<<20))
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Theme archive is larger than %d MB", maxThemeArchiveBytes>>20), nil)
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "Theme archive (file) is required", nil)
+		return
+	}
+	defer file.Close()
+
+	name := strings.ToLower(strings.TrimSpace(r.FormValue("name")))
+	if name == "" {
+		name = strings.ToLower(strings.TrimSuffix(path.Base(header.Filename), path.Ext(header.Filename)))
+	}
+	if !themeName.MatchString(name) {
+		writeValidationErrors(w, ValidationErrors{"name": "must be lowercase letters, digits and dashes"})
+		return
+	}
+	if name == defaultThemeName {
+		writeValidationErrors(w, ValidationErrors{"name": "the built-in theme cannot be replaced"})
+		return
+	}
+
+	archive, err := io.ReadAll(io.LimitReader(file, maxThemeArchiveBytes+1))
+	if err != nil || len(archive) > maxThemeArchiveBytes {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Theme archive is larger than %d MB", maxThemeArchiveBytes>>20), nil)
+		return
+	}
+	files, err := readThemeArchive(archive)
+	if err == nil {
+		_, err = newTheme(name, files)
+	}
+	if err != nil {
+		slog.InfoContext(r.Context(), "Theme upload rejected", "theme", name, "error", err)
+		writeValidationErrors(w, ValidationErrors{"file": err.Error()})
+		return
+	}
+
+	if err := s.Themes.SaveTheme(StoredTheme{Name: name, Archive: archive, UploadedBy: admin}); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save theme", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save theme", nil)
+		return
+	}
+	s.themeCache.Forget(name)
+
+	t, _ := s.themeCache.Load(name)
+	slog.InfoContext(r.Context(), "Theme uploaded", "theme", name, "files", len(files))
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "theme": t})
+}
+
+// DeleteTheme removes an uploaded theme that no site uses
+func (s *Server) DeleteTheme(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !s.requireSuperAdmin(w, r) {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if name == defaultThemeName {
+		writeJSONError(w, http.StatusConflict, "The built-in theme cannot be deleted", nil)
+		return
+	}
+
+	users, err := s.Themes.ThemeSites(name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to load theme", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete theme", nil)
+		return
+	}
+	if len(users) > 0 {
+		writeJSONError(w, http.StatusConflict, "Theme is in use by "+strings.Join(users, ", "), nil)
+		return
+	}
+
+	found, err := s.Themes.DeleteTheme(name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete theme", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete theme", nil)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Theme not found", nil)
+		return
+	}
+	s.themeCache.Forget(name)
+	slog.InfoContext(r.Context(), "Theme deleted", "theme", name)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// ServeThemeAsset serves a theme's static/ files to the rendered portal
+func (s *Server) ServeThemeAsset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	t, err := s.themeCache.Load(vars["name"])
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to serve theme asset", "error", err)
+		http.Error(w, "Failed to load theme", http.StatusInternalServerError)
+		return
+	}
+	var data []byte
+	if t != nil {
+		data = t.assets[vars["path"]]
+	}
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(vars["path"]))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(data)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig is whether and how the backend terminates TLS itself, from the
+// environment. Without it (the default) the backend serves plain HTTP on
+// LISTEN_ADDR behind a proxy such as deploy/nginx.conf.
+//
+//	TLS_MODE            off, acme (automatic certificates) or files
+//	TLS_DOMAINS         comma-separated hostnames to get certificates for (acme)
+//	TLS_CERT_FILE       certificate chain (files); reloaded when it changes
+//	TLS_KEY_FILE        private key (files)
+//	ACME_DIRECTORY_URL  ACME directory (Let's Encrypt); point it at a local
+//	                    Pebble to test
+//	ACME_CA_CERT        PEM bundle to trust for the ACME directory, e.g. Pebble's CA
+//	ACME_EMAIL          contact address for the ACME account
+//	ACME_CACHE_DIR      where the account key and certificates are kept (acme-cache)
+//	HTTPS_ADDR          HTTPS listen address (0.0.0.0:443)
+//	HTTP_REDIRECT_ADDR  plain HTTP listener that redirects to HTTPS, answers
+//	                    HTTP-01 challenges and captive-portal probes (0.0.0.0:80)
+type TLSConfig struct {
+	Mode         string
+	Domains      []string
+	CertFile     string
+	KeyFile      string
+	DirectoryURL string
+	CACert       string
+	Email        string
+	CacheDir     string
+	HTTPSAddr    string
+	RedirectAddr string
+}
+
+// The TLS modes
+const (
+	tlsOff   = "off"
+	tlsACME  = "acme"
+	tlsFiles = "files"
+)
+
+func tlsConfigFromEnv() (TLSConfig, error) {
+	env := func(name, def string) string {
+		if v := CleanEnv(os.Getenv(name)); v != "" {
+			return v
+		}
+		return def
+	}
+	cfg := TLSConfig{
+		Mode:         strings.ToLower(env("TLS_MODE", tlsOff)),
+		CertFile:     env("TLS_CERT_FILE", ""),
+		KeyFile:      env("TLS_KEY_FILE", ""),
+		DirectoryURL: env("ACME_DIRECTORY_URL", autocert.DefaultACMEDirectory),
+		CACert:       env("ACME_CA_CERT", ""),
+		Email:        env("ACME_EMAIL", ""),
+		CacheDir:     env("ACME_CACHE_DIR", "acme-cache"),
+		HTTPSAddr:    env("HTTPS_ADDR", "0.0.0.0:443"),
+		RedirectAddr: env("HTTP_REDIRECT_ADDR", "0.0.0.0:80"),
+	}
+	for _, d := range strings.Split(env("TLS_DOMAINS", ""), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			cfg.Domains = append(cfg.Domains, strings.ToLower(d))
+		}
+	}
+
+	switch cfg.Mode {
+	case tlsOff:
+	case tlsACME:
+		if len(cfg.Domains) == 0 {
+			return cfg, fmt.Errorf("TLS_MODE=acme needs TLS_DOMAINS")
+		}
+	case tlsFiles:
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return cfg, fmt.Errorf("TLS_MODE=files needs TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+	default:
+		return cfg, fmt.Errorf("unknown TLS_MODE %q (use off, acme or files)", cfg.Mode)
+	}
+	return cfg, nil
+}
+
+// newServers builds the servers to run: one plain HTTP server when TLS is
+// off, otherwise the HTTPS server and the plain HTTP one redirecting to it
+func newServers(cfg HTTPConfig, t TLSConfig, handler http.Handler) ([]*http.Server, error) {
+	if t.Mode == tlsOff {
+		return []*http.Server{newHTTPServer(cfg, handler)}, nil
+	}
+
+	httpsCfg := cfg
+	httpsCfg.Addr = t.HTTPSAddr
+	https := newHTTPServer(httpsCfg, handler)
+
+	redirectCfg := cfg
+	redirectCfg.Addr = t.RedirectAddr
+	redirect := redirectToHTTPS(handler, t.HTTPSAddr)
+
+	switch t.Mode {
+	case tlsACME:
+		m, err := newCertManager(t)
+		if err != nil {
+			return nil, err
+		}
+		// TLS-ALPN-01 is answered in the handshake, HTTP-01 on the redirect listener
+		https.TLSConfig = m.TLSConfig()
+		redirect = m.HTTPHandler(redirect)
+	case tlsFiles:
+		certs, err := newCertFiles(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		https.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, NextProtos: []string{"h2", "http/1.1"}}
+	}
+	https.TLSConfig.MinVersion = tls.VersionTLS12
+
+	return []*http.Server{https, newHTTPServer(redirectCfg, redirect)}, nil
+}
+
+// newCertManager gets and renews certificates for the configured domains from
+// the ACME directory
+func newCertManager(t TLSConfig) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: t.DirectoryURL}
+	if t.CACert != "" {
+		pem, err := os.ReadFile(t.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("ACME_CA_CERT: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ACME_CA_CERT: no certificates in %s", t.CACert)
+		}
+		client.HTTPClient = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(t.CacheDir),
+		HostPolicy: autocert.HostWhitelist(t.Domains...),
+		Email:      t.Email,
+		Client:     client,
+	}, nil
+}
+
+// certFiles serves a certificate from files, picking up a renewed one (say,
+// by certbot) on the first handshake after the files change
+type certFiles struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertFiles(certFile, keyFile string) (*certFiles, error) {
+	c := &certFiles{certFile: certFile, keyFile: keyFile}
+	if _, err := c.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certFiles) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTime, err := newestModTime(c.certFile, c.keyFile)
+	if err != nil && c.cert == nil {
+		return nil, err
+	}
+	if err == nil && modTime.After(c.modTime) {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		switch {
+		case err == nil:
+			c.cert, c.modTime = &cert, modTime
+			slog.Info("TLS certificate loaded", "file", c.certFile)
+		case c.cert == nil:
+			return nil, err
+		default:
+			// Likely caught halfway through a renewal; the next handshake tries again
+			slog.Warn("TLS certificate reload failed, keeping the current one", "error", err)
+		}
+	}
+	return c.cert, nil
+}
+
+func newestModTime(files ...string) (time.Time, error) {
+	var newest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return newest, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// captiveProbePaths are the URLs phones and laptops fetch over plain HTTP to
+// detect a captive portal. Redirecting them to HTTPS would break detection,
+// so they are served as they are.
+var captiveProbePaths = map[string]bool{
+	"/generate_204":                  true, // Android, Chrome
+	"/gen_204":                       true,
+	"/hotspot-detect.html":           true, // Apple
+	"/library/test/success.html":     true,
+	"/connecttest.txt":               true, // Windows
+	"/ncsi.txt":                      true,
+	"/redirect":                      true,
+	"/success.txt":                   true, // Firefox
+	"/canonical.html":                true,
+	"/check_network_status.txt":      true, // Ubuntu, GNOME
+	"/kindle-wifi/wifistub.html":     true, // Kindle
+	"/kindle-wifi/wifiredirect.html": true,
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL over HTTPS,
+// except captive-portal probes, which app answers directly
+func redirectToHTTPS(app http.Handler, httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if captiveProbePaths[strings.ToLower(r.URL.Path)] {
+			app.ServeHTTP(w, r)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
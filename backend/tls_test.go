@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	cases := []struct {
+		httpsAddr, target, location string
+	}{
+		{"0.0.0.0:443", "http://wifi.example.com/portal?mac=aa", "https://wifi.example.com/portal?mac=aa"},
+		{"0.0.0.0:443", "http://wifi.example.com:80/", "https://wifi.example.com/"},
+		{"0.0.0.0:8443", "http://wifi.example.com/api/settings", "https://wifi.example.com:8443/api/settings"},
+		{"0.0.0.0:443", "http://wifi.example.com/generate_204", ""},
+		{"0.0.0.0:443", "http://captive.apple.com/hotspot-detect.html", ""},
+		{"0.0.0.0:443", "http://www.msftconnecttest.com/connecttest.txt", ""},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		redirectToHTTPS(app, c.httpsAddr).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, c.target, nil))
+		if c.location == "" {
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("%s: captive probe got %d, want it served", c.target, rec.Code)
+			}
+			continue
+		}
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != c.location {
+			t.Errorf("%s: got %d to %q, want 301 to %q", c.target, rec.Code, rec.Header().Get("Location"), c.location)
+		}
+	}
+}
+
+func TestTLSConfigFromEnv(t *testing.T) {
+	t.Setenv("TLS_MODE", "acme")
+	if _, err := tlsConfigFromEnv(); err == nil {
+		t.Error("acme without TLS_DOMAINS accepted")
+	}
+
+	t.Setenv("TLS_DOMAINS", "Wifi.Example.com, portal.example.com")
+	t.Setenv("ACME_DIRECTORY_URL", "https://localhost:14000/dir")
+	cfg, err := tlsConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Domains) != 2 || cfg.Domains[0] != "wifi.example.com" {
+		t.Errorf("domains %v", cfg.Domains)
+	}
+	m, err := newCertManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Client.DirectoryURL != "https://localhost:14000/dir" {
+		t.Errorf("directory %q", m.Client.DirectoryURL)
+	}
+	if err := m.HostPolicy(context.Background(), "portal.example.com"); err != nil {
+		t.Errorf("configured domain refused: %v", err)
+	}
+	if err := m.HostPolicy(context.Background(), "evil.example.com"); err == nil {
+		t.Error("unconfigured domain allowed")
+	}
+
+	t.Setenv("TLS_MODE", "files")
+	if _, err := tlsConfigFromEnv(); err == nil {
+		t.Error("files without TLS_CERT_FILE accepted")
+	}
+}
+
+func TestServeTLSFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	roots := x509.NewCertPool()
+	roots.AddCert(writeSelfSigned(t, certFile, keyFile, "first"))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	})
+	servers, err := newServers(HTTPConfig{ReadHeaderTimeout: time.Second}, TLSConfig{
+		Mode: tlsFiles, CertFile: certFile, KeyFile: keyFile, HTTPSAddr: l.Addr().String(),
+	}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	https := servers[0]
+	go https.ServeTLS(l, "", "")
+	defer https.Close()
+
+	get := func(roots *x509.CertPool) (string, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"}}}
+		resp, err := client.Get("https://" + l.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		raw, _ := io.ReadAll(resp.Body)
+		return string(raw), nil
+	}
+	if body, err := get(roots); err != nil || body != "secure" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+
+	// A renewed certificate is picked up without a restart
+	renewed := x509.NewCertPool()
+	renewed.AddCert(writeSelfSigned(t, certFile, keyFile, "second"))
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if body, err := get(renewed); err != nil || body != "secure" {
+		t.Fatalf("after renewal got %q, %v", body, err)
+	}
+}
+
+// writeSelfSigned writes a certificate for localhost and its key
+func writeSelfSigned(t *testing.T, certFile, keyFile, serial string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          new(big.Int).SetBytes([]byte(serial)),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
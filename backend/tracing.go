@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the spans the backend creates itself
+const tracerName = "wifi-portal-backend"
+
+// setupTracing exports spans over OTLP/HTTP when a collector is configured
+// with the standard OpenTelemetry variables:
+//
+//	OTEL_EXPORTER_OTLP_ENDPOINT         collector, e.g. http://localhost:4318
+//	OTEL_EXPORTER_OTLP_TRACES_ENDPOINT  or just for traces
+//	OTEL_TRACES_EXPORTER                otlp to use the default localhost:4318
+//	OTEL_SERVICE_NAME                   service name (wifi-portal-backend)
+//	OTEL_TRACES_SAMPLER(_ARG)           sampling, e.g. parentbased_traceidratio 0.1
+//
+// Without them spans are not recorded at all. The returned function flushes
+// the spans still buffered; call it on shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	noop := func(context.Context) error { return nil }
+
+	enabled := CleanEnv(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")) != "" ||
+		CleanEnv(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")) != "" ||
+		strings.EqualFold(CleanEnv(os.Getenv("OTEL_TRACES_EXPORTER")), "otlp")
+	if !enabled || strings.EqualFold(CleanEnv(os.Getenv("OTEL_SDK_DISABLED")), "true") {
+		return noop, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return noop, err
+	}
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewSchemaless(semconv.ServiceName(tracerName)),
+	)
+	if err != nil {
+		return noop, err
+	}
+	// OTEL_SERVICE_NAME, when set, wins over the default name
+	if env, err := resource.New(ctx, resource.WithFromEnv()); err == nil {
+		res, _ = resource.Merge(res, env)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("Tracing enabled, exporting over OTLP")
+	return provider.Shutdown, nil
+}
+
+// traceRequests starts a server span for every request, continuing the trace
+// of a caller that sent a traceparent header. The span is named after the
+// route once the router has matched one (see setRoute).
+func traceRequests(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.server",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}),
+	)
+}
+
+// nameSpan names the request's span after the matched route
+func nameSpan(r *http.Request, route string) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(r.Method + " " + route)
+	span.SetAttributes(semconv.HTTPRoute(route))
+}
+
+// tracingTransport puts a client span around each outbound call to the OAuth
+// providers. Unlike otelhttp's transport it records the URL without its query
+// string, which carries codes, client secrets and access tokens. No trace
+// headers are sent to the providers.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := otel.Tracer(tracerName).Start(req.Context(), req.Method+" "+req.URL.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.ServerAddress(req.URL.Host),
+			semconv.URLFull(req.URL.Scheme+"://"+req.URL.Host+req.URL.Path),
+		),
+	)
+	defer span.End()
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		// The error may quote the URL, query string included
+		span.SetStatus(codes.Error, redactString(err.Error()))
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
+
+// openTracedDB is sql.Open with a span around each query. Only the statement
+// is recorded, never its arguments.
+func openTracedDB(driver, dsn string, system attribute.KeyValue) (*sql.DB, error) {
+	return otelsql.Open(driver, dsn,
+		otelsql.WithAttributes(system),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			OmitConnectorConnect: true,
+		}),
+	)
+}
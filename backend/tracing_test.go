@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	setupTracing(context.Background()) // the W3C propagator; no exporter configured
+
+	ts := newTestServer(t, newTestSQLiteStore(t))
+	const parentTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	rec := ts.do("GET", "/api/ads/1/translations", nil, "traceparent", "00-"+parentTrace+"-00f067aa0ba902b7-01")
+	if rec.Header().Get(requestIDHeader) == "" {
+		t.Error("no request ID header")
+	}
+
+	provider.ForceFlush(context.Background())
+	var server sdktrace.ReadOnlySpan
+	queries := 0
+	for _, s := range recorder.Ended() {
+		if s.Name() == "GET /api/ads/{id}/translations" {
+			server = s
+		}
+		for _, a := range s.Attributes() {
+			if a.Key == "db.system" && a.Value.AsString() == "sqlite" {
+				queries++
+			}
+		}
+	}
+	if server == nil {
+		t.Fatalf("no server span named after the route")
+	}
+	if got := server.SpanContext().TraceID().String(); got != parentTrace {
+		t.Errorf("server span trace %s, want the caller's %s", got, parentTrace)
+	}
+	if queries == 0 {
+		t.Error("no database spans")
+	}
+
+	// Outbound calls are traced without their query string
+	oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("traceparent") != "" {
+			t.Error("trace headers sent to the provider")
+		}
+	}))
+	defer oauth.Close()
+	ctx, span := otel.Tracer("test").Start(context.Background(), "callback")
+	resp, err := ts.srv.outboundGet(ctx, oauth.URL+"/me?access_token=secret-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	span.End()
+
+	var client sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Parent().SpanID() == span.SpanContext().SpanID() {
+			client = s
+		}
+	}
+	if client == nil {
+		t.Fatal("no client span under the callback span")
+	}
+	for _, a := range client.Attributes() {
+		if strings.Contains(a.Value.Emit(), "secret-token") {
+			t.Errorf("client span attribute %s leaks the token: %s", a.Key, a.Value.Emit())
+		}
+		if a.Key == attribute.Key("url.full") && a.Value.AsString() != oauth.URL+"/me" {
+			t.Errorf("url.full = %s", a.Value.AsString())
+		}
+	}
+
+	// Logs written with a traced context carry its trace ID
+	var buf bytes.Buffer
+	slog.New(newLogHandler(&buf, "json", "info")).InfoContext(ctx, "Guest login callback")
+	if !strings.Contains(buf.String(), `"trace_id":"`+span.SpanContext().TraceID().String()+`"`) {
+		t.Errorf("log lacks the trace ID: %s", buf.String())
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	maxImageUploadBytes = 10 << 20
+	maxVideoUploadBytes = 50 << 20
+	maxImageDimension   = 8000     // px, per side
+	maxImagePixels      = 40000000 // 40 MP, keeps decoding memory bounded
+)
+
+// uploadTypes is the allowlist of sniffed content types and the extension they are stored with
+var uploadTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+	"video/mp4":  ".mp4",
+}
+
+// UploadError carries the HTTP status a rejected upload should be answered with
+type UploadError struct {
+	Status  int
+	Message string
+}
+
+func (e *UploadError) Error() string { return e.Message }
+
+func uploadErrorf(status int, format string, args ...interface{}) *UploadError {
+	return &UploadError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// StoredUpload describes a file accepted by the upload pipeline
+type StoredUpload struct {
+	Filename    string `json:"filename"`
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Hash        string `json:"hash"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+}
+
+func (s *Server) UploadFile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	if !s.allow(w, r, limitUpload, uploadLimitKeys(r, admin)) {
+		return
+	}
+
+	// Hard cap on the whole request; the per-type limits are checked below
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadBytes+(1<<20))
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "File too large", nil)
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "Invalid multipart form", nil)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "No file received", nil)
+		return
+	}
+	defer file.Close()
+
+	// A background upload goes live on a site; check the admin may manage it
+	// before anything is stored
+	isAd := r.FormValue("is_ad") == "true"
+	var site Site
+	if !isAd {
+		if site, ok = s.adminSite(w, r); !ok {
+			return
+		}
+	}
+
+	staged, err := stageUpload(file)
+	if err != nil {
+		var uerr *UploadError
+		if errors.As(err, &uerr) {
+			slog.InfoContext(r.Context(), "Upload rejected", "filename", header.Filename, "reason", uerr.Message)
+			writeJSONError(w, uerr.Status, uerr.Message, nil)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Upload failed", "filename", header.Filename, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save file", nil)
+		return
+	}
+	defer staged.Remove()
+	stored := &staged.StoredUpload
+	s.metrics.uploadBytes.Observe(float64(stored.Size))
+
+	media, deduplicated, err := s.storeUpload(r, staged, header.Filename)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Upload failed", "filename", header.Filename, "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save file", nil)
+		return
+	}
+	if deduplicated {
+		slog.InfoContext(r.Context(), "Upload is a duplicate", "filename", header.Filename, "media", media.ID, "url", media.URL)
+	} else {
+		slog.InfoContext(r.Context(), "Upload stored", "filename", header.Filename, "url", stored.URL, "content_type", stored.ContentType, "size", stored.Size, "storage", s.Storage.Name())
+	}
+
+	if !isAd {
+		if _, err := s.saveSettings(site.ID, settingValues(map[string]string{"background_image": fmt.Sprintf("url(%s)", media.URL)}), admin, "upload"); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to set background image", "site", site.Slug, "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to set background image", nil)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"url":          media.URL,
+		"file":         stored,
+		"variants":     media.Variants,
+		"media":        media,
+		"deduplicated": deduplicated,
+	})
+}
+
+// storeUpload puts a staged upload into storage and the media library.
+// Bytes already in the library are not stored again; the existing entry is
+// returned (with the new tags merged in) and deduplicated is true.
+func (s *Server) storeUpload(r *http.Request, staged *StagedUpload, originalName string) (*Media, bool, error) {
+	ctx := r.Context()
+	tags := parseTags(r.FormValue("tags"))
+
+	existing, err := s.Media.MediaByHash(staged.Hash)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Media lookup failed", "hash", staged.Hash, "error", err)
+	}
+	if existing != nil && mediaStillStored(ctx, s.Storage, existing) {
+		if len(tags) > 0 {
+			if err := s.addMediaTags(existing, tags); err != nil {
+				slog.WarnContext(r.Context(), "Failed to tag media", "media", existing.ID, "error", err)
+			}
+		}
+		staged.URL = existing.URL
+		return existing, true, nil
+	}
+
+	media := &Media{
+		Hash:         staged.Hash,
+		ContentType:  staged.ContentType,
+		Size:         staged.Size,
+		Width:        staged.Width,
+		Height:       staged.Height,
+		Uploader:     requestAdmin(r),
+		OriginalName: originalName,
+		Tags:         tags,
+	}
+	if processableImage(staged.ContentType) {
+		variants, err := processImageVariants(ctx, s.Storage, staged)
+		if err != nil {
+			return nil, false, fmt.Errorf("process image: %w", err)
+		}
+		slog.InfoContext(r.Context(), "Image variants generated", "variants", len(variants.Variants), "filename", staged.Filename)
+		media.Variants = variants
+		for _, v := range variants.Variants {
+			media.Keys = append(media.Keys, v.Key)
+		}
+	} else {
+		if err := storeStagedUpload(ctx, s.Storage, staged); err != nil {
+			return nil, false, err
+		}
+		media.Keys = []string{staged.Filename}
+	}
+	media.URL = staged.URL
+
+	if existing != nil {
+		// Files had gone missing; keep the old tags on the refreshed entry
+		media.Tags = normalizeTags(append(existing.Tags, tags...))
+	}
+	if err := s.Media.SaveMedia(media); err != nil {
+		return nil, false, fmt.Errorf("record media: %w", err)
+	}
+	return media, false, nil
+}
+
+// StagedUpload is a validated upload waiting in a temp file to be stored
+type StagedUpload struct {
+	StoredUpload
+	Path string
+}
+
+func (s *StagedUpload) Remove() {
+	os.Remove(s.Path)
+}
+
+// stageUpload streams an upload into a temp file after checking its sniffed
+// type, size, dimensions and that its head and image metadata carry no
+// markup. It is named by content hash; the client's filename is never used.
+func stageUpload(src io.Reader) (*StagedUpload, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return nil, uploadErrorf(http.StatusBadRequest, "Empty file")
+		}
+		return nil, err
+	}
+	head = head[:n]
+
+	contentType := sniffUploadType(head)
+	ext, ok := uploadTypes[contentType]
+	if !ok {
+		if looksLikeMarkup(head) {
+			return nil, uploadErrorf(http.StatusUnsupportedMediaType, "SVG and HTML files are not allowed")
+		}
+		return nil, uploadErrorf(http.StatusUnsupportedMediaType, "Unsupported file type %s (allowed: JPEG, PNG, WebP, GIF, MP4)", contentType)
+	}
+
+	limit := int64(maxImageUploadBytes)
+	if contentType == "video/mp4" {
+		limit = maxVideoUploadBytes
+	}
+
+	tmp, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	staged := &StagedUpload{Path: tmp.Name()}
+	defer tmp.Close()
+
+	fail := func(err error) (*StagedUpload, error) {
+		tmp.Close()
+		staged.Remove()
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hasher), io.LimitReader(io.MultiReader(bytes.NewReader(head), src), limit+1))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return fail(uploadErrorf(http.StatusRequestEntityTooLarge, "File too large"))
+		}
+		return fail(err)
+	}
+	if written > limit {
+		return fail(uploadErrorf(http.StatusRequestEntityTooLarge, "File too large (max %d MB for %s)", limit>>20, contentType))
+	}
+	if found := markupIn(head); found != "" {
+		return fail(uploadErrorf(http.StatusUnprocessableEntity, "File contains embedded markup (%s)", found))
+	}
+
+	staged.ContentType = contentType
+	staged.Size = written
+	staged.Hash = hex.EncodeToString(hasher.Sum(nil))
+	staged.Filename = staged.Hash[:32] + ext
+
+	if strings.HasPrefix(contentType, "image/") {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return fail(err)
+		}
+		width, height, err := checkImage(tmp)
+		if err != nil {
+			return fail(err)
+		}
+		staged.Width, staged.Height = width, height
+
+		found, err := imageMetadataMarkup(tmp, contentType)
+		if err != nil {
+			return fail(err)
+		}
+		if found != "" {
+			return fail(uploadErrorf(http.StatusUnprocessableEntity, "File contains embedded markup (%s)", found))
+		}
+	}
+	return staged, nil
+}
+
+// storeStagedUpload copies a staged upload into storage as-is.
+// Same hash means same bytes, so an existing object is kept.
+func storeStagedUpload(ctx context.Context, store Storage, staged *StagedUpload) error {
+	staged.URL = store.URL(staged.Filename)
+	if exists, err := store.Exists(ctx, staged.Filename); err == nil && exists {
+		return nil
+	}
+	f, err := os.Open(staged.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return store.Put(ctx, staged.Filename, f, staged.Size, staged.ContentType)
+}
+
+func sniffUploadType(head []byte) string {
+	contentType := http.DetectContentType(head)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return contentType
+}
+
+// checkImage enforces the dimension limits and fully decodes the image,
+// so a file that only starts like an image is rejected
+func checkImage(f io.ReadSeeker) (int, int, error) {
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, uploadErrorf(http.StatusUnprocessableEntity, "File is not a valid image")
+	}
+	if cfg.Width > maxImageDimension || cfg.Height > maxImageDimension || cfg.Width*cfg.Height > maxImagePixels {
+		return 0, 0, uploadErrorf(http.StatusUnprocessableEntity, "Image is too large (%dx%d, max %dpx per side)", cfg.Width, cfg.Height, maxImageDimension)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	if _, _, err := image.Decode(f); err != nil {
+		return 0, 0, uploadErrorf(http.StatusUnprocessableEntity, "File is not a valid image")
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// markupPatterns betray polyglot files: a valid image that a browser could also run as HTML/SVG/PHP
+var markupPatterns = [][]byte{
+	[]byte("<script"),
+	[]byte("<svg"),
+	[]byte("<html"),
+	[]byte("<iframe"),
+	[]byte("<?php"),
+	[]byte("javascript:"),
+}
+
+func looksLikeMarkup(b []byte) bool {
+	return markupIn(b) != "" || bytes.HasPrefix(bytes.TrimSpace(bytes.ToLower(b)), []byte("<?xml"))
+}
+
+// markupIn returns the first of markupPatterns found in b, if any
+func markupIn(b []byte) string {
+	lower := bytes.ToLower(b)
+	for _, p := range markupPatterns {
+		if bytes.Contains(lower, p) {
+			return string(p)
+		}
+	}
+	return ""
+}
+
+// maxMetadataScan bounds how much of one metadata segment is searched
+const maxMetadataScan = 1 << 20
+
+// imageMetadataMarkup searches the text a JPEG or PNG can carry beside its
+// pixels (JPEG APPn and comment segments, PNG text chunks) for markup. The
+// compressed pixel data is not searched: on random bytes the short patterns
+// would match every so often and reject valid images.
+func imageMetadataMarkup(f io.ReadSeeker, contentType string) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	switch contentType {
+	case "image/jpeg":
+		return jpegMetadataMarkup(f)
+	case "image/png":
+		return pngMetadataMarkup(f)
+	}
+	return "", nil
+}
+
+// jpegMetadataMarkup walks the segments up to the start of the scan data
+func jpegMetadataMarkup(f io.ReadSeeker) (string, error) {
+	var soi [2]byte
+	if _, err := io.ReadFull(f, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return "", nil
+	}
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(f, hdr[:2]); err != nil {
+			return "", nil
+		}
+		if hdr[0] != 0xFF {
+			return "", nil
+		}
+		marker := hdr[1]
+		switch {
+		case marker == 0xFF: // fill byte
+			f.Seek(-1, io.SeekCurrent)
+			continue
+		case marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			continue
+		case marker == 0xDA || marker == 0xD9: // start of scan, end of image
+			return "", nil
+		}
+		if _, err := io.ReadFull(f, hdr[2:]); err != nil {
+			return "", nil
+		}
+		length := int64(hdr[2])<<8 | int64(hdr[3]) - 2
+		if length < 0 {
+			return "", nil
+		}
+		if (marker >= 0xE0 && marker <= 0xEF) || marker == 0xFE {
+			data, err := io.ReadAll(io.LimitReader(f, length))
+			if err != nil {
+				return "", err
+			}
+			if found := markupIn(data); found != "" {
+				return found, nil
+			}
+			continue
+		}
+		if _, err := f.Seek(length, io.SeekCurrent); err != nil {
+			return "", err
+		}
+	}
+}
+
+// pngMetadataMarkup checks the text chunks, skipping over the image data
+func pngMetadataMarkup(f io.ReadSeeker) (string, error) {
+	if _, err := f.Seek(8, io.SeekStart); err != nil {
+		return "", err
+	}
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(f, hdr[:]); err != nil {
+			return "", nil
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[:4]))
+		switch string(hdr[4:]) {
+		case "tEXt", "iTXt", "zTXt":
+			scan := min(length, maxMetadataScan)
+			data, err := io.ReadAll(io.LimitReader(f, scan))
+			if err != nil {
+				return "", err
+			}
+			if found := markupIn(data); found != "" {
+				return found, nil
+			}
+			length -= scan
+		case "IEND":
+			return "", nil
+		}
+		if _, err := f.Seek(length+4, io.SeekCurrent); err != nil { // and the CRC
+			return "", err
+		}
+	}
+}
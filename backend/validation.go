@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// allowedLinkSchemes are the only schemes an ad may link to; anything else
+// (javascript:, data:, file:, ...) is rejected before it reaches the portal
+var allowedLinkSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+	"tel":    true,
+}
+
+// ValidationErrors maps a JSON field name to what is wrong with it
+type ValidationErrors map[string]string
+
+func (v ValidationErrors) Add(field, format string, args ...interface{}) {
+	if _, exists := v[field]; !exists {
+		v[field] = fmt.Sprintf(format, args...)
+	}
+}
+
+// writeJSONError writes the error envelope shared by the ad endpoints:
+// {"success": false, "message": "...", "errors": {...}}
+func writeJSONError(w http.ResponseWriter, status int, message string, errs ValidationErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body := map[string]interface{}{"success": false, "message": message}
+	if len(errs) > 0 {
+		body["errors"] = errs
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	writeJSONError(w, http.StatusUnprocessableEntity, "Validation failed", errs)
+}
+
+// validateAd normalizes the ad in place and reports every invalid field at once
+func validateAd(ad *ScheduledAd) ValidationErrors {
+	errs := ValidationErrors{}
+
+	ad.Title = strings.TrimSpace(ad.Title)
+	ad.Description = strings.TrimSpace(ad.Description)
+	ad.Image = strings.TrimSpace(ad.Image)
+	ad.Link = strings.TrimSpace(ad.Link)
+	ad.StartDate = strings.TrimSpace(ad.StartDate)
+	ad.EndDate = strings.TrimSpace(ad.EndDate)
+	ad.StartTime = strings.TrimSpace(ad.StartTime)
+	ad.EndTime = strings.TrimSpace(ad.EndTime)
+
+	switch {
+	case ad.Title == "":
+		errs.Add("title", "is required")
+	case utf8.RuneCountInString(ad.Title) > 200:
+		errs.Add("title", "must be at most 200 characters")
+	}
+	if utf8.RuneCountInString(ad.Description) > 2000 {
+		errs.Add("description", "must be at most 2000 characters")
+	}
+
+	// Text-only ads have no image. A path must be on this site: //host/... is
+	// protocol-relative and would load the image from anywhere.
+	if ad.Image != "" && (!strings.HasPrefix(ad.Image, "/") || strings.HasPrefix(ad.Image, "//")) {
+		if u, err := url.Parse(ad.Image); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.Add("image", "must be a site path (e.g. /img/...) or an http(s) URL")
+		}
+	}
+
+	if ad.Link != "" {
+		if msg := validateLink(ad.Link); msg != "" {
+			errs.Add("link", msg)
+		}
+	}
+
+	startDate, startOK := parseAdDate(errs, "start_date", &ad.StartDate)
+	endDate, endOK := parseAdDate(errs, "end_date", &ad.EndDate)
+	if startOK && endOK && endDate.Before(startDate) {
+		errs.Add("end_date", "must not be before start_date")
+	}
+
+	startTime, startTimeOK := parseAdTime(errs, "start_time", &ad.StartTime)
+	endTime, endTimeOK := parseAdTime(errs, "end_time", &ad.EndTime)
+	if startTimeOK && endTimeOK && !endTime.After(startTime) {
+		errs.Add("end_time", "must be after start_time")
+	}
+
+	if ad.CampaignID != nil && *ad.CampaignID <= 0 {
+		errs.Add("campaign_id", "must be a positive id")
+	}
+
+	return errs
+}
+
+func validateLink(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "is not a valid URL"
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if !allowedLinkSchemes[scheme] {
+		return "must use http, https, mailto or tel"
+	}
+	if (scheme == "http" || scheme == "https") && u.Host == "" {
+		return "must include a host"
+	}
+	return ""
+}
+
+// parseAdDate accepts YYYY-MM-DD (or the RFC3339 form Postgres hands back) and normalizes it
+func parseAdDate(errs ValidationErrors, field string, value *string) (time.Time, bool) {
+	if *value == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, *value); err == nil {
+			*value = t.Format("2006-01-02")
+			return t, true
+		}
+	}
+	errs.Add(field, "must be a date in YYYY-MM-DD format")
+	return time.Time{}, false
+}
+
+// parseAdTime accepts HH:MM or HH:MM:SS and normalizes it to HH:MM:SS
+func parseAdTime(errs ValidationErrors, field string, value *string) (time.Time, bool) {
+	if *value == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, *value); err == nil {
+			*value = t.Format("15:04:05")
+			return t, true
+		}
+	}
+	errs.Add(field, "must be a time in HH:MM or HH:MM:SS format")
+	return time.Time{}, false
+}
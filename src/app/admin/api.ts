@@ -7,8 +7,8 @@ export interface PageSettings {
     background_color: string
     page_title: string
     button_text: string
-    google_login_enabled: string
-    facebook_login_enabled: string
+    google_login_enabled: boolean
+    facebook_login_enabled: boolean
     google_client_id: string
     google_client_secret: string
     facebook_app_id: string
@@ -49,8 +49,8 @@ export async function getSettings(): Promise<PageSettings> {
             background_color: '#667eea',
             page_title: 'Welcome To NUANU Free WiFi',
             button_text: 'Connect to WiFi',
-            google_login_enabled: 'false',
-            facebook_login_enabled: 'false',
+            google_login_enabled: false,
+            facebook_login_enabled: false,
             google_client_id: '',
             google_client_secret: '',
             facebook_app_id: '',
@@ -1,7 +1,7 @@
 'use client'
 
 import { useState, useEffect, useRef } from 'react'
-import { getSettings, updateSettings, uploadFile, getAds, createAd, deleteAd, updateAd, type PageSettings, type ScheduledAd, API_URL } from '@/lib/api'
+import { getAdminSettings, updateSettings, uploadFile, getAds, createAd, deleteAd, updateAd, type PageSettings, type ScheduledAd, API_URL } from '@/lib/api'
 import { Upload, Save, Loader2, Image as ImageIcon, CheckCircle, Trash2, Calendar, Clock, Plus, Monitor, Pencil, X, AlertCircle, Mail } from 'lucide-react'
 import Link from 'next/link'
 import ImageCropper from '@/components/ImageCropper'
@@ -45,7 +45,7 @@ export default function AdminPage() {
         async function fetchData() {
             console.log('🔄 AdminPage: Initializing data fetch from:', API_URL)
             try {
-                const [settingsData, adsData] = await Promise.all([getSettings(), getAds()])
+                const [settingsData, adsData] = await Promise.all([getAdminSettings(), getAds()])
                 console.log('✅ AdminPage: Data fetched successfully')
 
                 setSettings(settingsData)
@@ -199,8 +199,8 @@ export default function AdminPage() {
             page_title: formData.get('page_title') as string,
             button_text: formData.get('button_text') as string,
             background_color: formData.get('background_color') as string,
-            google_login_enabled: formData.get('google_login_enabled') === 'on' ? 'true' : 'false',
-            facebook_login_enabled: formData.get('facebook_login_enabled') === 'on' ? 'true' : 'false',
+            google_login_enabled: formData.get('google_login_enabled') === 'on',
+            facebook_login_enabled: formData.get('facebook_login_enabled') === 'on',
             google_client_id: formData.get('google_client_id') as string,
             google_client_secret: formData.get('google_client_secret') as string,
             facebook_app_id: formData.get('facebook_app_id') as string,
@@ -573,7 +573,7 @@ export default function AdminPage() {
                                                 </div>
                                             </div>
                                             <label className="relative inline-flex items-center cursor-pointer">
-                                                <input type="checkbox" name="google_login_enabled" defaultChecked={settings.google_login_enabled === 'true'} className="sr-only peer" />
+                                                <input type="checkbox" name="google_login_enabled" defaultChecked={settings.google_login_enabled} className="sr-only peer" />
                                                 <div className="w-11 h-6 bg-gray-200 peer-focus:outline-none rounded-full peer peer-checked:after:translate-x-full peer-checked:after:border-white after:content-[''] after:absolute after:top-[2px] after:left-[2px] after:bg-white after:border-gray-300 after:border after:rounded-full after:h-5 after:w-5 after:transition-all peer-checked:bg-blue-600"></div>
                                             </label>
                                         </div>
@@ -602,7 +602,7 @@ export default function AdminPage() {
                                                 </div>
                                             </div>
                                             <label className="relative inline-flex items-center cursor-pointer">
-                                                <input type="checkbox" name="facebook_login_enabled" defaultChecked={settings.facebook_login_enabled === 'true'} className="sr-only peer" />
+                                                <input type="checkbox" name="facebook_login_enabled" defaultChecked={settings.facebook_login_enabled} className="sr-only peer" />
                                                 <div className="w-11 h-6 bg-gray-200 peer-focus:outline-none rounded-full peer peer-checked:after:translate-x-full peer-checked:after:border-white after:content-[''] after:absolute after:top-[2px] after:left-[2px] after:bg-white after:border-gray-300 after:border after:rounded-full after:h-5 after:w-5 after:transition-all peer-checked:bg-indigo-600"></div>
                                             </label>
                                         </div>
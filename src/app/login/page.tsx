@@ -1,7 +1,7 @@
 'use client'
 
 import { useEffect, useState } from 'react'
-import { getSettings, getAds, type PageSettings, type ScheduledAd } from '@/lib/api'
+import { getSettings, getActiveAd, type PageSettings, type ScheduledAd } from '@/lib/api'
 import { ChevronLeft, ChevronRight } from 'lucide-react'
 
 // Nuanu Logo using the provided image asset
@@ -38,7 +38,8 @@ export default function LoginPage() {
     useEffect(() => {
         async function fetchData() {
             try {
-                const [s, allAds] = await Promise.all([getSettings(), getAds()])
+                const [s, active] = await Promise.all([getSettings(), getActiveAd()])
+                const allAds = active.ad ? [active.ad] : []
                 setSettings(s)
 
                 const now = new Date()
@@ -636,7 +637,7 @@ export default function LoginPage() {
                         </form>
 
                         {/* Social Login */}
-                        {(settings.google_login_enabled === 'true' || settings.facebook_login_enabled === 'true') && (
+                        {(settings.google_login_enabled || settings.facebook_login_enabled) && (
                             <>
                                 <div className="divider">
                                     <div className="divider-line" />
@@ -645,13 +646,13 @@ export default function LoginPage() {
                                 </div>
 
                                 <div className="social-grid">
-                                    {settings.google_login_enabled === 'true' && (
+                                    {settings.google_login_enabled && (
                                         <a href={`/auth/google/login${paramsUrl}`} className="social-btn">
                                             <img src="/img/google 1.png" alt="google" />
                                             Google
                                         </a>
                                     )}
-                                    {settings.facebook_login_enabled === 'true' && (
+                                    {settings.facebook_login_enabled && (
                                         <a href={`/auth/facebook/login${paramsUrl}`} className="social-btn">
                                             <img src="/img/facebook 1.png" alt="facebook" />
                                             Facebook
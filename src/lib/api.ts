@@ -2,6 +2,12 @@
 // Fallback to localhost:8080 only if specifically needed during dev without proxy
 export const API_URL = process.env.NEXT_PUBLIC_API_URL || ''
 
+// Admin calls carry the session token the admin login stored
+function adminHeaders(headers: Record<string, string> = {}): Record<string, string> {
+    const token = typeof window !== 'undefined' ? localStorage.getItem('admin_session') : null
+    return token ? { ...headers, Authorization: `Bearer ${token}` } : headers
+}
+
 export interface PageSettings {
     background_image: string
     background_image_type: string
@@ -9,8 +15,8 @@ export interface PageSettings {
     background_color: string
     page_title: string
     button_text: string
-    google_login_enabled: string
-    facebook_login_enabled: string
+    google_login_enabled: boolean
+    facebook_login_enabled: boolean
     google_client_id: string
     google_client_secret: string
     facebook_app_id: string
@@ -58,8 +64,8 @@ export async function getSettings(): Promise<PageSettings> {
             background_color: '#667eea',
             page_title: 'Welcome To NUANU Free WiFi',
             button_text: 'Connect to WiFi',
-            google_login_enabled: 'false',
-            facebook_login_enabled: 'false',
+            google_login_enabled: false,
+            facebook_login_enabled: false,
             google_client_id: '',
             google_client_secret: '',
             facebook_app_id: '',
@@ -68,10 +74,21 @@ export async function getSettings(): Promise<PageSettings> {
     }
 }
 
+// Admin view of the settings: includes admin-only keys, secrets come back masked
+export async function getAdminSettings(): Promise<PageSettings> {
+    const res = await fetch(`${API_URL}/api/settings/admin`, {
+        cache: 'no-store',
+        method: 'GET',
+        headers: adminHeaders({ 'Content-Type': 'application/json' })
+    })
+    if (!res.ok) throw new Error(`HTTP ${res.status}: ${res.statusText}`)
+    return res.json()
+}
+
 export async function updateSettings(settings: Partial<PageSettings>) {
     const res = await fetch(`${API_URL}/api/settings`, {
         method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
+        headers: adminHeaders({ 'Content-Type': 'application/json' }),
         body: JSON.stringify(settings),
     })
     return res.json()
@@ -84,6 +101,7 @@ export async function uploadFile(file: File, isAd = false) {
 
     const res = await fetch(`${API_URL}/api/upload`, {
         method: 'POST',
+        headers: adminHeaders(),
         body: formData,
     })
     return res.json()
@@ -95,7 +113,7 @@ export async function getAds(): Promise<ScheduledAd[]> {
         const res = await fetch(`${API_URL}/api/ads`, {
             cache: 'no-store',
             method: 'GET',
-            headers: { 'Content-Type': 'application/json' }
+            headers: adminHeaders({ 'Content-Type': 'application/json' })
         })
         if (!res.ok) throw new Error(`HTTP ${res.status}: ${res.statusText}`)
         return res.json()
@@ -109,7 +127,7 @@ export async function getAds(): Promise<ScheduledAd[]> {
 export async function createAd(ad: ScheduledAd) {
     const res = await fetch(`${API_URL}/api/ads`, {
         method: 'POST',
-        headers: { 'Content-Type': 'application/json' },
+        headers: adminHeaders({ 'Content-Type': 'application/json' }),
         body: JSON.stringify(ad),
     })
     return res.json()
@@ -118,7 +136,7 @@ export async function createAd(ad: ScheduledAd) {
 export async function updateAd(id: number, ad: ScheduledAd) {
     const res = await fetch(`${API_URL}/api/ads/${id}`, {
         method: 'PUT',
-        headers: { 'Content-Type': 'application/json' },
+        headers: adminHeaders({ 'Content-Type': 'application/json' }),
         body: JSON.stringify(ad),
     })
     return res.json()
@@ -127,6 +145,7 @@ export async function updateAd(id: number, ad: ScheduledAd) {
 export async function deleteAd(id: number) {
     const res = await fetch(`${API_URL}/api/ads/${id}`, {
         method: 'DELETE',
+        headers: adminHeaders(),
     })
     return res.json()
 }
@@ -145,7 +164,7 @@ export async function getEmails(): Promise<CollectedEmail[]> {
         const res = await fetch(`${API_URL}/api/emails`, {
             cache: 'no-store',
             method: 'GET',
-            headers: { 'Content-Type': 'application/json' }
+            headers: adminHeaders({ 'Content-Type': 'application/json' })
         })
         if (!res.ok) throw new Error(`HTTP ${res.status}`)
         return res.json()